@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kylelemons/blightbot/bot"
@@ -44,41 +45,72 @@ func firstletters(acro string) string {
 	return string(letters)
 }
 
+// lock protects games and the server, started, commands and renames fields
+// of each game, which are shared between the game's goroutine, commands and
+// the ON_NICK handler.
+var lock sync.Mutex
+
 type Game struct {
 	server  *bot.Server
 	channel string
 
 	started  bool
 	commands chan gameCommand
+	renames  chan *rename // buffered, so that nick changes never block
 }
 
+// The number of nick changes which may be waiting for a game to see them.
+const renameBuffer = 64
+
 type gameCommand interface {
 	writef(string, ...interface{})
 	done()
 }
 
+// serv returns the server on which the game is played.
+func (g *Game) serv() *bot.Server {
+	lock.Lock()
+	defer lock.Unlock()
+	return g.server
+}
+
+// running returns the game's command channel, or nil if it is not running.
+func (g *Game) running() chan gameCommand {
+	lock.Lock()
+	defer lock.Unlock()
+	if !g.started {
+		return nil
+	}
+	return g.commands
+}
+
 func (g *Game) Chanf(format string, args ...interface{}) {
-	g.server.WriteMessage(bot.NewMessage("", "PRIVMSG", g.channel, fmt.Sprintf(format, args...)))
+	g.serv().WriteMessage(bot.NewMessage("", "PRIVMSG", g.channel, fmt.Sprintf(format, args...)))
 }
 
 func (g *Game) String() string {
-	return g.server.Name() + "/" + g.channel
+	return g.serv().Name() + "/" + g.channel
 }
 
+// start starts the game.  The lock must be held.
 func (g *Game) start() {
 	g.started = true
 	g.commands = make(chan gameCommand)
+	g.renames = make(chan *rename, renameBuffer)
+	commands, renames := g.commands, g.renames
 
 	go func() {
 		defer func() {
+			lock.Lock()
 			g.started = false
+			lock.Unlock()
 
 			// Just to be safe, grab any lingering commands for 60s
 			go func() {
 				reallydone := time.After(60 * time.Second)
 				for {
 					select {
-					case cmd := <-g.commands:
+					case cmd := <-commands:
 						log.Printf("Lingering acro command: %#v", cmd)
 						cmd.done()
 					case <-reallydone:
@@ -88,19 +120,42 @@ func (g *Game) start() {
 			}()
 		}()
 
-		botnick := g.server.ID().Nick
+		botnick := g.serv().ID().Nick
+
+		// Game state, kept up to date with nick changes
+		var (
+			players     = map[string]string{}
+			playerIndex []string
+			voted       = map[string]bool{}
+		)
+		renamed := func(r *rename) {
+			if sub, ok := players[r.old]; ok {
+				delete(players, r.old)
+				players[r.nick] = sub
+			}
+			if v, ok := voted[r.old]; ok {
+				delete(voted, r.old)
+				voted[r.nick] = v
+			}
+			for i, p := range playerIndex {
+				if p == r.old {
+					playerIndex[i] = r.nick
+				}
+			}
+		}
 
 		g.Chanf(`Acro is starting in %s! Type "!acro join" or "/msg %s ACRO %s JOIN" to join!`,
 			*acrostart, botnick, g.channel)
 
 		joinstop := time.After(*acrostart)
-		players := map[string]string{}
 	joins:
 		for {
 			select {
 			case <-joinstop:
 				break joins
-			case cmd := <-g.commands:
+			case r := <-renames:
+				renamed(r)
+			case cmd := <-commands:
 				switch j := cmd.(type) {
 				case *join:
 					if _, ok := players[j.nick]; ok {
@@ -132,7 +187,9 @@ func (g *Game) start() {
 			select {
 			case <-submitstop:
 				break submits
-			case cmd := <-g.commands:
+			case r := <-renames:
+				renamed(r)
+			case cmd := <-commands:
 				switch s := cmd.(type) {
 				case *submission:
 					if _, ok := players[s.nick]; !ok {
@@ -164,7 +221,6 @@ func (g *Game) start() {
 		}
 
 		votes := make([]int, 0, len(players))
-		playerIndex := make([]string, 0, len(players))
 		for player, submitted := range players {
 			if submitted == "" {
 				continue
@@ -176,14 +232,15 @@ func (g *Game) start() {
 		g.Chanf(`Type "/msg %s ACRO %s VOTE <number>" in the next %s to vote!`,
 			botnick, g.channel)
 
-		voted := map[string]bool{}
 		votestop := time.After(*acrovote)
 	votes:
 		for {
 			select {
 			case <-votestop:
 				break votes
-			case cmd := <-g.commands:
+			case r := <-renames:
+				renamed(r)
+			case cmd := <-commands:
 				switch s := cmd.(type) {
 				case *vote:
 					if voted[s.nick] {
@@ -244,28 +301,27 @@ var Acro = commander.Cmd("acro", func(s *commander.Source, r *commander.Response
 	}
 
 	var channel string
-	if args[0][0] == '#' {
+	if s.Server().IsChannel(args[0]) {
 		channel = args[0]
 		args = args[1:]
 	} else {
 		channel = s.Message().Args[0]
-		if len(channel) == 0 || channel[0] != '#' {
+		if !s.Server().IsChannel(channel) {
 			usage()
 			return
 		}
 	}
 
-	gamename := s.Server().Name() + "/" + channel
-	var game *Game
-	if g, ok := games[gamename]; ok {
-		game = g
-	} else {
-		game = &Game{
-			server:  s.Server(),
-			channel: channel,
-		}
+	gamename := s.Server().Name() + "/" + s.Server().ToLower(channel)
+	lock.Lock()
+	game, ok := games[gamename]
+	if !ok {
+		game = &Game{channel: channel}
 		games[gamename] = game
 	}
+	// Make sure the game keeps up with the server
+	game.server = s.Server()
+	lock.Unlock()
 
 	if len(args) == 0 {
 		usage()
@@ -277,21 +333,21 @@ var Acro = commander.Cmd("acro", func(s *commander.Source, r *commander.Response
 
 	switch cmd {
 	case "start":
+		lock.Lock()
+		defer lock.Unlock()
 		if game.started {
 			r.Private()
 			r.Printf("Acro has already been started in %s", channel)
 			return
 		}
 
-		// Make sure the game keeps up with the server
-		game.server = s.Server()
-
 		// Start the game
 		game.start()
 
 	case "join":
 		r.Private()
-		if !game.started {
+		commands := game.running()
+		if commands == nil {
 			r.Printf("You need to start the game before you can join it!")
 			return
 		}
@@ -299,13 +355,14 @@ var Acro = commander.Cmd("acro", func(s *commander.Source, r *commander.Response
 		j := new(join)
 		j.nick = s.ID().Nick
 		j.ret = make(chan string)
-		game.commands <- j
+		commands <- j
 		r.Private()
 		for msg := range j.ret {
 			r.Printf(msg)
 		}
 	case "vote":
-		if !game.started {
+		commands := game.running()
+		if commands == nil {
 			r.Private()
 			r.Printf("You can't vote right now.  Try starting a new game?")
 			return
@@ -328,7 +385,7 @@ var Acro = commander.Cmd("acro", func(s *commander.Source, r *commander.Response
 		v.nick = s.ID().Nick
 		v.idx = idx - 1
 		v.ret = make(chan string)
-		game.commands <- v
+		commands <- v
 		r.Private()
 		for msg := range v.ret {
 			r.Printf(msg)
@@ -337,7 +394,8 @@ var Acro = commander.Cmd("acro", func(s *commander.Source, r *commander.Response
 		args = originalArgs
 		fallthrough
 	case "submit":
-		if !game.started {
+		commands := game.running()
+		if commands == nil {
 			r.Private()
 			r.Printf("You can't submit an acronym right now.  Try starting a new game?")
 			return
@@ -347,7 +405,7 @@ var Acro = commander.Cmd("acro", func(s *commander.Source, r *commander.Response
 		sub.acro = strings.Join(args, " ")
 		sub.nick = s.ID().Nick
 		sub.ret = make(chan string)
-		game.commands <- sub
+		commands <- sub
 		r.Private()
 		for msg := range sub.ret {
 			r.Printf(msg)
@@ -398,6 +456,33 @@ type vote struct {
 	gc
 }
 
+type rename struct {
+	old, nick string
+}
+
+// Register makes running games follow players who change their nick.  Games
+// are matched by server name, so that they keep following nicks after a
+// reconnection.
+func Register(b *bot.Bot) {
+	b.OnEvent(bot.ON_NICK, func(event string, serv *bot.Server, msg *bot.Message) {
+		if len(msg.Args) < 1 {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, game := range games {
+			if !game.started || game.server.Name() != serv.Name() {
+				continue
+			}
+			select {
+			case game.renames <- &rename{old: msg.ID().Nick, nick: msg.Args[0]}:
+			default:
+				log.Printf("(%s/%s) dropped nick change %s -> %s", serv.Name(), game.channel, msg.ID().Nick, msg.Args[0])
+			}
+		}
+	})
+}
+
 type votesort struct {
 	votes []int
 	names []string
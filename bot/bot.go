@@ -1,23 +1,107 @@
 package bot
 
 import (
+	"context"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Handler func(event string, serv *Server, msg *Message)
 
+// A Registration is a handler which has been registered for an event.  By
+// default, handlers are run asynchronously (each in its own goroutine), and
+// all handlers have priority 0.
+type Registration struct {
+	bot     *Bot
+	event   string
+	handler Handler
+
+	// Protected by the bot lock
+	priority int
+	sync     bool
+	seq      int // registration order, to keep sorting stable
+
+	removed int32 // atomic
+}
+
+// Priority sets the priority of the handler.  Handlers with higher
+// priorities are called (or, for asynchronous handlers, started) first.
+// Handlers with equal priorities are called in the order in which they were
+// registered.  The registration is returned for easy chaining.
+func (r *Registration) Priority(n int) *Registration {
+	r.bot.lock.Lock()
+	defer r.bot.lock.Unlock()
+
+	r.priority = n
+	sort.Sort(registrationSorter(r.bot.callbacks[r.event]))
+	return r
+}
+
+// Sync makes the handler synchronous: it is called from the goroutine which
+// processes the server's messages, so it sees events in order and can
+// safely inspect the server's state, but no further messages are processed
+// until it returns.  Synchronous handlers must not block; in particular,
+// they must not call Server.Quit or Bot.Close.  The registration is returned
+// for easy chaining.
+func (r *Registration) Sync() *Registration {
+	r.bot.lock.Lock()
+	defer r.bot.lock.Unlock()
+
+	r.sync = true
+	return r
+}
+
+// Remove unregisters the handler.  Asynchronous handlers which have already
+// been started are not affected.
+func (r *Registration) Remove() {
+	r.bot.lock.Lock()
+	defer r.bot.lock.Unlock()
+
+	atomic.StoreInt32(&r.removed, 1)
+	regs := r.bot.callbacks[r.event]
+	for i, reg := range regs {
+		if reg == r {
+			r.bot.callbacks[r.event] = append(regs[:i:i], regs[i+1:]...)
+			break
+		}
+	}
+}
+
 type Bot struct {
 	lock    sync.RWMutex
 	id      *Identity
 	servers []*Server
 
+	// Cancelled when the bot is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // tracks network connections
+
 	ping    time.Duration
 	timeout time.Duration
 
+	floodBurst    int
+	floodInterval time.Duration
+	lagLimit      time.Duration
+
 	LogLevel int
 
-	callbacks map[string][]Handler
+	caps []string
+	sasl *SASL
+
+	altNicks []string
+	regain   time.Duration
+	nickserv *NickServ
+
+	encoding *Encoding
+	clock    Clock
+	recorder Recorder
+
+	callbacks map[string][]*Registration
+	handlers  int // number of registrations ever made
 }
 
 type Identity struct {
@@ -37,30 +121,115 @@ func (id *Identity) String() string {
 }
 
 func New(nick, user string) *Bot {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Bot{
-		LogLevel:  10,
-		id:        &Identity{Nick: nick, User: user},
-		ping:      60 * time.Second,
-		timeout:   10 * time.Second,
-		callbacks: map[string][]Handler{},
+		ctx:           ctx,
+		cancel:        cancel,
+		LogLevel:      10,
+		id:            &Identity{Nick: nick, User: user},
+		ping:          60 * time.Second,
+		timeout:       10 * time.Second,
+		floodBurst:    DefaultFloodBurst,
+		floodInterval: DefaultFloodInterval,
+		lagLimit:      DefaultLagThreshold,
+		regain:        DefaultRegainInterval,
+		encoding:      DefaultEncoding,
+		clock:         systemClock{},
+		callbacks:     map[string][]*Registration{},
 	}
 }
 
+// Run runs the bot until ctx is cancelled, when it closes the bot, or until
+// the bot is closed some other way.
+func (b *Bot) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		b.Close()
+		return ctx.Err()
+	case <-b.ctx.Done():
+		return nil
+	}
+}
+
+// Close quits all servers with the default quit message and stops
+// reconnecting to networks.  It returns once all connections are closed.
+func (b *Bot) Close() error {
+	b.cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range b.Servers() {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			s.Quit(QuitMessage)
+		}(s)
+	}
+	wg.Wait()
+	b.wg.Wait()
+	return nil
+}
+
+// Done returns a channel which is closed when the bot is closed.
+func (b *Bot) Done() <-chan struct{} {
+	return b.ctx.Done()
+}
+
 func (b *Bot) SetPing(ping, timeout time.Duration) {
 	b.ping, b.timeout = ping, timeout
 }
 
-func (b *Bot) OnConnect(h Handler) {
-	b.OnEvent(ON_CONNECT, h)
+func (b *Bot) OnConnect(h Handler) *Registration {
+	return b.OnEvent(ON_CONNECT, h)
+}
+
+func (b *Bot) OnDisconnect(h Handler) *Registration {
+	return b.OnEvent(ON_DISCONNECT, h)
+}
+
+// CommandEvent returns the event which occurs for every line received with
+// the given command or numeric, for use with Bot.OnEvent.
+func CommandEvent(cmd string) string {
+	return "oncmd:" + strings.ToUpper(cmd)
+}
+
+// OnCommand registers h to be called for every line received with the given
+// command (e.g. CMD_KICK).  Commands are case-insensitive.
+func (b *Bot) OnCommand(cmd string, h Handler) *Registration {
+	return b.OnEvent(CommandEvent(cmd), h)
 }
 
-func (b *Bot) OnDisconnect(h Handler) {
-	b.OnEvent(ON_DISCONNECT, h)
+// OnNumeric registers h to be called for every reply received with the given
+// numeric (e.g. RPL_WHOISUSER).
+func (b *Bot) OnNumeric(numeric string, h Handler) *Registration {
+	return b.OnEvent(CommandEvent(numeric), h)
 }
 
-func (b *Bot) OnEvent(event string, h Handler) {
+// OnEvent registers h to be called when the given event (one of the ON_*
+// constants) occurs.  The returned Registration may be used to change how
+// the handler is called, or to remove it.
+func (b *Bot) OnEvent(event string, h Handler) *Registration {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.callbacks[event] = append(b.callbacks[event], h)
+	b.handlers++
+	r := &Registration{
+		bot:     b,
+		event:   event,
+		handler: h,
+		seq:     b.handlers,
+	}
+	b.callbacks[event] = append(b.callbacks[event], r)
+	sort.Sort(registrationSorter(b.callbacks[event]))
+	return r
+}
+
+type registrationSorter []*Registration
+
+func (r registrationSorter) Len() int      { return len(r) }
+func (r registrationSorter) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r registrationSorter) Less(i, j int) bool {
+	if r[i].priority != r[j].priority {
+		return r[i].priority > r[j].priority
+	}
+	return r[i].seq < r[j].seq
 }
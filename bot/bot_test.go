@@ -0,0 +1,222 @@
+package bot
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkGoroutines fails the test if the number of goroutines does not drop
+// back to want.
+func checkGoroutines(t *testing.T, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines running, want %d:\n%s", runtime.NumGoroutine(), want, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRun(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	b := New("n", "u")
+	b.SetFlood(0, 0)
+	b.SetPing(10*time.Millisecond, 10*time.Second)
+
+	// One server which reconnects, and one which doesn't
+	if err := b.ConnectNetwork(&Network{Addrs: []string{l.Addr().String()}}); err != nil {
+		t.Fatalf("ConnectNetwork: %s", err)
+	}
+	net1 := accept(t, l)
+	net1.Expect("NICK n")
+	net1.Send(":serv 001 n :Welcome")
+
+	if err := b.ConnectPass(l.Addr().String(), ""); err != nil {
+		t.Fatalf("ConnectPass: %s", err)
+	}
+	pass := accept(t, l)
+	pass.Expect("NICK n")
+	pass.Send(":serv 001 n :Welcome")
+
+	// Make sure the ping loops are running
+	net1.Expect("PING :blight-bot-1")
+	pass.Expect("PING :blight-bot-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+	cancel()
+
+	net1.Expect("QUIT :" + QuitMessage)
+	net1.Send("ERROR :Closing link")
+	net1.conn.Close()
+	pass.Expect("QUIT :" + QuitMessage)
+	pass.conn.Close()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * QuitTimeout):
+		t.Fatalf("Run did not return")
+	}
+
+	select {
+	case <-b.Done():
+	default:
+		t.Errorf("bot not done after Run returned")
+	}
+	if got := b.Servers(); len(got) != 0 {
+		t.Errorf("Servers() = %v after close, want none", got)
+	}
+	l.Close()
+	checkGoroutines(t, before)
+}
+
+func TestQuit(t *testing.T) {
+	b := New("n", "u")
+	c := newTestConn(t, b)
+	c.Sync()
+
+	done := make(chan error)
+	go func() {
+		done <- c.serv.Quit("bye now")
+	}()
+	if got, want := <-c.lines, "QUIT :bye now"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	c.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Quit: %s", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Quit did not return")
+	}
+	select {
+	case <-c.serv.Done():
+	default:
+		t.Errorf("server not done after Quit")
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	b := New("n", "u")
+
+	var lock sync.Mutex
+	var calls []string
+	record := func(name string) Handler {
+		return func(e string, s *Server, m *Message) {
+			lock.Lock()
+			defer lock.Unlock()
+			calls = append(calls, name+" "+m.Args[0])
+		}
+	}
+	b.OnEvent(ON_CHANMSG, record("low")).Sync().Priority(-1)
+	b.OnEvent(ON_CHANMSG, record("first")).Sync()
+	b.OnEvent(ON_CHANMSG, record("high")).Sync().Priority(10)
+	removed := b.OnEvent(ON_CHANMSG, record("removed")).Sync()
+	b.OnEvent(ON_CHANMSG, record("second")).Sync()
+	removed.Remove()
+
+	async := make(chan string, 1)
+	b.OnEvent(ON_CHANMSG, func(e string, s *Server, m *Message) {
+		async <- m.Args[0]
+	})
+
+	// A synchronous handler sees the server's state as of its event
+	var nicks []string
+	b.OnEvent(ON_NICK, func(e string, s *Server, m *Message) {
+		nicks = append(nicks, s.ID().Nick)
+	}).Sync()
+
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Send(
+		":serv 001 n :Welcome",
+		":x!y@z PRIVMSG #a :hi",
+		":x!y@z PRIVMSG #b :hi",
+		":n!u@h NICK n2",
+		":n2!u@h NICK n3",
+	)
+	c.Sync()
+
+	want := []string{
+		"high #a", "first #a", "second #a", "low #a",
+		"high #b", "first #b", "second #b", "low #b",
+	}
+	lock.Lock()
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	lock.Unlock()
+	if got, want := nicks, []string{"n2", "n3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nicks = %q, want %q", got, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-async:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("asynchronous handler not called")
+		}
+	}
+}
+
+func TestRawEvents(t *testing.T) {
+	b := New("n", "u")
+
+	var lock sync.Mutex
+	var raw, kicks, whois []string
+	record := func(list *[]string) Handler {
+		return func(e string, s *Server, m *Message) {
+			lock.Lock()
+			defer lock.Unlock()
+			*list = append(*list, m.Command)
+		}
+	}
+	b.OnEvent(ON_RAW, record(&raw)).Sync()
+	b.OnCommand("kick", record(&kicks)).Sync()
+	b.OnNumeric(RPL_WHOISUSER, record(&whois)).Sync()
+
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Send(
+		":serv 001 n :Welcome",
+		":serv 311 n x y z * :Real Name",
+		":x!y@z KICK #chan w :bye",
+		":x!y@z TOPIC #chan :new topic",
+	)
+	c.Sync()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if got, want := raw[:4], []string{RPL_WELCOME, RPL_WHOISUSER, CMD_KICK, CMD_TOPIC}; !reflect.DeepEqual(got, want) {
+		t.Errorf("raw = %q, want %q", got, want)
+	}
+	if got, want := kicks, []string{CMD_KICK}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kicks = %q, want %q", got, want)
+	}
+	if got, want := whois, []string{RPL_WHOISUSER}; !reflect.DeepEqual(got, want) {
+		t.Errorf("whois = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+package bot
+
+import (
+	"sort"
+	"strings"
+)
+
+// CAP subcommands
+const (
+	CAP_LS   = "LS"
+	CAP_LIST = "LIST"
+	CAP_REQ  = "REQ"
+	CAP_ACK  = "ACK"
+	CAP_NAK  = "NAK"
+	CAP_NEW  = "NEW"
+	CAP_DEL  = "DEL"
+	CAP_END  = "END"
+
+	// The CAP LS version we advertise
+	CAP_VERSION = "302"
+)
+
+// RequestCap adds the given capabilities to the set which will be requested
+// from servers which support them.  Capabilities are requested during
+// registration and, for servers which support cap-notify, whenever they
+// become available.  Servers which are already connected are not affected
+// until the capability is next advertised.
+func (b *Bot) RequestCap(caps ...string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, c := range caps {
+		if !b.wantsCap(c) {
+			b.caps = append(b.caps, c)
+		}
+	}
+}
+
+// wantsCap returns true if the capability has been requested.  The bot lock
+// must be held.
+func (b *Bot) wantsCap(name string) bool {
+	for _, c := range b.caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCap returns true if the given capability has been negotiated with the
+// server.
+func (s *Server) HasCap(name string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, ok := s.caps[name]
+	return ok
+}
+
+// Caps returns the sorted names of the capabilities which have been
+// negotiated with the server.
+func (s *Server) Caps() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := make([]string, 0, len(s.caps))
+	for name := range s.caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CapValue returns the value with which a negotiated capability was
+// advertised (e.g. the mechanism list for "sasl").
+func (s *Server) CapValue(name string) (val string, ok bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	val, ok = s.caps[name]
+	return val, ok
+}
+
+// capStart begins capability negotiation if the bot has requested any
+// capabilities.  It must be called before NICK and USER are sent.
+func (s *Server) capStart() {
+	s.bot.lock.RLock()
+	want := len(s.bot.caps) > 0
+	s.bot.lock.RUnlock()
+
+	if !want {
+		return
+	}
+
+	s.capNeg = true
+	s.send(NewMessage("", CMD_CAP, CAP_LS, CAP_VERSION))
+}
+
+// capHold prevents capability negotiation from ending until a matching call
+// to capRelease.  It is used while requests (and authentication) are pending.
+func (s *Server) capHold() {
+	s.capHolds++
+}
+
+// capRelease releases a hold on capability negotiation, and ends it if there
+// are no remaining holds.
+func (s *Server) capRelease() {
+	if s.capHolds > 0 {
+		s.capHolds--
+	}
+	if s.capHolds == 0 && s.capNeg {
+		s.capNeg = false
+		s.send(NewMessage("", CMD_CAP, CAP_END))
+	}
+}
+
+// capRequest requests any capabilities which the bot wants and the server
+// has advertised but which have not yet been negotiated.
+func (s *Server) capRequest() {
+	s.bot.lock.RLock()
+	s.lock.RLock()
+	var req []string
+	for _, c := range s.bot.caps {
+		if _, ok := s.capAvail[c]; !ok {
+			continue
+		}
+		if _, ok := s.caps[c]; ok {
+			continue
+		}
+		req = append(req, c)
+	}
+	s.lock.RUnlock()
+	s.bot.lock.RUnlock()
+
+	if len(req) == 0 {
+		return
+	}
+	s.capHold()
+	s.send(NewMessage("", CMD_CAP, CAP_REQ, strings.Join(req, " ")))
+}
+
+// handleCap processes a CAP message from the server.
+func (s *Server) handleCap(m *Message) {
+	// :server CAP <target> <subcommand> [*] :<caps>
+	if len(m.Args) < 2 {
+		return
+	}
+	sub, args := strings.ToUpper(m.Args[1]), m.Args[2:]
+	more := false
+	if len(args) > 1 && args[0] == "*" {
+		more, args = true, args[1:]
+	}
+	var tokens []string
+	if len(args) > 0 {
+		tokens = strings.Fields(args[0])
+	}
+
+	switch sub {
+	case CAP_LS, CAP_NEW:
+		s.lock.Lock()
+		for _, tok := range tokens {
+			name, val := splitCap(tok)
+			s.capAvail[name] = val
+		}
+		s.lock.Unlock()
+
+		if more {
+			return
+		}
+		if auth := s.saslConfig(); auth != nil && sub == CAP_LS {
+			if _, ok := s.capAvail["sasl"]; !ok {
+				s.Log("SASL is not supported by the server")
+				if s.saslDone(false); auth.Required {
+					return
+				}
+			}
+		}
+		s.capRequest()
+		if sub == CAP_LS && s.capNeg && s.capHolds == 0 {
+			s.capRelease()
+		}
+	case CAP_ACK:
+		s.lock.Lock()
+		for _, tok := range tokens {
+			if strings.HasPrefix(tok, "-") {
+				delete(s.caps, tok[1:])
+				continue
+			}
+			name, _ := splitCap(tok)
+			s.caps[name] = s.capAvail[name]
+		}
+		s.lock.Unlock()
+
+		s.trigger(ON_CAPS, m)
+		for _, tok := range tokens {
+			if tok == "sasl" {
+				s.saslStart()
+			}
+		}
+		s.capRelease()
+	case CAP_NAK:
+		s.Log("capabilities rejected: %s", strings.Join(tokens, " "))
+		for _, tok := range tokens {
+			if tok == "sasl" {
+				s.saslDone(false)
+			}
+		}
+		s.capRelease()
+	case CAP_DEL:
+		changed := false
+		s.lock.Lock()
+		for _, tok := range tokens {
+			name, _ := splitCap(tok)
+			delete(s.capAvail, name)
+			if _, ok := s.caps[name]; ok {
+				delete(s.caps, name)
+				changed = true
+			}
+		}
+		s.lock.Unlock()
+
+		if changed {
+			s.trigger(ON_CAPS, m)
+		}
+	}
+}
+
+// splitCap splits a capability token into its name and value.
+func splitCap(tok string) (name, val string) {
+	if eq := strings.IndexByte(tok, '='); eq >= 0 {
+		return tok[:eq], tok[eq+1:]
+	}
+	return tok, ""
+}
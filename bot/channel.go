@@ -1,33 +1,508 @@
 package bot
 
 import (
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// A Member is a user in a channel.
+type Member struct {
+	Nick string
+
+	// Modes holds the channel status modes (e.g. "ov") of the member, in
+	// order of decreasing rank.
+	Modes string
+}
+
 type Channel struct {
 	serv *Server
 	lock sync.RWMutex
 
 	name string
+
+	members map[string]*Member
+	names   map[string]*Member // in-progress NAMES reply
+	modes   map[byte]string
+	lists   map[byte][]string
+
+	topic   string
+	topicBy string
+	topicAt time.Time
 }
 
-func (s *Server) newChannel(name string) {
+func (s *Server) newChannel(name string) *Channel {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	s.channels[name] = &Channel{serv: s, name: name}
+	ch := &Channel{
+		serv:    s,
+		name:    name,
+		members: map[string]*Member{},
+		modes:   map[byte]string{},
+		lists:   map[byte][]string{},
+	}
+	s.channels[s.ToLower(name)] = ch
+	return ch
 }
 
 func (s *Server) delChannel(name string) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	delete(s.channels, name)
+	delete(s.channels, s.ToLower(name))
 }
 
 func (s *Server) GetChannel(name string) *Channel {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	return s.channels[name]
+	return s.channels[s.ToLower(name)]
+}
+
+// Channels returns the channels the bot is in on this server.
+func (s *Server) Channels() []*Channel {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	chans := make([]*Channel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		chans = append(chans, ch)
+	}
+	sort.Sort(channelSorter(chans))
+	return chans
+}
+
+// Name returns the name of the channel.
+func (c *Channel) Name() string {
+	return c.name
+}
+
+// Topic returns the topic of the channel, who set it, and when.  The setter
+// and time are only available if the server provided them.
+func (c *Channel) Topic() (topic, setter string, at time.Time) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.topic, c.topicBy, c.topicAt
+}
+
+// Members returns the members of the channel, sorted by nick.
+func (c *Channel) Members() []Member {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	members := make([]Member, 0, len(c.members))
+	for _, m := range c.members {
+		members = append(members, *m)
+	}
+	sort.Sort(memberSorter(members))
+	return members
+}
+
+// Member returns the member of the channel with the given nick.
+func (c *Channel) Member(nick string) (Member, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	m, ok := c.members[c.serv.ToLower(nick)]
+	if !ok {
+		return Member{}, false
+	}
+	return *m, true
+}
+
+// HasMode returns true if the given member of the channel has the given
+// status mode (e.g. 'v').
+func (c *Channel) HasMode(nick string, mode byte) bool {
+	m, ok := c.Member(nick)
+	return ok && strings.IndexByte(m.Modes, mode) >= 0
+}
+
+// IsOp returns true if the given member of the channel is a channel operator
+// (or has a status ranked above operator).
+func (c *Channel) IsOp(nick string) bool {
+	m, ok := c.Member(nick)
+	if !ok {
+		return false
+	}
+	modes, _ := c.serv.isupport.Prefix()
+	op := strings.IndexByte(modes, 'o')
+	for i := 0; i < len(m.Modes); i++ {
+		if m.Modes[i] == 'o' {
+			return true
+		}
+		if rank := strings.IndexByte(modes, m.Modes[i]); rank >= 0 && rank < op {
+			return true
+		}
+	}
+	return false
+}
+
+// Mode returns the parameter (if any) of the given channel mode and whether
+// it is set.  List modes (e.g. bans) are available from List.
+func (c *Channel) Mode(mode byte) (param string, set bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	param, set = c.modes[mode]
+	return param, set
+}
+
+// Modes returns the channel modes as a mode string (e.g. "+klnt key 10").
+func (c *Channel) Modes() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	flags := make([]byte, 0, len(c.modes))
+	for mode := range c.modes {
+		flags = append(flags, mode)
+	}
+	sort.Sort(byteSorter(flags))
+
+	str, params := "+"+string(flags), []string{}
+	for _, mode := range flags {
+		if p := c.modes[mode]; p != "" {
+			params = append(params, p)
+		}
+	}
+	return strings.Join(append([]string{str}, params...), " ")
+}
+
+// List returns the entries in the given list mode (e.g. 'b' for bans) which
+// have been seen since joining the channel.
+func (c *Channel) List(mode byte) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return append([]string(nil), c.lists[mode]...)
+}
+
+// addMember adds (or updates) a member of the channel.
+func (c *Channel) addMember(nick, modes string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.members[c.serv.ToLower(nick)] = &Member{Nick: nick, Modes: modes}
+}
+
+// delMember removes a member from the channel, returning whether they were
+// present.
+func (c *Channel) delMember(nick string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := c.serv.ToLower(nick)
+	_, ok := c.members[key]
+	delete(c.members, key)
+	return ok
 }
+
+// renameMember updates the nick of a member of the channel.
+func (c *Channel) renameMember(old, nick string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := c.serv.ToLower(old)
+	m, ok := c.members[key]
+	if !ok {
+		return
+	}
+	delete(c.members, key)
+	m.Nick = nick
+	c.members[c.serv.ToLower(nick)] = m
+}
+
+// addNames processes the entries in an RPL_NAMREPLY.  The members are
+// replaced when the RPL_ENDOFNAMES is received.
+func (c *Channel) addNames(names string) {
+	modes, prefixes := c.serv.isupport.Prefix()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.names == nil {
+		c.names = map[string]*Member{}
+	}
+	for _, name := range strings.Fields(names) {
+		m, ok := parseMember(name, modes, prefixes)
+		if !ok {
+			continue
+		}
+		c.names[c.serv.ToLower(m.Nick)] = &m
+	}
+}
+
+// parseMember parses an entry in an RPL_NAMREPLY, given the PREFIX modes
+// and their prefixes.
+func parseMember(name, modes, prefixes string) (m Member, ok bool) {
+	for len(name) > 0 {
+		idx := strings.IndexByte(prefixes, name[0])
+		if idx < 0 {
+			break
+		}
+		m.Modes += modes[idx : idx+1]
+		name = name[1:]
+	}
+	// userhost-in-names
+	if bang := strings.IndexByte(name, '!'); bang >= 0 {
+		name = name[:bang]
+	}
+	m.Nick = name
+	return m, name != ""
+}
+
+// endNames replaces the members of the channel with those from the NAMES
+// reply which has just completed.
+func (c *Channel) endNames() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.names != nil {
+		c.members, c.names = c.names, nil
+	}
+}
+
+// setTopic sets the topic of the channel.
+func (c *Channel) setTopic(topic, setter string, at time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.topic, c.topicBy, c.topicAt = topic, setter, at
+}
+
+// setTopicWho sets the setter and time of the topic.
+func (c *Channel) setTopicWho(setter string, at time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.topicBy, c.topicAt = setter, at
+}
+
+// applyModes applies the mode changes to the channel.  If reset is true, all
+// existing (non-list, non-status) modes are cleared first.
+func (c *Channel) applyModes(changes []ModeChange, reset bool) {
+	prefixModes, _ := c.serv.isupport.Prefix()
+	list, _, _, _ := c.serv.isupport.ChanModes()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if reset {
+		c.modes = map[byte]string{}
+	}
+	for _, mc := range changes {
+		switch {
+		case strings.IndexByte(prefixModes, mc.Mode) >= 0:
+			m, ok := c.members[c.serv.ToLower(mc.Param)]
+			if !ok {
+				continue
+			}
+			modes := strings.Replace(m.Modes, string(mc.Mode), "", -1)
+			if mc.Add {
+				modes += string(mc.Mode)
+			}
+			m.Modes = rankModes(modes, prefixModes)
+		case strings.IndexByte(list, mc.Mode) >= 0:
+			entries := c.lists[mc.Mode]
+			for i, e := range entries {
+				if e == mc.Param {
+					entries = append(entries[:i:i], entries[i+1:]...)
+					break
+				}
+			}
+			if mc.Add {
+				entries = append(entries, mc.Param)
+			}
+			c.lists[mc.Mode] = entries
+		case mc.Add:
+			c.modes[mc.Mode] = mc.Param
+		default:
+			delete(c.modes, mc.Mode)
+		}
+	}
+}
+
+// rankModes sorts the status modes in order of decreasing rank.
+func rankModes(modes, order string) string {
+	ranked := make([]byte, 0, len(modes))
+	for i := 0; i < len(order); i++ {
+		if strings.IndexByte(modes, order[i]) >= 0 {
+			ranked = append(ranked, order[i])
+		}
+	}
+	return string(ranked)
+}
+
+// A ModeChange is a single mode being set or unset by a MODE command.
+type ModeChange struct {
+	Add   bool
+	Mode  byte
+	Param string
+}
+
+// ParseModes parses a channel mode string and its parameters (e.g. "+o-v",
+// "nick1", "nick2") into individual changes.  The server's PREFIX and
+// CHANMODES are used to determine which modes take parameters.
+func ParseModes(f *ISupport, modestr string, params []string) []ModeChange {
+	prefix, _ := f.Prefix()
+	list, always, set, _ := f.ChanModes()
+
+	var changes []ModeChange
+	add := true
+	for i := 0; i < len(modestr); i++ {
+		mc := ModeChange{Add: add, Mode: modestr[i]}
+		switch mc.Mode {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+
+		takesParam := strings.IndexByte(prefix, mc.Mode) >= 0 ||
+			strings.IndexByte(list, mc.Mode) >= 0 ||
+			strings.IndexByte(always, mc.Mode) >= 0 ||
+			(add && strings.IndexByte(set, mc.Mode) >= 0)
+		if takesParam {
+			if len(params) == 0 {
+				continue
+			}
+			mc.Param, params = params[0], params[1:]
+		}
+		changes = append(changes, mc)
+	}
+	return changes
+}
+
+// trackChannels updates channel state from an incoming message.
+func (s *Server) trackChannels(m *Message) {
+	switch m.Command {
+	case CMD_JOIN:
+		// :nick!user@host JOIN #chan [account :realname]
+		if len(m.Args) < 1 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[0]); ch != nil {
+			ch.addMember(m.ID().Nick, "")
+		}
+	case CMD_PART:
+		// :nick!user@host PART #chan [:reason]
+		if len(m.Args) < 1 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[0]); ch != nil {
+			ch.delMember(m.ID().Nick)
+		}
+	case CMD_KICK:
+		// :nick!user@host KICK #chan nick [:reason]
+		if len(m.Args) < 2 {
+			return
+		}
+		if s.isupport.EqualFold(m.Args[1], s.id.Nick) {
+			s.delChannel(m.Args[0])
+		} else if ch := s.GetChannel(m.Args[0]); ch != nil {
+			ch.delMember(m.Args[1])
+		}
+	case CMD_QUIT:
+		for _, ch := range s.Channels() {
+			ch.delMember(m.ID().Nick)
+		}
+	case CMD_NICK:
+		if len(m.Args) < 1 {
+			return
+		}
+		for _, ch := range s.Channels() {
+			ch.renameMember(m.ID().Nick, m.Args[0])
+		}
+	case CMD_MODE:
+		// :nick!user@host MODE #chan +modes [params...]
+		if len(m.Args) < 2 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[0]); ch != nil {
+			ch.applyModes(ParseModes(s.isupport, m.Args[1], m.Args[2:]), false)
+		}
+	case RPL_CHANNELMODEIS:
+		// :server 324 me #chan +modes [params...]
+		if len(m.Args) < 3 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[1]); ch != nil {
+			ch.applyModes(ParseModes(s.isupport, m.Args[2], m.Args[3:]), true)
+		}
+	case RPL_NAMREPLY:
+		// :server 353 me = #chan :[@]nick [+]nick...
+		if len(m.Args) < 4 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[2]); ch != nil {
+			ch.addNames(m.Args[3])
+		}
+	case RPL_ENDOFNAMES:
+		// :server 366 me #chan :End of NAMES list
+		if len(m.Args) < 2 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[1]); ch != nil {
+			ch.endNames()
+		}
+	case CMD_TOPIC:
+		// :nick!user@host TOPIC #chan :topic
+		if len(m.Args) < 2 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[0]); ch != nil {
+			ch.setTopic(m.Args[1], m.ID().Nick, s.clock.Now())
+		}
+	case RPL_NOTOPIC:
+		// :server 331 me #chan :No topic is set
+		if len(m.Args) < 2 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[1]); ch != nil {
+			ch.setTopic("", "", time.Time{})
+		}
+	case RPL_TOPIC:
+		// :server 332 me #chan :topic
+		if len(m.Args) < 3 {
+			return
+		}
+		if ch := s.GetChannel(m.Args[1]); ch != nil {
+			ch.setTopic(m.Args[2], "", time.Time{})
+		}
+	case RPL_TOPICWHOTIME:
+		// :server 333 me #chan setter timestamp
+		if len(m.Args) < 4 {
+			return
+		}
+		ts, err := strconv.ParseInt(m.Args[3], 10, 64)
+		if err != nil {
+			return
+		}
+		if ch := s.GetChannel(m.Args[1]); ch != nil {
+			ch.setTopicWho(m.Args[2], time.Unix(ts, 0))
+		}
+	}
+}
+
+type channelSorter []*Channel
+
+func (c channelSorter) Len() int           { return len(c) }
+func (c channelSorter) Less(i, j int) bool { return c[i].name < c[j].name }
+func (c channelSorter) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+type memberSorter []Member
+
+func (m memberSorter) Len() int           { return len(m) }
+func (m memberSorter) Less(i, j int) bool { return m[i].Nick < m[j].Nick }
+func (m memberSorter) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+type byteSorter []byte
+
+func (b byteSorter) Len() int           { return len(b) }
+func (b byteSorter) Less(i, j int) bool { return b[i] < b[j] }
+func (b byteSorter) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChannelState(t *testing.T) {
+	c := newTestConn(t, New("n", "u"))
+	defer c.Close()
+
+	c.Send(
+		":serv 001 n :Welcome",
+		":serv 005 n PREFIX=(qov)~@+ CHANMODES=beI,k,l,imnpst CASEMAPPING=rfc1459 :are supported",
+		":n!u@h JOIN #Chan",
+		":serv 332 n #chan :Hello world",
+		":serv 333 n #chan setter!u@h 1300000000",
+		":serv 353 n = #chan :n ~owner @op +voice",
+		":serv 353 n = #chan :@+both!u@h plain",
+		":serv 366 n #chan :End of NAMES list",
+		":serv 324 n #chan +ntk key",
+	)
+	c.Sync()
+
+	ch := c.serv.GetChannel("#CHAN")
+	if ch == nil {
+		t.Fatalf("channel not tracked")
+	}
+	if got, want := ch.Name(), "#Chan"; got != want {
+		t.Errorf("name = %q, want %q", got, want)
+	}
+
+	members := func() map[string]string {
+		m := map[string]string{}
+		for _, mem := range ch.Members() {
+			m[mem.Nick] = mem.Modes
+		}
+		return m
+	}
+	want := map[string]string{"n": "", "owner": "q", "op": "o", "voice": "v", "both": "ov", "plain": ""}
+	if got := members(); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %q, want %q", got, want)
+	}
+
+	topic, setter, at := ch.Topic()
+	if topic != "Hello world" || setter != "setter!u@h" || !at.Equal(time.Unix(1300000000, 0)) {
+		t.Errorf("topic = %q, %q, %v", topic, setter, at)
+	}
+	if got, want := ch.Modes(), "+knt key"; got != want {
+		t.Errorf("modes = %q, want %q", got, want)
+	}
+
+	for nick, op := range map[string]bool{"owner": true, "OP": true, "both": true, "voice": false, "nobody": false} {
+		if got := ch.IsOp(nick); got != op {
+			t.Errorf("IsOp(%q) = %v, want %v", nick, got, op)
+		}
+	}
+
+	c.Send(
+		":op!u@h MODE #chan +v-o+b-k op op *!*@bad key",
+		":op!u@h MODE #chan +l 10",
+		":new!u@h JOIN #chan",
+		":plain!u@h PART #chan :bye",
+		":op!u@h KICK #chan both :out",
+		":voice!u@h QUIT :gone",
+		":new!u@h NICK Newer",
+		":op!u@h TOPIC #chan :New topic",
+	)
+	c.Sync()
+
+	want = map[string]string{"n": "", "owner": "q", "op": "v", "Newer": ""}
+	if got := members(); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %q, want %q", got, want)
+	}
+	if got, want := ch.List('b'), []string{"*!*@bad"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bans = %q, want %q", got, want)
+	}
+	if got, want := ch.Modes(), "+lnt 10"; got != want {
+		t.Errorf("modes = %q, want %q", got, want)
+	}
+	if topic, setter, _ := ch.Topic(); topic != "New topic" || setter != "op" {
+		t.Errorf("topic = %q, %q", topic, setter)
+	}
+	if _, ok := ch.Member("NEWER"); !ok {
+		t.Errorf("renamed member not found")
+	}
+	if !ch.HasMode("OP", 'v') || ch.HasMode("op", 'o') {
+		t.Errorf("op has modes %q, want %q", want["op"], "v")
+	}
+
+	c.Send(":op!u@h KICK #chan n :bye bot")
+	c.Sync()
+	if c.serv.GetChannel("#chan") != nil {
+		t.Errorf("channel still tracked after being kicked")
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	f := new(ISupport)
+	f.parse([]string{"n", "PREFIX=(ov)@+", "CHANMODES=beI,k,l,imnpst", "are supported"})
+
+	got := ParseModes(f, "+ol-l+k-bm", []string{"nick", "5", "key", "mask", "extra"})
+	want := []ModeChange{
+		{true, 'o', "nick"},
+		{true, 'l', "5"},
+		{false, 'l', ""},
+		{true, 'k', "key"},
+		{false, 'b', "mask"},
+		{false, 'm', ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseModes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and waits for it to pass.  Bots use the system
+// clock unless given another with SetClock; replays (see Bot.Replay) use a
+// VirtualClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock sets the clock used by servers which are connected after the
+// call, and by networks for their reconnect delays.
+func (b *Bot) SetClock(c Clock) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.clock = c
+}
+
+// getClock returns the bot's clock.
+func (b *Bot) getClock() Clock {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.clock
+}
+
+// A VirtualClock is a Clock whose time only passes when it is told to.
+type VirtualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// A waiter is a channel waiting for a time.
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewVirtualClock returns a clock which starts at the given time.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the clock's current time.
+func (c *VirtualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// After returns a channel on which the time is sent once the clock has been
+// advanced by at least d.
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &waiter{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock forward by d.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock forward to t, firing the channels returned by After
+// which are due, earliest first.  The clock never moves backward.
+func (c *VirtualClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.Before(c.now) {
+		return
+	}
+	c.now = t
+
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].at.Before(c.waiters[j].at)
+	})
+	n := 0
+	for n < len(c.waiters) && !c.waiters[n].at.After(t) {
+		w := c.waiters[n]
+		w.ch <- w.at
+		n++
+	}
+	c.waiters = c.waiters[n:]
+}
+
+// Waiting returns the number of channels waiting for the clock to advance.
+func (c *VirtualClock) Waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
@@ -11,36 +11,107 @@ const (
 	CMD_QUIT   = "QUIT"
 	CMD_PING   = "PING"
 	CMD_PONG   = "PONG"
+	CMD_CAP    = "CAP"
 
 	CMD_OPER = "OPER"
 	CMD_MODE = "MODE"
 
 	CMD_JOIN  = "JOIN"
 	CMD_PART  = "PART"
+	CMD_KICK  = "KICK"
 	CMD_WHO   = "WHO"
 	CMD_TOPIC = "TOPIC"
 	CMD_NAMES = "NAMES"
+	CMD_WHOIS = "WHOIS"
+	CMD_LIST  = "LIST"
+
+	CMD_ISON    = "ISON"
+	CMD_MONITOR = "MONITOR"
+
+	CMD_ACCOUNT = "ACCOUNT"
+	CMD_CHGHOST = "CHGHOST"
 
 	CMD_WALLOPS = "WALLOPS"
 	CMD_PRIVMSG = "PRIVMSG"
 	CMD_NOTICE  = "NOTICE"
+	CMD_TAGMSG  = "TAGMSG"
+	CMD_BATCH   = "BATCH"
+	CMD_ACK     = "ACK"
 
 	// Server commands
-	CMD_SJOIN = "SJOIN"
-	CMD_SID   = "SID"
-	CMD_SQUIT = "SQUIT"
-	CMD_UID   = "UID"
-	CMD_EUID  = "EUID"
-	CMD_ENCAP = "ENCAP"
-	CMD_BMASK = "BMASK"
-	CMD_TB    = "TB"
-
-	// Callback-only
-	ON_CONNECT    = "onconnect"
+	CMD_SJOIN  = "SJOIN"
+	CMD_SID    = "SID"
+	CMD_SQUIT  = "SQUIT"
+	CMD_UID    = "UID"
+	CMD_EUID   = "EUID"
+	CMD_ENCAP  = "ENCAP"
+	CMD_BMASK  = "BMASK"
+	CMD_TB     = "TB"
+	CMD_SVINFO = "SVINFO"
+	CMD_TMODE  = "TMODE"
+	CMD_KILL   = "KILL"
+
+	// Callback-only events, for use with Bot.OnEvent.  Unless noted
+	// otherwise, the message passed to handlers is the one which caused the
+	// event, and the server's state (channels, users, etc) has already been
+	// updated when the handler is called.  Handlers run asynchronously by
+	// default; see Registration.Sync for ordered, synchronous dispatch.
+
+	// ON_CONNECT occurs when registration completes (RPL_WELCOME).
+	ON_CONNECT = "onconnect"
+	// ON_DISCONNECT occurs when the connection is closed.  The message is
+	// nil, and messages written to the server are discarded.
 	ON_DISCONNECT = "ondisconnect"
-	ON_JOIN       = "onjoin"
-	ON_PART       = "onpart"
-	ON_CHANMSG    = "onchanmsg"
-	ON_PRIVMSG    = "onprivmsg"
-	ON_NOTICE     = "onnotice"
+	// ON_JOIN occurs when the bot joins a channel.  The channel exists, but
+	// its members have not yet been listed.
+	ON_JOIN = "onjoin"
+	// ON_PART occurs when the bot leaves a channel.  The channel no longer
+	// exists.
+	ON_PART = "onpart"
+	// ON_CHANMSG occurs for PRIVMSGs to a channel.
+	ON_CHANMSG = "onchanmsg"
+	// ON_PRIVMSG occurs for PRIVMSGs to the bot.
+	ON_PRIVMSG = "onprivmsg"
+	// ON_NOTICE occurs for NOTICEs to the bot.
+	ON_NOTICE = "onnotice"
+	// ON_CAPS occurs when capabilities are acknowledged (CAP ACK) or
+	// withdrawn (CAP DEL).
+	ON_CAPS = "oncaps"
+	// ON_NICK occurs when anyone visible to the bot, including the bot
+	// itself, changes nick.
+	ON_NICK = "onnick"
+	// ON_QUIT occurs when a user visible to the bot quits.
+	ON_QUIT = "onquit"
+	// ON_KICK occurs when anyone, including the bot, is kicked from a
+	// channel the bot is in.
+	ON_KICK = "onkick"
+	// ON_ACCOUNT occurs when a user logs into or out of services
+	// (account-notify).
+	ON_ACCOUNT = "onaccount"
+	// ON_LAG occurs when the server's lag rises above the lag threshold, and
+	// when it falls back below it.  The message is nil; see Server.Lagging
+	// and Server.Lag.
+	ON_LAG = "onlag"
+	// ON_NETSERVER occurs when a server joins the network of a server link.
+	// The message is its SERVER or SID.  See Server.NetState.
+	ON_NETSERVER = "onnetserver"
+	// ON_NETSPLIT occurs when a server leaves the network of a server link.
+	// The message is the SQUIT; the servers behind it and their users have
+	// already been removed, and ON_NETQUIT has occurred for each user.
+	ON_NETSPLIT = "onnetsplit"
+	// ON_NETUSER occurs when a user joins the network of a server link.  The
+	// message is its EUID or UID.
+	ON_NETUSER = "onnetuser"
+	// ON_NETQUIT occurs when a user leaves the network of a server link by
+	// quitting, being killed or a netsplit.  The message is a client QUIT,
+	// which handlers have already seen if the bot shares a channel with the
+	// user.
+	ON_NETQUIT = "onnetquit"
+	// ON_ERROR occurs for every error reply (ERR_*) from the server, after
+	// the error has been passed to the query or Send it answers, if any.
+	// ErrorReply returns the error.
+	ON_ERROR = "onerror"
+	// ON_RAW occurs for every line received from the server, including
+	// numerics and the closing ERROR.  See also Bot.OnCommand.
+	ON_RAW = "onraw"
 )
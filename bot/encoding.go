@@ -0,0 +1,192 @@
+package bot
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Character sets understood by Encoding
+const (
+	CHARSET_UTF8   = "utf-8"
+	CHARSET_CP1252 = "cp1252"
+	CHARSET_LATIN1 = "iso-8859-1"
+)
+
+// An Encoding controls how lines are converted between a server's character
+// set and UTF-8.  Incoming lines which are valid UTF-8 are always taken as
+// such; others are decoded using the Fallback character set.
+type Encoding struct {
+	// Fallback is the character set of incoming lines which are not valid
+	// UTF-8.  With CHARSET_UTF8 (or ""), invalid sequences are replaced with
+	// U+FFFD.
+	Fallback string
+
+	// Outgoing is the character set in which lines are sent (default
+	// UTF-8).  Characters it cannot represent are sent as '?'.
+	Outgoing string
+
+	// Channels replaces the encoding for messages to and from particular
+	// channels.
+	Channels map[string]*Encoding
+}
+
+// DefaultEncoding sends UTF-8 and decodes lines which are not UTF-8 as
+// CP1252, which most non-UTF-8 clients use.
+var DefaultEncoding = &Encoding{Fallback: CHARSET_CP1252}
+
+// SetEncoding sets the encoding used by servers which are connected after
+// the call, unless their Network has its own.  A nil encoding sends UTF-8
+// and replaces invalid sequences in incoming lines.
+func (b *Bot) SetEncoding(enc *Encoding) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.encoding = enc
+}
+
+// Encoding returns the encoding used for the server.
+func (s *Server) Encoding() *Encoding { return s.enc }
+
+// ValidCharset returns true if the character set is understood by Encoding.
+func ValidCharset(name string) bool {
+	switch charset(name) {
+	case CHARSET_UTF8, CHARSET_CP1252, CHARSET_LATIN1:
+		return true
+	}
+	return false
+}
+
+// charset returns the canonical name for a character set.
+func charset(name string) string {
+	switch strings.ToLower(name) {
+	case "", "utf8", CHARSET_UTF8:
+		return CHARSET_UTF8
+	case "windows-1252", CHARSET_CP1252:
+		return CHARSET_CP1252
+	case "latin1", "latin-1", "iso8859-1", CHARSET_LATIN1:
+		return CHARSET_LATIN1
+	}
+	return name
+}
+
+// channel returns the encoding for the named channel.
+func (e *Encoding) channel(s *Server, name string) *Encoding {
+	for ch, enc := range e.Channels {
+		if s.isupport.EqualFold(ch, name) {
+			return enc
+		}
+	}
+	return e
+}
+
+// decode converts a line received from the server to UTF-8.
+func (s *Server) decode(line string) string {
+	if utf8.ValidString(line) {
+		return line
+	}
+
+	enc := s.enc
+	if len(enc.Channels) > 0 {
+		if m := ParseMessage(line); m != nil {
+			// :nick!user@host PRIVMSG <channel> ...
+			// :server 332 <nick> <channel> ...
+			arg := 0
+			if len(m.Command) == 3 && m.Command[0] >= '0' && m.Command[0] <= '9' {
+				arg = 1
+			}
+			if len(m.Args) > arg && s.IsChannel(m.Args[arg]) {
+				enc = enc.channel(s, m.Args[arg])
+			}
+		}
+	}
+	return decode(line, enc.Fallback)
+}
+
+// encode converts the lines, which are all for the same target as m, to the
+// outgoing character set.
+func (s *Server) encode(m *Message, lines [][]byte) [][]byte {
+	enc := s.enc
+	if m != nil && len(m.Args) > 0 && s.IsChannel(m.Args[0]) {
+		enc = enc.channel(s, m.Args[0])
+	}
+	if charset(enc.Outgoing) == CHARSET_UTF8 {
+		return lines
+	}
+
+	out := make([][]byte, len(lines))
+	for i, line := range lines {
+		out[i] = encode(line, enc.Outgoing)
+	}
+	return out
+}
+
+// The characters for bytes 0x80-0x9F in CP1252.  The five unassigned bytes
+// are mapped to the C1 controls, as in Latin-1.
+var cp1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// decode converts text in the character set to UTF-8.
+func decode(text, cs string) string {
+	switch charset(cs) {
+	case CHARSET_CP1252, CHARSET_LATIN1:
+	default:
+		return strings.ToValidUTF8(text, "\uFFFD")
+	}
+
+	var b strings.Builder
+	b.Grow(len(text) + len(text)/2)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0 && charset(cs) == CHARSET_CP1252:
+			b.WriteRune(cp1252[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// encode converts UTF-8 text to the character set.
+func encode(text []byte, cs string) []byte {
+	switch charset(cs) {
+	case CHARSET_CP1252, CHARSET_LATIN1:
+	default:
+		return text
+	}
+
+	out := make([]byte, 0, len(text))
+	for _, r := range string(text) {
+		switch {
+		case r < 0x80:
+			out = append(out, byte(r))
+		case r >= 0xA0 && r <= 0xFF:
+			out = append(out, byte(r))
+		case charset(cs) == CHARSET_LATIN1:
+			if r < 0xA0 {
+				out = append(out, byte(r))
+			} else {
+				out = append(out, '?')
+			}
+		default:
+			out = append(out, cp1252Byte(r))
+		}
+	}
+	return out
+}
+
+// cp1252Byte returns the CP1252 byte for the rune, which is not ASCII or
+// Latin-1, or '?' if there is none.
+func cp1252Byte(r rune) byte {
+	for i, c := range cp1252 {
+		if c == r {
+			return byte(0x80 + i)
+		}
+	}
+	return '?'
+}
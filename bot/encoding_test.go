@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		text, charset string
+		want          string
+	}{
+		{"caf\xe9", CHARSET_CP1252, "café"},
+		{"\x93quoted\x94 \x80", CHARSET_CP1252, "“quoted” €"},
+		{"\x93quoted\x94", "latin1", "\u0093quoted\u0094"},
+		{"caf\xe9", CHARSET_UTF8, "caf\uFFFD"},
+		{"caf\xe9", "", "caf\uFFFD"},
+	}
+	for _, test := range tests {
+		if got := decode(test.text, test.charset); got != test.want {
+			t.Errorf("decode(%q, %q) = %q, want %q", test.text, test.charset, got, test.want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text, charset string
+		want          string
+	}{
+		{"café €5", CHARSET_CP1252, "caf\xe9 \x805"},
+		{"café €5", CHARSET_LATIN1, "caf\xe9 ?5"},
+		{"日本", CHARSET_CP1252, "??"},
+		{"café", CHARSET_UTF8, "café"},
+	}
+	for _, test := range tests {
+		if got := string(encode([]byte(test.text), test.charset)); got != test.want {
+			t.Errorf("encode(%q, %q) = %q, want %q", test.text, test.charset, got, test.want)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	b := New("n", "u")
+	b.SetEncoding(&Encoding{
+		Fallback: CHARSET_CP1252,
+		Channels: map[string]*Encoding{
+			"#Latin": {Fallback: CHARSET_LATIN1, Outgoing: CHARSET_LATIN1},
+		},
+	})
+	texts := make(chan string, 10)
+	b.OnCommand(CMD_PRIVMSG, func(e string, s *Server, m *Message) {
+		texts <- m.Args[1]
+	}).Sync()
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	c.Send(
+		":a!u@h PRIVMSG #utf8 :caf\xc3\xa9",
+		":a!u@h PRIVMSG #cp1252 :\x93caf\xe9\x94",
+		":a!u@h PRIVMSG #latin :\x93caf\xe9\x94",
+	)
+	c.Sync()
+	for _, want := range []string{"café", "“café”", "\u0093café\u0094"} {
+		if got := <-texts; got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+
+	c.serv.WriteMessage(&Message{Command: CMD_PRIVMSG, Args: []string{"#other", "café"}})
+	c.serv.WriteMessage(&Message{Command: CMD_PRIVMSG, Args: []string{"#LATIN", "café"}})
+	c.expectLine("PRIVMSG #other caf\xc3\xa9")
+	c.expectLine("PRIVMSG #LATIN caf\xe9")
+}
@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A NumericError is an error reply (one of the ERR_* numerics) from the
+// server.  Particular errors can be detected with errors.Is and a
+// NumericError with the numeric set, e.g.
+// &NumericError{Numeric: ERR_CANNOTSENDTOCHAN}.
+type NumericError struct {
+	Numeric string // e.g. ERR_NOSUCHNICK
+	Target  string // the nick, channel or command the error is about, if any
+	Text    string // the server's description of the error
+}
+
+// newNumericError returns the error described by an ERR_* reply.
+func newNumericError(m *Message) *NumericError {
+	e := &NumericError{Numeric: m.Command}
+
+	// :server ERR me [target] :text
+	args := m.Args
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	// The RFC describes the parameters which precede the text, and the text
+	// to use if the server doesn't send any.
+	params, desc := 0, NumericText[e.Numeric]
+	if colon := strings.Index(desc, ":"); colon >= 0 {
+		params, desc = strings.Count(desc[:colon], "<"), desc[colon+1:]
+	}
+	if len(args) > params {
+		e.Text, args = args[len(args)-1], args[:len(args)-1]
+	}
+	if e.Text == "" {
+		e.Text = desc
+	}
+	if len(args) > 0 {
+		e.Target = args[0]
+	}
+	return e
+}
+
+// ErrorReply returns the error described by an ERR_* reply, or nil if the
+// message is not an error reply.  It is intended for use by ON_ERROR
+// handlers.
+func ErrorReply(m *Message) *NumericError {
+	if m == nil || !isErrorNumeric(m.Command) {
+		return nil
+	}
+	return newNumericError(m)
+}
+
+func (e *NumericError) Error() string {
+	name, ok := NumericName[e.Numeric]
+	if !ok {
+		name = e.Numeric
+	}
+	if e.Target != "" {
+		return fmt.Sprintf("%s: %s: %s", name, e.Target, e.Text)
+	}
+	return fmt.Sprintf("%s: %s", name, e.Text)
+}
+
+// Is returns true if target is a *NumericError with the same numeric.
+func (e *NumericError) Is(target error) bool {
+	t, ok := target.(*NumericError)
+	return ok && t.Numeric == e.Numeric
+}
+
+// isErrorNumeric returns true if the command is an error numeric (400-599).
+func isErrorNumeric(cmd string) bool {
+	if len(cmd) != 3 || cmd[0] != '4' && cmd[0] != '5' {
+		return false
+	}
+	return cmd[1] >= '0' && cmd[1] <= '9' && cmd[2] >= '0' && cmd[2] <= '9'
+}
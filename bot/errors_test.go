@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestErrorReply(t *testing.T) {
+	tests := []struct {
+		Line string
+		Want *NumericError
+	}{
+		{":serv 001 n :Welcome", nil},
+		{":serv 404 n #chan :Cannot send to channel (+m)", &NumericError{ERR_CANNOTSENDTOCHAN, "#chan", "Cannot send to channel (+m)"}},
+		{":serv 451 n :You have not registered", &NumericError{ERR_NOTREGISTERED, "", "You have not registered"}},
+		{":serv 474 n #chan", &NumericError{ERR_BANNEDFROMCHAN, "#chan", "Cannot join channel (+b)"}},
+	}
+	for _, test := range tests {
+		got := ErrorReply(ParseMessage(test.Line))
+		if got == nil || test.Want == nil {
+			if got != test.Want {
+				t.Errorf("ErrorReply(%q) = %v, want %v", test.Line, got, test.Want)
+			}
+			continue
+		}
+		if *got != *test.Want {
+			t.Errorf("ErrorReply(%q) = %#v, want %#v", test.Line, got, test.Want)
+		}
+	}
+
+	err := error(&NumericError{ERR_CANNOTSENDTOCHAN, "#chan", "Cannot send to channel"})
+	if !errors.Is(err, &NumericError{Numeric: ERR_CANNOTSENDTOCHAN}) {
+		t.Errorf("errors.Is(%v, ERR_CANNOTSENDTOCHAN) = false, want true", err)
+	}
+	if errors.Is(err, &NumericError{Numeric: ERR_NOSUCHNICK}) {
+		t.Errorf("errors.Is(%v, ERR_NOSUCHNICK) = true, want false", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	b := New("n", "u")
+	events := make(chan *NumericError, 1)
+	b.OnEvent(ON_ERROR, func(e string, s *Server, m *Message) {
+		events <- ErrorReply(m)
+	})
+
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Send(":serv 001 n :Welcome")
+	c.Sync()
+
+	ctx := context.Background()
+	result := make(chan error)
+	go func() {
+		result <- c.serv.Send(ctx, NewMessage("", CMD_PRIVMSG, "#chan", "hello"))
+	}()
+	c.expectLine("PRIVMSG #chan hello")
+	c.expectLine("PING send1")
+	c.Send(
+		":serv 404 n #chan :Cannot send to channel",
+		":serv PONG serv send1",
+	)
+	if err := <-result; !errors.Is(err, &NumericError{Numeric: ERR_CANNOTSENDTOCHAN}) {
+		t.Errorf("Send = %v, want ERR_CANNOTSENDTOCHAN", err)
+	}
+	if e := <-events; e == nil || e.Numeric != ERR_CANNOTSENDTOCHAN || e.Target != "#chan" {
+		t.Errorf("ON_ERROR got %v, want ERR_CANNOTSENDTOCHAN for #chan", e)
+	}
+
+	go func() {
+		result <- c.serv.Send(ctx, NewMessage("", CMD_PRIVMSG, "#other", "hello"))
+	}()
+	c.expectLine("PING send2")
+	c.Send(":serv PONG serv send2")
+	if err := <-result; err != nil {
+		t.Errorf("Send = %v, want success", err)
+	}
+}
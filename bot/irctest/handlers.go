@@ -0,0 +1,530 @@
+package irctest
+
+import (
+	"sort"
+	"strings"
+)
+
+// handle processes a message from the client.  The server's lock must be
+// held.
+func (s *Server) handle(c *client, m *Message) {
+	if c.gone {
+		return
+	}
+
+	switch m.Command {
+	case "PASS":
+		return
+	case "CAP":
+		s.cap(c, m)
+		return
+	case "NICK":
+		s.nick(c, m)
+		return
+	case "USER":
+		if len(m.Args) < 4 {
+			c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+			return
+		}
+		if !c.registered {
+			c.user, c.real = m.Args[0], m.Args[3]
+			s.register(c)
+		}
+		return
+	case "PING":
+		s.pong(c, m)
+		return
+	case "PONG":
+		return
+	case "QUIT":
+		reason := "Quit"
+		if len(m.Args) > 0 {
+			reason = "Quit: " + m.Args[0]
+		}
+		c.send("ERROR :Closing link (" + reason + ")")
+		s.quit(c, reason)
+		return
+	}
+
+	if !c.registered {
+		c.reply(errNotRegistered, "You have not registered")
+		return
+	}
+
+	switch m.Command {
+	case "JOIN":
+		s.join(c, m)
+	case "PART":
+		s.part(c, m)
+	case "PRIVMSG", "NOTICE":
+		s.privmsg(c, m)
+	case "NAMES":
+		if len(m.Args) == 0 {
+			c.reply(rplEndOfNames, "*", "End of /NAMES list")
+			return
+		}
+		for _, name := range strings.Split(m.Args[0], ",") {
+			s.names(c, name)
+		}
+	case "TOPIC":
+		s.topic(c, m)
+	case "MODE":
+		s.mode(c, m)
+	case "KICK":
+		s.kick(c, m)
+	case "WHO":
+		s.who(c, m)
+	case "WHOIS":
+		s.whois(c, m)
+	case "ISON":
+		var on []string
+		for _, arg := range m.Args {
+			for _, nick := range strings.Fields(arg) {
+				if o := s.clients[fold(nick)]; o != nil {
+					on = append(on, o.nick)
+				}
+			}
+		}
+		c.reply(rplIsOn, strings.Join(on, " "))
+	default:
+		c.reply(errUnknownCommand, m.Command, "Unknown command")
+	}
+}
+
+// cap handles capability negotiation.
+func (s *Server) cap(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+	capReply := func(args ...string) {
+		target := c.nick
+		if !c.registered {
+			target = "*"
+		}
+		reply := &Message{Prefix: s.Name, Command: "CAP", Args: append([]string{target}, args...)}
+		c.send(reply.String())
+	}
+
+	switch strings.ToUpper(m.Args[0]) {
+	case "LS":
+		if !c.registered {
+			c.capping = true
+		}
+		var caps []string
+		for name, val := range s.Caps {
+			if val != "" {
+				name += "=" + val
+			}
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		capReply("LS", strings.Join(caps, " "))
+	case "LIST":
+		var caps []string
+		for name := range c.caps {
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		capReply("LIST", strings.Join(caps, " "))
+	case "REQ":
+		if !c.registered {
+			c.capping = true
+		}
+		if len(m.Args) < 2 {
+			return
+		}
+		req := strings.Fields(m.Args[1])
+		for _, name := range req {
+			if _, ok := s.Caps[strings.TrimPrefix(name, "-")]; !ok {
+				capReply("NAK", m.Args[1])
+				return
+			}
+		}
+		for _, name := range req {
+			if strings.HasPrefix(name, "-") {
+				delete(c.caps, name[1:])
+			} else {
+				c.caps[name] = true
+			}
+		}
+		capReply("ACK", m.Args[1])
+	case "END":
+		c.capping = false
+		s.register(c)
+	}
+}
+
+// validNick returns true if the nick is acceptable.
+func validNick(nick string) bool {
+	if nick == "" || len(nick) > 30 || strings.ContainsAny(nick[:1], "0123456789-") {
+		return false
+	}
+	for _, r := range nick {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-[]\\`^{}|_", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// nick handles a nick change, or sets the nick during registration.
+func (s *Server) nick(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNoNicknameGvn, "No nickname given")
+		return
+	}
+	nick := m.Args[0]
+	switch other := s.clients[fold(nick)]; {
+	case !validNick(nick):
+		c.reply(errErroneousNick, nick, "Erroneous nickname")
+		return
+	case other == c:
+		if nick == c.nick {
+			return
+		}
+	case other != nil:
+		c.reply(errNicknameInUse, nick, "Nickname is already in use")
+		return
+	}
+
+	if !c.registered {
+		c.nick = nick
+		s.register(c)
+		return
+	}
+
+	change := &Message{Prefix: c.prefix(), Command: "NICK", Args: []string{nick}}
+	for _, p := range s.peers(c) {
+		p.send(change.String())
+	}
+	delete(s.clients, fold(c.nick))
+	c.nick = nick
+	s.clients[fold(nick)] = c
+}
+
+// register completes registration once the client has sent NICK and USER
+// and finished capability negotiation.
+func (s *Server) register(c *client) {
+	if c.registered || c.capping || c.nick == "" || c.user == "" {
+		return
+	}
+	if s.clients[fold(c.nick)] != nil {
+		c.reply(errNicknameInUse, c.nick, "Nickname is already in use")
+		c.nick = ""
+		return
+	}
+	c.registered = true
+	s.clients[fold(c.nick)] = c
+
+	c.reply(rplWelcome, "Welcome to the IRCTest network, "+c.prefix())
+	c.reply(rplYourHost, "Your host is "+s.Name+", running irctest")
+	c.reply(rplCreated, "This server was created for testing")
+	c.reply(rplMyInfo, s.Name, "irctest", "i", "iklmnopstv")
+	if len(s.ISupport) > 0 {
+		c.reply(rplISupport, append(s.ISupport[:len(s.ISupport):len(s.ISupport)], "are supported by this server")...)
+	}
+	c.reply(errNoMOTD, "MOTD File is missing")
+}
+
+// pong answers a PING.
+func (s *Server) pong(c *client, m *Message) {
+	token := s.Name
+	if len(m.Args) > 0 {
+		token = m.Args[0]
+	}
+	pong := &Message{Prefix: s.Name, Command: "PONG", Args: []string{s.Name, token}}
+	c.send(pong.String())
+}
+
+// join adds the client to each of the channels.
+func (s *Server) join(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(m.Args[0], ",") {
+		if !strings.HasPrefix(name, "#") || strings.ContainsAny(name, " \a") {
+			c.reply(errNoSuchChannel, name, "No such channel")
+			continue
+		}
+		ch := s.channels[fold(name)]
+		if ch == nil {
+			ch = &channel{name: name, members: map[*client]string{}}
+			s.channels[fold(name)] = ch
+		}
+		if _, ok := ch.members[c]; ok {
+			continue
+		}
+		ch.members[c] = ""
+		if len(ch.members) == 1 {
+			ch.members[c] = "@"
+		}
+
+		ch.broadcast(&Message{Prefix: c.prefix(), Command: "JOIN", Args: []string{ch.name}}, nil)
+		if ch.topic != "" {
+			c.reply(rplTopic, ch.name, ch.topic)
+		}
+		s.names(c, ch.name)
+	}
+}
+
+// part removes the client from each of the channels.
+func (s *Server) part(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(m.Args[0], ",") {
+		ch := s.channels[fold(name)]
+		if ch == nil {
+			c.reply(errNoSuchChannel, name, "No such channel")
+			continue
+		}
+		if _, ok := ch.members[c]; !ok {
+			c.reply(errNotOnChannel, ch.name, "You're not on that channel")
+			continue
+		}
+		part := &Message{Prefix: c.prefix(), Command: "PART", Args: []string{ch.name}}
+		if len(m.Args) > 1 {
+			part.Args = append(part.Args, m.Args[1])
+		}
+		ch.broadcast(part, nil)
+		s.leave(ch, c)
+	}
+}
+
+// leave removes the client from the channel, which is removed once empty.
+func (s *Server) leave(ch *channel, c *client) {
+	delete(ch.members, c)
+	if len(ch.members) == 0 {
+		delete(s.channels, fold(ch.name))
+	}
+}
+
+// privmsg delivers a PRIVMSG or NOTICE to each of its targets.  Errors are
+// not reported for NOTICE.
+func (s *Server) privmsg(c *client, m *Message) {
+	notice := m.Command == "NOTICE"
+	switch {
+	case len(m.Args) == 0:
+		if !notice {
+			c.reply(errNoRecipient, "No recipient given ("+m.Command+")")
+		}
+		return
+	case len(m.Args) == 1 || m.Args[1] == "":
+		if !notice {
+			c.reply(errNoTextToSend, "No text to send")
+		}
+		return
+	}
+
+	for _, target := range strings.Split(m.Args[0], ",") {
+		msg := &Message{Prefix: c.prefix(), Command: m.Command, Args: []string{target, m.Args[1]}}
+		if strings.HasPrefix(target, "#") {
+			ch := s.channels[fold(target)]
+			switch {
+			case ch == nil:
+				if !notice {
+					c.reply(errNoSuchChannel, target, "No such channel")
+				}
+			case !ch.has(c):
+				if !notice {
+					c.reply(errCannotSendTo, ch.name, "Cannot send to channel")
+				}
+			default:
+				ch.broadcast(msg, c)
+			}
+			continue
+		}
+
+		to := s.clients[fold(target)]
+		if to == nil {
+			if !notice {
+				c.reply(errNoSuchNick, target, "No such nick/channel")
+			}
+			continue
+		}
+		to.send(msg.String())
+	}
+}
+
+func (ch *channel) has(c *client) bool {
+	_, ok := ch.members[c]
+	return ok
+}
+
+// names sends the channel's names to the client.
+func (s *Server) names(c *client, name string) {
+	if ch := s.channels[fold(name)]; ch != nil {
+		c.reply(rplNamReply, "=", ch.name, strings.Join(ch.names(), " "))
+		name = ch.name
+	}
+	c.reply(rplEndOfNames, name, "End of /NAMES list")
+}
+
+// topic queries or sets a channel's topic.
+func (s *Server) topic(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+	ch := s.channels[fold(m.Args[0])]
+	switch {
+	case ch == nil:
+		c.reply(errNoSuchChannel, m.Args[0], "No such channel")
+	case len(m.Args) == 1 && ch.topic == "":
+		c.reply(rplNoTopic, ch.name, "No topic is set")
+	case len(m.Args) == 1:
+		c.reply(rplTopic, ch.name, ch.topic)
+	case !ch.has(c):
+		c.reply(errNotOnChannel, ch.name, "You're not on that channel")
+	default:
+		ch.topic = m.Args[1]
+		ch.broadcast(&Message{Prefix: c.prefix(), Command: "TOPIC", Args: []string{ch.name, ch.topic}}, nil)
+	}
+}
+
+// mode queries a channel's modes or a user's modes, or changes the +o and +v
+// modes of channel members.  Other mode changes are ignored.
+func (s *Server) mode(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+	if !strings.HasPrefix(m.Args[0], "#") {
+		if fold(m.Args[0]) == fold(c.nick) && len(m.Args) == 1 {
+			c.reply(rplUModeIs, "+i")
+		}
+		return
+	}
+
+	ch := s.channels[fold(m.Args[0])]
+	if ch == nil {
+		c.reply(errNoSuchChannel, m.Args[0], "No such channel")
+		return
+	}
+	if len(m.Args) == 1 {
+		c.reply(rplChannelModeIs, ch.name, "+nt")
+		return
+	}
+
+	add, params := true, m.Args[2:]
+	applied := &Message{Prefix: c.prefix(), Command: "MODE", Args: []string{ch.name, ""}}
+	last := byte(0)
+	for _, mode := range m.Args[1] {
+		switch mode {
+		case '+', '-':
+			add = mode == '+'
+			continue
+		case 'o', 'v':
+		default:
+			continue
+		}
+		if len(params) == 0 {
+			break
+		}
+		nick := params[0]
+		params = params[1:]
+		target := s.clients[fold(nick)]
+		if target == nil || !ch.has(target) {
+			c.reply(errUserNotInChan, nick, ch.name, "They aren't on that channel")
+			continue
+		}
+
+		prefix := map[rune]string{'o': "@", 'v': "+"}[mode]
+		switch cur := ch.members[target]; {
+		case add && cur != "@":
+			ch.members[target] = prefix
+		case !add && cur == prefix:
+			ch.members[target] = ""
+		}
+
+		sign := byte('-')
+		if add {
+			sign = '+'
+		}
+		if sign != last {
+			applied.Args[1] += string(sign)
+			last = sign
+		}
+		applied.Args[1] += string(mode)
+		applied.Args = append(applied.Args, target.nick)
+	}
+	if applied.Args[1] != "" {
+		ch.broadcast(applied, nil)
+	}
+}
+
+// kick removes a member from a channel.
+func (s *Server) kick(c *client, m *Message) {
+	if len(m.Args) < 2 {
+		c.reply(errNeedMoreParams, m.Command, "Not enough parameters")
+		return
+	}
+	ch := s.channels[fold(m.Args[0])]
+	if ch == nil {
+		c.reply(errNoSuchChannel, m.Args[0], "No such channel")
+		return
+	}
+	target := s.clients[fold(m.Args[1])]
+	if target == nil || !ch.has(target) {
+		c.reply(errUserNotInChan, m.Args[1], ch.name, "They aren't on that channel")
+		return
+	}
+	reason := c.nick
+	if len(m.Args) > 2 {
+		reason = m.Args[2]
+	}
+	ch.broadcast(&Message{Prefix: c.prefix(), Command: "KICK", Args: []string{ch.name, target.nick, reason}}, nil)
+	s.leave(ch, target)
+}
+
+// who lists the members of a channel, or the user with the nick.
+func (s *Server) who(c *client, m *Message) {
+	mask := "*"
+	if len(m.Args) > 0 {
+		mask = m.Args[0]
+	}
+	whoReply := func(chname string, o *client, prefix string) {
+		c.reply(rplWhoReply, chname, o.user, clientHost, s.Name, o.nick, "H"+prefix, "0 "+o.real)
+	}
+	if ch := s.channels[fold(mask)]; ch != nil {
+		for _, o := range ch.sorted() {
+			whoReply(ch.name, o, ch.members[o])
+		}
+	} else if o := s.clients[fold(mask)]; o != nil {
+		whoReply("*", o, "")
+	}
+	c.reply(rplEndOfWho, mask, "End of /WHO list")
+}
+
+// whois describes the user with the nick.
+func (s *Server) whois(c *client, m *Message) {
+	if len(m.Args) == 0 {
+		c.reply(errNoNicknameGvn, "No nickname given")
+		return
+	}
+	nick := m.Args[len(m.Args)-1]
+	o := s.clients[fold(nick)]
+	if o == nil {
+		c.reply(errNoSuchNick, nick, "No such nick/channel")
+		c.reply(rplEndOfWhois, nick, "End of /WHOIS list")
+		return
+	}
+	c.reply(rplWhoisUser, o.nick, o.user, clientHost, "*", o.real)
+	var chans []string
+	for _, name := range s.channelNames() {
+		ch := s.channels[name]
+		if prefix, ok := ch.members[o]; ok {
+			chans = append(chans, prefix+ch.name)
+		}
+	}
+	if len(chans) > 0 {
+		c.reply(rplWhoisChannels, o.nick, strings.Join(chans, " "))
+	}
+	c.reply(rplEndOfWhois, o.nick, "End of /WHOIS list")
+}
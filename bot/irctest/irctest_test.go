@@ -0,0 +1,232 @@
+package irctest_test
+
+import (
+	"context"
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/blightbot/acro"
+	"github.com/kylelemons/blightbot/bot"
+	"github.com/kylelemons/blightbot/bot/irctest"
+	"github.com/kylelemons/blightbot/commander"
+)
+
+func addUser(t *testing.T, srv *irctest.Server, nick string) *irctest.User {
+	t.Helper()
+	u, err := srv.AddUser(nick)
+	if err != nil {
+		t.Fatalf("AddUser(%q): %s", nick, err)
+	}
+	return u
+}
+
+func expect(t *testing.T, u *irctest.User, want string) *irctest.Message {
+	t.Helper()
+	m, err := u.Expect(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestUsers(t *testing.T) {
+	srv := irctest.New()
+	defer srv.Close()
+
+	alice, bob := addUser(t, srv, "alice"), addUser(t, srv, "bob")
+	expect(t, alice, "001 alice :Welcome to the IRCTest network, alice!alice@irctest")
+	if _, err := srv.AddUser("Alice"); err == nil {
+		t.Errorf("AddUser(%q) succeeded with %q connected", "Alice", "alice")
+	}
+
+	alice.Join("#chan")
+	expect(t, alice, ":alice!alice@irctest JOIN #chan")
+	expect(t, alice, "353 alice = #chan @alice")
+	bob.Join("#Chan")
+	expect(t, bob, "353 bob = #chan :@alice bob")
+	expect(t, alice, ":bob!bob@irctest JOIN #chan")
+
+	bob.Say("#chan", "hello there")
+	bob.Say("nobody", "hello?")
+	expect(t, alice, ":bob!bob@irctest PRIVMSG #chan :hello there")
+	expect(t, bob, "401 bob nobody :No such nick/channel")
+
+	bob.SetNick("robert")
+	expect(t, alice, ":bob!bob@irctest NICK robert")
+	alice.Sendf("MODE #chan +v %s", "robert")
+	expect(t, bob, ":alice!alice@irctest MODE #chan +v robert")
+	if got, want := srv.Members("#chan"), []string{"@alice", "+robert"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members = %q, want %q", got, want)
+	}
+
+	bob.Quit("bye")
+	expect(t, alice, ":robert!bob@irctest QUIT :Quit: bye")
+	if got, want := srv.Nicks(), []string{"alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Nicks = %q, want %q", got, want)
+	}
+}
+
+func TestSlowClient(t *testing.T) {
+	srv := irctest.New()
+	defer srv.Close()
+
+	conn, err := srv.Dial(context.Background())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "NICK slow\r\nUSER slow 0 * :Slow\r\nJOIN #chan\r\n")
+	if err := srv.WaitNick("slow"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection reads nothing, so it falls behind and is dropped
+	alice := addUser(t, srv, "alice")
+	alice.Join("#chan")
+	for i := 0; i < 2000; i++ {
+		alice.Say("#chan", "spam")
+	}
+	expect(t, alice, ":slow!slow@irctest QUIT :SendQ exceeded")
+	if got, want := srv.Members("#chan"), []string{"alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members = %q, want %q", got, want)
+	}
+}
+
+func TestBot(t *testing.T) {
+	srv := irctest.New()
+	srv.Caps["multi-prefix"] = ""
+	defer srv.Close()
+
+	b := bot.New("blight", "bot")
+	b.SetFlood(0, 0)
+	b.OnConnect(func(e string, s *bot.Server, m *bot.Message) {
+		s.WriteMessage(bot.NewMessage("", bot.CMD_JOIN, "#bots"))
+	})
+	echo := commander.Cmd("echo", func(s *commander.Source, r *commander.Response, cmd string, args []string) {
+		r.Public()
+		r.Printf("%s said %s", s.ID().Nick, strings.Join(args, " "))
+	})
+	go commander.Run(b, '!', []*commander.Command{echo})
+	defer b.Close()
+
+	if err := b.ConnectTransport("irctest", bot.DialerFunc(srv.Dial)); err != nil {
+		t.Fatalf("ConnectTransport: %s", err)
+	}
+	if err := srv.Wait(func() bool { return len(srv.Members("#bots")) == 1 }); err != nil {
+		t.Fatalf("bot did not join: %s", err)
+	}
+
+	carol, dave := addUser(t, srv, "carol"), addUser(t, srv, "dave")
+	carol.Join("#bots")
+	dave.Join("#bots")
+	carol.Say("#bots", "!echo hi all")
+	expect(t, dave, ":carol!carol@irctest PRIVMSG #bots :!echo hi all")
+	expect(t, dave, ":blight!bot@irctest PRIVMSG #bots :carol said hi all")
+}
+
+// said reads the user's messages until the bot says something in the
+// channel which starts with prefix, and returns what it said.
+func said(t *testing.T, u *irctest.User, channel, prefix string) string {
+	t.Helper()
+	for {
+		m, err := u.Next()
+		if err != nil {
+			t.Fatalf("waiting for %q: %s", prefix, err)
+		}
+		if m.Nick() == "blight" && m.Command == "PRIVMSG" && len(m.Args) == 2 &&
+			m.Args[0] == channel && strings.HasPrefix(m.Args[1], prefix) {
+			return m.Args[1]
+		}
+	}
+}
+
+func TestAcro(t *testing.T) {
+	for name, val := range map[string]string{
+		"acro-start":  "500ms",
+		"acro-submit": "1s",
+		"acro-vote":   "1s",
+	} {
+		if err := flag.Set(name, val); err != nil {
+			t.Fatalf("setting -%s: %s", name, err)
+		}
+	}
+
+	srv := irctest.New()
+	defer srv.Close()
+
+	b := bot.New("blight", "bot")
+	b.SetFlood(0, 0)
+	b.OnConnect(func(e string, s *bot.Server, m *bot.Message) {
+		s.WriteMessage(bot.NewMessage("", bot.CMD_JOIN, "#acro"))
+	})
+	acro.Register(b)
+	go commander.Run(b, '!', []*commander.Command{acro.Acro})
+	defer b.Close()
+
+	if err := b.ConnectTransport("irctest", bot.DialerFunc(srv.Dial)); err != nil {
+		t.Fatalf("ConnectTransport: %s", err)
+	}
+	if err := srv.Wait(func() bool { return len(srv.Members("#acro")) == 1 }); err != nil {
+		t.Fatalf("bot did not join: %s", err)
+	}
+
+	players := []*irctest.User{addUser(t, srv, "alice"), addUser(t, srv, "bob"), addUser(t, srv, "carol")}
+	alice, bob, carol := players[0], players[1], players[2]
+	for _, u := range players {
+		u.Join("#acro")
+	}
+
+	alice.Say("#acro", "!acro start")
+	said(t, alice, "#acro", "Acro is starting")
+	for _, u := range players {
+		u.Say("#acro", "!acro join")
+		said(t, alice, "#acro", u.Nick()+" has joined the game!")
+	}
+
+	// Each player submits an acronym for the round's letters
+	text := said(t, alice, "#acro", "Your acro this round is: ")
+	letters := strings.Trim(strings.TrimPrefix(text, "Your acro this round is: "), "\x02\x0F")
+	said(t, alice, "#acro", `Type "/msg blight ACRO #acro SUBMIT <acronym>"`)
+	submitted := map[string]string{}
+	for _, u := range players {
+		var words []string
+		for _, l := range letters {
+			words = append(words, string(l)+strings.ToLower(u.Nick()))
+		}
+		submitted[u.Nick()] = strings.Join(words, " ")
+		u.Say("blight", "ACRO #acro SUBMIT "+submitted[u.Nick()])
+		expect(t, u, ":blight!bot@irctest NOTICE "+u.Nick()+" :Acronym accepted!")
+	}
+
+	// The acronyms are listed in some order, and carol's wins two votes to one
+	number := map[string]string{}
+	for range players {
+		text := said(t, alice, "#acro", "")
+		num, acronym, _ := strings.Cut(text, ". ")
+		for nick, sub := range submitted {
+			if sub == acronym {
+				number[nick] = num
+			}
+		}
+	}
+	if len(number) != len(players) {
+		t.Fatalf("listed acronyms %v, want one for each of %v", number, submitted)
+	}
+	said(t, alice, "#acro", `Type "/msg blight ACRO #acro VOTE <number>"`)
+	for _, v := range []struct {
+		Voter *irctest.User
+		For   string
+	}{{alice, "carol"}, {bob, "carol"}, {carol, "alice"}} {
+		v.Voter.Say("blight", "ACRO #acro VOTE "+number[v.For])
+		expect(t, v.Voter, ":blight!bot@irctest NOTICE "+v.Voter.Nick()+" :Your vote has been counted.")
+	}
+
+	said(t, alice, "#acro", "The results are in!")
+	if got, want := said(t, alice, "#acro", "1. "), "1. "+submitted["carol"]+" (carol, 2 votes)"; got != want {
+		t.Errorf("winner = %q, want %q", got, want)
+	}
+	said(t, alice, "#acro", "Congratulations, \x02carol\x0F!")
+}
@@ -0,0 +1,85 @@
+package irctest
+
+import (
+	"strings"
+)
+
+// A Message is an IRC message as seen by the fake server.  Tags are not
+// supported, and are discarded when parsing.
+type Message struct {
+	Prefix  string
+	Command string
+	Args    []string
+}
+
+// Parse parses a line, returning nil if it has no command.
+func Parse(line string) *Message {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	m := new(Message)
+	if strings.HasPrefix(line, ":") {
+		m.Prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if line[0] == ':' {
+			args = append(args, line[1:])
+			break
+		}
+		var arg string
+		arg, line, _ = strings.Cut(line, " ")
+		args = append(args, arg)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	m.Command, m.Args = strings.ToUpper(args[0]), args[1:]
+	return m
+}
+
+// String returns the message as a line, without the CR LF.
+func (m *Message) String() string {
+	var b strings.Builder
+	if m.Prefix != "" {
+		b.WriteString(":" + m.Prefix + " ")
+	}
+	b.WriteString(m.Command)
+	for i, arg := range m.Args {
+		b.WriteByte(' ')
+		if i == len(m.Args)-1 && (arg == "" || arg[0] == ':' || strings.Contains(arg, " ")) {
+			b.WriteByte(':')
+		}
+		b.WriteString(arg)
+	}
+	return b.String()
+}
+
+// Nick returns the nick in the prefix, if any.
+func (m *Message) Nick() string {
+	nick, _, _ := strings.Cut(m.Prefix, "!")
+	return nick
+}
+
+// Match returns true if the message has the same command and arguments as
+// want, and also the same prefix if want has one.
+func (m *Message) Match(want *Message) bool {
+	if want.Prefix != "" && want.Prefix != m.Prefix {
+		return false
+	}
+	if m.Command != want.Command || len(m.Args) != len(want.Args) {
+		return false
+	}
+	for i := range m.Args {
+		if m.Args[i] != want.Args[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,401 @@
+// Package irctest provides a minimal in-process IRC server, with scripted
+// virtual users, for testing bots end to end.
+//
+// A Server handles registration (with optional capability negotiation),
+// channels, NAMES, WHO, TOPIC, channel operator and voice modes, PRIVMSG and
+// NOTICE fan-out, nick changes, KICK and QUIT.  Every message is handled to
+// completion before the next, so a virtual user's actions are seen by the
+// other clients in the order they were made.
+package irctest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server defaults
+const (
+	DefaultName    = "irc.test"
+	DefaultTimeout = 5 * time.Second
+)
+
+// DefaultISupport lists the RPL_ISUPPORT tokens sent by a new Server.
+var DefaultISupport = []string{
+	"CASEMAPPING=ascii",
+	"CHANTYPES=#",
+	"PREFIX=(ov)@+",
+	"CHANMODES=b,k,l,imnpst",
+	"NICKLEN=30",
+	"NETWORK=IRCTest",
+}
+
+// The host of every client
+const clientHost = "irctest"
+
+// The size of each connection's buffer of lines waiting to be written.  A
+// connection which falls this far behind is disconnected.
+const outBuffer = 1024
+
+// ErrClosed is returned when connecting to a closed server.
+var ErrClosed = errors.New("irctest: server closed")
+
+// Replies sent by the server
+const (
+	rplWelcome        = "001"
+	rplYourHost       = "002"
+	rplCreated        = "003"
+	rplMyInfo         = "004"
+	rplISupport       = "005"
+	rplUModeIs        = "221"
+	rplIsOn           = "303"
+	rplWhoisUser      = "311"
+	rplEndOfWho       = "315"
+	rplEndOfWhois     = "318"
+	rplWhoisChannels  = "319"
+	rplChannelModeIs  = "324"
+	rplNoTopic        = "331"
+	rplTopic          = "332"
+	rplWhoReply       = "352"
+	rplNamReply       = "353"
+	rplEndOfNames     = "366"
+	errNoSuchNick     = "401"
+	errNoSuchChannel  = "403"
+	errCannotSendTo   = "404"
+	errNoRecipient    = "411"
+	errNoTextToSend   = "412"
+	errUnknownCommand = "421"
+	errNoMOTD         = "422"
+	errNoNicknameGvn  = "431"
+	errErroneousNick  = "432"
+	errNicknameInUse  = "433"
+	errUserNotInChan  = "441"
+	errNotOnChannel   = "442"
+	errNotRegistered  = "451"
+	errNeedMoreParams = "461"
+)
+
+// A Server is a minimal IRC server.  Its fields may be changed before the
+// first client connects.
+type Server struct {
+	// Name is the server's name, used as the prefix of its replies.
+	Name string
+
+	// ISupport lists the tokens sent in RPL_ISUPPORT.
+	ISupport []string
+
+	// Caps lists the capabilities offered in CAP LS, with their values (if
+	// any).  Clients may request any of them.
+	Caps map[string]string
+
+	// Timeout is how long User.Next and Server.Wait wait.
+	Timeout time.Duration
+
+	lock     sync.Mutex
+	clients  map[string]*client // registered, by casefolded nick
+	conns    map[*client]bool   // all connected clients
+	channels map[string]*channel
+	closed   bool
+}
+
+// New returns a new Server with the defaults.
+func New() *Server {
+	return &Server{
+		Name:     DefaultName,
+		ISupport: DefaultISupport,
+		Caps:     map[string]string{},
+		Timeout:  DefaultTimeout,
+		clients:  map[string]*client{},
+		conns:    map[*client]bool{},
+		channels: map[string]*channel{},
+	}
+}
+
+// A client is a connection or a virtual user.
+type client struct {
+	srv *Server
+
+	nick, user, real string
+	registered       bool
+	capping          bool // negotiating capabilities
+	caps             map[string]bool
+	gone             bool // disconnected
+
+	out  chan string // lines for the connection, if any
+	conn io.Closer
+	vu   *User // the virtual user, if any
+}
+
+// A channel tracks its members, with their prefix (@ or +) if any.
+type channel struct {
+	name    string
+	topic   string
+	members map[*client]string
+}
+
+func fold(name string) string { return strings.ToLower(name) }
+
+// Dial connects a client to the server over an in-memory pipe.  It has the
+// signature of bot.DialerFunc, so a bot can connect with
+//
+//	b.ConnectTransport("irctest", bot.DialerFunc(srv.Dial))
+func (s *Server) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	local, remote := net.Pipe()
+	if err := s.serve(remote); err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+	return local, nil
+}
+
+// Serve accepts connections from the listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if err := s.serve(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+}
+
+// serve handles messages from the connection.
+func (s *Server) serve(conn io.ReadWriteCloser) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	c := &client{
+		srv:  s,
+		caps: map[string]bool{},
+		out:  make(chan string, outBuffer),
+		conn: conn,
+	}
+	s.conns[c] = true
+
+	go func() {
+		for line := range c.out {
+			io.WriteString(conn, line+"\r\n")
+		}
+		conn.Close()
+	}()
+
+	go func() {
+		in := bufio.NewReader(conn)
+		for {
+			line, err := in.ReadString('\n')
+			if err != nil {
+				s.lock.Lock()
+				s.quit(c, "Connection closed")
+				s.lock.Unlock()
+				return
+			}
+			if m := Parse(line); m != nil {
+				s.lock.Lock()
+				s.handle(c, m)
+				s.lock.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+// Close disconnects all clients and refuses further connections.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.send("ERROR :Server closing")
+		s.quit(c, "Server closing")
+	}
+	return nil
+}
+
+// Nicks returns the sorted nicks of the registered clients.
+func (s *Server) Nicks() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var nicks []string
+	for _, c := range s.clients {
+		nicks = append(nicks, c.nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// Members returns the sorted nicks in the channel, each with its prefix (@
+// or +), if any.
+func (s *Server) Members(name string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ch := s.channels[fold(name)]
+	if ch == nil {
+		return nil
+	}
+	return ch.names()
+}
+
+// Topic returns the channel's topic.
+func (s *Server) Topic(name string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ch := s.channels[fold(name)]; ch != nil {
+		return ch.topic
+	}
+	return ""
+}
+
+// Wait waits until cond returns true, checking it periodically.  It returns
+// an error if it does not within the server's Timeout.  Cond must not be
+// called with the server's lock held, so it may use the Server's methods.
+func (s *Server) Wait(cond func() bool) error {
+	deadline := time.Now().Add(s.Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("irctest: condition not met after %s", s.Timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// WaitNick waits until a client with the nick has registered.
+func (s *Server) WaitNick(nick string) error {
+	return s.Wait(func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.clients[fold(nick)] != nil
+	})
+}
+
+// send sends a line to the client.  The server's lock must be held, so a
+// connection which is not reading its lines is disconnected rather than
+// waited for.
+func (c *client) send(line string) {
+	switch {
+	case c.gone:
+	case c.vu != nil:
+		c.vu.receive(line)
+	default:
+		select {
+		case c.out <- line:
+		default:
+			c.srv.quit(c, "SendQ exceeded")
+		}
+	}
+}
+
+// prefix returns the client's nick!user@host.
+func (c *client) prefix() string {
+	return c.nick + "!" + c.user + "@" + clientHost
+}
+
+// reply sends a numeric reply to the client.
+func (c *client) reply(num string, args ...string) {
+	target := c.nick
+	if !c.registered {
+		target = "*"
+	}
+	m := &Message{Prefix: c.srv.Name, Command: num, Args: append([]string{target}, args...)}
+	c.send(m.String())
+}
+
+// names returns the channel's members, sorted, with their prefixes.
+func (ch *channel) names() []string {
+	var names []string
+	for c, prefix := range ch.members {
+		names = append(names, prefix+c.nick)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.TrimLeft(names[i], "@+") < strings.TrimLeft(names[j], "@+")
+	})
+	return names
+}
+
+// broadcast sends the message to the members of the channel.
+func (ch *channel) broadcast(m *Message, except *client) {
+	line := m.String()
+	for _, c := range ch.sorted() {
+		if c != except {
+			c.send(line)
+		}
+	}
+}
+
+// sorted returns the members of the channel, in nick order.
+func (ch *channel) sorted() []*client {
+	var cs []*client
+	for c := range ch.members {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return fold(cs[i].nick) < fold(cs[j].nick) })
+	return cs
+}
+
+// peers returns the client and the clients which share a channel with it.
+func (s *Server) peers(c *client) []*client {
+	seen := map[*client]bool{c: true}
+	peers := []*client{c}
+	for _, name := range s.channelNames() {
+		ch := s.channels[name]
+		if _, ok := ch.members[c]; !ok {
+			continue
+		}
+		for _, p := range ch.sorted() {
+			if !seen[p] {
+				seen[p] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers
+}
+
+// channelNames returns the casefolded names of the channels, sorted.
+func (s *Server) channelNames() []string {
+	var names []string
+	for name := range s.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quit removes the client from the server.
+func (s *Server) quit(c *client, reason string) {
+	if c.gone {
+		return
+	}
+	if c.registered {
+		m := &Message{Prefix: c.prefix(), Command: "QUIT", Args: []string{reason}}
+		for _, p := range s.peers(c)[1:] {
+			p.send(m.String())
+		}
+		for name, ch := range s.channels {
+			delete(ch.members, c)
+			if len(ch.members) == 0 {
+				delete(s.channels, name)
+			}
+		}
+		delete(s.clients, fold(c.nick))
+	}
+	delete(s.conns, c)
+	c.gone = true
+	if c.out != nil {
+		close(c.out)
+	}
+}
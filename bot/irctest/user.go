@@ -0,0 +1,182 @@
+package irctest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A User is a scripted client, which is registered with the server without
+// a network connection.  Its actions are handled before its methods return,
+// and the messages it receives are kept until read with Next or Expect.
+type User struct {
+	srv *Server
+	c   *client
+
+	lock     sync.Mutex
+	received []string
+	notify   chan struct{} // signalled when a line is received
+}
+
+// AddUser registers a virtual user with the nick, and the user name and
+// real name of the nick.
+func (s *Server) AddUser(nick string) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if !validNick(nick) {
+		return nil, fmt.Errorf("irctest: invalid nick %q", nick)
+	}
+	if s.clients[fold(nick)] != nil {
+		return nil, fmt.Errorf("irctest: nick %q is in use", nick)
+	}
+
+	u := &User{
+		srv:    s,
+		notify: make(chan struct{}, 1),
+	}
+	u.c = &client{
+		srv:  s,
+		nick: nick,
+		user: nick,
+		real: nick,
+		caps: map[string]bool{},
+		vu:   u,
+	}
+	s.conns[u.c] = true
+	s.register(u.c)
+	return u, nil
+}
+
+// receive queues a line for the user.  The server's lock is held.
+func (u *User) receive(line string) {
+	u.lock.Lock()
+	u.received = append(u.received, line)
+	u.lock.Unlock()
+
+	select {
+	case u.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Nick returns the user's current nick.
+func (u *User) Nick() string {
+	u.srv.lock.Lock()
+	defer u.srv.lock.Unlock()
+	return u.c.nick
+}
+
+// Send handles the line as though the user had sent it.
+func (u *User) Send(line string) {
+	m := Parse(line)
+	if m == nil {
+		return
+	}
+	u.srv.lock.Lock()
+	defer u.srv.lock.Unlock()
+	u.srv.handle(u.c, m)
+}
+
+// Sendf formats and sends a line.
+func (u *User) Sendf(format string, args ...interface{}) {
+	u.Send(fmt.Sprintf(format, args...))
+}
+
+// Join joins the channels.
+func (u *User) Join(channels ...string) {
+	u.Send("JOIN " + strings.Join(channels, ","))
+}
+
+// Part leaves the channel.
+func (u *User) Part(channel, reason string) {
+	u.Send("PART " + channel + " :" + reason)
+}
+
+// Say sends a PRIVMSG to the target.
+func (u *User) Say(target, text string) {
+	u.Send("PRIVMSG " + target + " :" + text)
+}
+
+// Notice sends a NOTICE to the target.
+func (u *User) Notice(target, text string) {
+	u.Send("NOTICE " + target + " :" + text)
+}
+
+// SetNick changes the user's nick.
+func (u *User) SetNick(nick string) {
+	u.Send("NICK " + nick)
+}
+
+// Quit disconnects the user.
+func (u *User) Quit(reason string) {
+	u.Send("QUIT :" + reason)
+}
+
+// Received returns the lines the user has received and not yet read, and
+// discards them.
+func (u *User) Received() []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	lines := u.received
+	u.received = nil
+	return lines
+}
+
+// Next returns the next message received by the user, waiting up to the
+// server's Timeout for one to arrive.
+func (u *User) Next() (*Message, error) {
+	timeout := time.NewTimer(u.srv.Timeout)
+	defer timeout.Stop()
+	for {
+		u.lock.Lock()
+		if len(u.received) > 0 {
+			line := u.received[0]
+			u.received = u.received[1:]
+			u.lock.Unlock()
+			return Parse(line), nil
+		}
+		u.lock.Unlock()
+
+		select {
+		case <-u.notify:
+		case <-timeout.C:
+			return nil, fmt.Errorf("irctest: %s received nothing after %s", u.Nick(), u.srv.Timeout)
+		}
+	}
+}
+
+// Expect reads messages until one matches want (see Message.Match), which
+// it returns.  It returns an error, listing the messages it skipped, if
+// none does within the server's Timeout.
+func (u *User) Expect(want string) (*Message, error) {
+	w := Parse(want)
+	if w == nil {
+		return nil, fmt.Errorf("irctest: cannot expect %q", want)
+	}
+
+	var skipped []string
+	deadline := time.Now().Add(u.srv.Timeout)
+	for {
+		u.lock.Lock()
+		for len(u.received) > 0 {
+			line := u.received[0]
+			u.received = u.received[1:]
+			if m := Parse(line); m != nil && m.Match(w) {
+				u.lock.Unlock()
+				return m, nil
+			}
+			skipped = append(skipped, line)
+		}
+		u.lock.Unlock()
+
+		select {
+		case <-u.notify:
+		case <-time.After(time.Until(deadline)):
+			return nil, fmt.Errorf("irctest: %q not received after %s (got %q)", want, u.srv.Timeout, skipped)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package bot
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Casemappings
+const (
+	CASEMAP_ASCII   = "ascii"
+	CASEMAP_RFC1459 = "rfc1459"
+	CASEMAP_STRICT  = "strict-rfc1459"
+)
+
+// Defaults used until (or unless) the server says otherwise.
+var isupportDefaults = map[string]string{
+	"CASEMAPPING": CASEMAP_RFC1459,
+	"CHANTYPES":   "#&",
+	"PREFIX":      "(ov)@+",
+	"CHANMODES":   "b,k,l,imnpst",
+	"NICKLEN":     "9",
+}
+
+// ISupport holds the features advertised by a server in RPL_ISUPPORT.  The
+// zero value uses RFC 2812 defaults and is safe for concurrent use.
+type ISupport struct {
+	lock   sync.RWMutex
+	tokens map[string]string
+}
+
+// parse updates the features from the arguments of an RPL_ISUPPORT message.
+func (f *ISupport) parse(args []string) {
+	// :server 005 <nick> <token>... :are supported by this server
+	if len(args) < 3 {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.tokens == nil {
+		f.tokens = map[string]string{}
+	}
+	for _, tok := range args[1 : len(args)-1] {
+		if strings.HasPrefix(tok, "-") {
+			delete(f.tokens, strings.ToUpper(tok[1:]))
+			continue
+		}
+		key, val := splitCap(tok)
+		f.tokens[strings.ToUpper(key)] = unescapeISupport(val)
+	}
+}
+
+// unescapeISupport decodes \xHH escapes in ISUPPORT values.
+func unescapeISupport(val string) string {
+	if !strings.Contains(val, "\\x") {
+		return val
+	}
+	b := make([]byte, 0, len(val))
+	for i := 0; i < len(val); i++ {
+		if val[i] == '\\' && i+3 < len(val) && val[i+1] == 'x' {
+			if n, err := strconv.ParseUint(val[i+2:i+4], 16, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, val[i])
+	}
+	return string(b)
+}
+
+// Get returns the raw value of the given token and whether the server
+// advertised it.  Defaults are not consulted.
+func (f *ISupport) Get(key string) (string, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	val, ok := f.tokens[key]
+	return val, ok
+}
+
+// value returns the value of the token, or its default if it was not
+// advertised or was advertised with an empty value.
+func (f *ISupport) value(key string) string {
+	if val, ok := f.Get(key); ok && val != "" {
+		return val
+	}
+	return isupportDefaults[key]
+}
+
+// Network returns the name of the network, if the server advertised it.
+func (f *ISupport) Network() string {
+	val, _ := f.Get("NETWORK")
+	return val
+}
+
+// CaseMapping returns the casemapping used by the server.
+func (f *ISupport) CaseMapping() string {
+	return strings.ToLower(f.value("CASEMAPPING"))
+}
+
+// ChanTypes returns the characters which may begin a channel name.
+func (f *ISupport) ChanTypes() string {
+	return f.value("CHANTYPES")
+}
+
+// StatusMsg returns the prefixes with which messages may be sent to the
+// members of a channel with a particular status (e.g. "@#chan").
+func (f *ISupport) StatusMsg() string {
+	val, _ := f.Get("STATUSMSG")
+	return val
+}
+
+// Prefix returns the channel modes which grant a status to members of a
+// channel (e.g. "ov") along with the corresponding nick prefixes (e.g.
+// "@+"), in order of decreasing rank.
+func (f *ISupport) Prefix() (modes, prefixes string) {
+	val := f.value("PREFIX")
+	if !strings.HasPrefix(val, "(") {
+		return "", ""
+	}
+	end := strings.IndexByte(val, ')')
+	if end < 0 || end-1 != len(val)-end-1 {
+		val = isupportDefaults["PREFIX"]
+		end = strings.IndexByte(val, ')')
+	}
+	return val[1:end], val[end+1:]
+}
+
+// ChanModes returns the channel modes in each of the four CHANMODES classes:
+// list modes (e.g. bans), modes which always take a parameter, modes which
+// take a parameter only when set, and flags which never take one.
+func (f *ISupport) ChanModes() (list, always, set, flag string) {
+	fields := strings.SplitN(f.value("CHANMODES"), ",", 4)
+	for len(fields) < 4 {
+		fields = append(fields, "")
+	}
+	return fields[0], fields[1], fields[2], fields[3]
+}
+
+// intval returns the integer value of the given token, or def if it is
+// missing or invalid.
+func (f *ISupport) intval(key string, def int) int {
+	n, err := strconv.Atoi(f.value(key))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// NickLen returns the maximum length of a nickname.
+func (f *ISupport) NickLen() int {
+	return f.intval("NICKLEN", 9)
+}
+
+// ChannelLen returns the maximum length of a channel name, or 0 if there is
+// no known limit.
+func (f *ISupport) ChannelLen() int {
+	return f.intval("CHANNELLEN", 0)
+}
+
+// TargMax returns the maximum number of targets which may be given to the
+// command.  If the server did not advertise a limit, ok is false.
+func (f *ISupport) TargMax(cmd string) (max int, ok bool) {
+	val, _ := f.Get("TARGMAX")
+	for _, pair := range strings.Split(val, ",") {
+		name, limit := splitCap(strings.Replace(pair, ":", "=", 1))
+		if !strings.EqualFold(name, cmd) {
+			continue
+		}
+		if limit == "" {
+			return 0, false
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// IsChannel returns true if the given target names a channel.  Targets with
+// a STATUSMSG prefix (e.g. "@#chan") are considered channels.
+func (f *ISupport) IsChannel(target string) bool {
+	types := f.ChanTypes()
+	if len(target) > 0 && strings.IndexByte(types, target[0]) < 0 {
+		target = strings.TrimLeft(target, f.StatusMsg())
+	}
+	return len(target) > 0 && strings.IndexByte(types, target[0]) >= 0
+}
+
+// ToLower returns the casefolded version of the string according to the
+// server's casemapping.  Use it to compare nicks and channel names.
+func (f *ISupport) ToLower(str string) string {
+	return toLower(str, f.CaseMapping())
+}
+
+// EqualFold compares two nicks or channel names using the server's
+// casemapping.
+func (f *ISupport) EqualFold(a, b string) bool {
+	return f.ToLower(a) == f.ToLower(b)
+}
+
+// ValidNick returns true if the nick is valid and not too long.
+func (f *ISupport) ValidNick(nick string) bool {
+	return ValidNick(nick) && len(nick) <= f.NickLen()
+}
+
+// ValidChannel returns true if the channel name is valid, begins with one of
+// the server's channel types, and is not too long.
+func (f *ISupport) ValidChannel(name string) bool {
+	if max := f.ChannelLen(); max > 0 && len(name) > max {
+		return false
+	}
+	return validChannel(name, f.ChanTypes())
+}
+
+// Features returns the features supported by the server.
+func (s *Server) Features() *ISupport { return s.isupport }
+
+// IsChannel returns true if the target names a channel on this server.
+func (s *Server) IsChannel(target string) bool { return s.isupport.IsChannel(target) }
+
+// ToLower casefolds the string using this server's casemapping.
+func (s *Server) ToLower(str string) string { return s.isupport.ToLower(str) }
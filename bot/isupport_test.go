@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestISupport(t *testing.T) {
+	f := new(ISupport)
+
+	// Defaults
+	if got, want := f.CaseMapping(), CASEMAP_RFC1459; got != want {
+		t.Errorf("default casemapping = %q, want %q", got, want)
+	}
+	if !f.IsChannel("&local") || f.IsChannel("+modeless") {
+		t.Errorf("default channel types = %q", f.ChanTypes())
+	}
+
+	f.parse(ParseMessage(":serv 005 n CHANTYPES=#+ PREFIX=(qaohv)~&@%+ CASEMAPPING=ascii NICKLEN=16 " +
+		"CHANMODES=beI,k,l,imnpst TARGMAX=PRIVMSG:4,NOTICE:4,JOIN: NETWORK=Example\\x20Net STATUSMSG=@+ " +
+		"EXCEPTS :are supported by this server").Args)
+	f.parse(ParseMessage(":serv 005 n -EXCEPTS CHANNELLEN=10 :are supported by this server").Args)
+
+	if got, want := f.Network(), "Example Net"; got != want {
+		t.Errorf("network = %q, want %q", got, want)
+	}
+	if got, want := f.NickLen(), 16; got != want {
+		t.Errorf("nicklen = %d, want %d", got, want)
+	}
+	if modes, prefixes := f.Prefix(); modes != "qaohv" || prefixes != "~&@%+" {
+		t.Errorf("prefix = %q %q, want %q %q", modes, prefixes, "qaohv", "~&@%+")
+	}
+	if list, always, set, flag := f.ChanModes(); list != "beI" || always != "k" || set != "l" || flag != "imnpst" {
+		t.Errorf("chanmodes = %q %q %q %q", list, always, set, flag)
+	}
+	if max, ok := f.TargMax("privmsg"); max != 4 || !ok {
+		t.Errorf("targmax(privmsg) = %d, %v, want 4, true", max, ok)
+	}
+	if _, ok := f.TargMax("JOIN"); ok {
+		t.Errorf("targmax(JOIN) is limited, want unlimited")
+	}
+	if _, ok := f.Get("EXCEPTS"); ok {
+		t.Errorf("EXCEPTS was not removed")
+	}
+
+	channels := []struct {
+		Target  string
+		Channel bool
+		Valid   bool
+	}{
+		{"#chan", true, true},
+		{"+chan", true, true},
+		{"@#chan", true, false},
+		{"&chan", false, false},
+		{"nick", false, false},
+		{"#waytoolongname", true, false},
+		{"", false, false},
+	}
+	for _, test := range channels {
+		if got, want := f.IsChannel(test.Target), test.Channel; got != want {
+			t.Errorf("IsChannel(%q) = %v, want %v", test.Target, got, want)
+		}
+		if got, want := f.ValidChannel(test.Target), test.Valid; got != want {
+			t.Errorf("ValidChannel(%q) = %v, want %v", test.Target, got, want)
+		}
+	}
+
+	if !f.ValidNick("sixteen_chars_ok") || f.ValidNick("seventeen_chars_x") {
+		t.Errorf("nick length not enforced")
+	}
+	if f.EqualFold("nick[a]", "NICK{A}") {
+		t.Errorf("ascii casemapping folded brackets")
+	}
+}
+
+func TestToLower(t *testing.T) {
+	tests := []struct {
+		In, Casemap, Out string
+	}{
+		{"Nick[]\\~^", CASEMAP_RFC1459, "nick{}|~~"},
+		{"Nick[]\\~^", CASEMAP_STRICT, "nick{}|~^"},
+		{"Nick[]\\~^", CASEMAP_ASCII, "nick[]\\~^"},
+	}
+
+	for _, test := range tests {
+		if got, want := toLower(test.In, test.Casemap), test.Out; got != want {
+			t.Errorf("toLower(%q, %q) = %q, want %q", test.In, test.Casemap, got, want)
+		}
+	}
+	if got, want := ToLower("Nick^"), "nick~"; got != want {
+		t.Errorf("ToLower = %q, want %q", got, want)
+	}
+}
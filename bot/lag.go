@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"time"
+)
+
+// Lag measurement defaults.
+const (
+	// DefaultLagThreshold is the lag above which ON_LAG reports the server
+	// as lagging.
+	DefaultLagThreshold = 5 * time.Second
+
+	// LagHistorySize is the number of round trip times kept for
+	// Server.LagHistory.
+	LagHistorySize = 10
+)
+
+// The prefix of the tokens sent by pingloop, which tells its PONGs apart
+// from those to other PINGs.
+const pingPrefix = "blight-bot-"
+
+// SetLagThreshold sets the lag above which a server is reported as lagging
+// by ON_LAG.  A threshold of zero disables ON_LAG.
+func (b *Bot) SetLagThreshold(threshold time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.lagLimit = threshold
+}
+
+// lagThreshold returns the lag threshold.
+func (b *Bot) lagThreshold() time.Duration {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.lagLimit
+}
+
+// Lag returns the round trip time of the last PING to the server, or how
+// long the current PING has been waiting for a reply if that is longer.
+func (s *Server) Lag() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.currentLag()
+}
+
+// currentLag returns the lag.  The server lock must be held.
+func (s *Server) currentLag() time.Duration {
+	if !s.pingAt.IsZero() {
+		if waiting := s.clock.Now().Sub(s.pingAt); waiting > s.lag {
+			return waiting
+		}
+	}
+	return s.lag
+}
+
+// LagHistory returns the round trip times of recent PINGs to the server,
+// oldest first.
+func (s *Server) LagHistory() []time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]time.Duration(nil), s.lags...)
+}
+
+// Lagging returns true if the server's lag is above the lag threshold.
+func (s *Server) Lagging() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lagging
+}
+
+// pinged records that a PING was sent.
+func (s *Server) pinged(at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pingAt = at
+}
+
+// ponged records the round trip time of a PING.
+func (s *Server) ponged(rtt time.Duration) {
+	s.lock.Lock()
+	s.pingAt = time.Time{}
+	s.lag = rtt
+	s.lags = append(s.lags, rtt)
+	if len(s.lags) > LagHistorySize {
+		s.lags = s.lags[len(s.lags)-LagHistorySize:]
+	}
+	s.lock.Unlock()
+
+	if s.bot.LogLevel > 5 {
+		s.Log("lag: %s", rtt)
+	}
+	s.checkLag()
+}
+
+// checkLag triggers ON_LAG if the server has started or stopped lagging.
+func (s *Server) checkLag() {
+	threshold := s.bot.lagThreshold()
+
+	s.lock.Lock()
+	lagging := threshold > 0 && s.currentLag() > threshold
+	changed := lagging != s.lagging
+	s.lagging = lagging
+	s.lock.Unlock()
+
+	if changed {
+		s.Log("lagging: %v (%s)", lagging, s.Lag())
+		s.post(ON_LAG, nil)
+	}
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLag(t *testing.T) {
+	b := New("n", "u")
+	b.SetPing(10*time.Millisecond, 5*time.Second)
+	b.SetLagThreshold(50 * time.Millisecond)
+
+	lagging := make(chan bool, 2)
+	b.OnEvent(ON_LAG, func(e string, s *Server, m *Message) {
+		lagging <- s.Lagging()
+	}).Sync()
+
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Send(":serv 001 n :Welcome")
+
+	// Other PONGs don't count as replies
+	c.expectLine("PING :blight-bot-1")
+	c.Send(":serv PONG serv :other")
+	c.Send(":serv PONG serv :blight-bot-1")
+
+	// A slow reply makes the server lag, until it is answered
+	c.expectLine("PING :blight-bot-2")
+	select {
+	case got := <-lagging:
+		if !got {
+			t.Errorf("first ON_LAG: Lagging() = false, want true")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("no ON_LAG while waiting for PONG")
+	}
+	if lag := c.serv.Lag(); lag < 50*time.Millisecond {
+		t.Errorf("Lag() = %s while lagging, want at least 50ms", lag)
+	}
+	c.Send(":serv PONG serv :blight-bot-2")
+	c.expectLine("PING :blight-bot-3")
+	c.Send(":serv PONG serv :blight-bot-3")
+	select {
+	case got := <-lagging:
+		if got {
+			t.Errorf("second ON_LAG: Lagging() = true, want false")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("no ON_LAG after recovering")
+	}
+
+	if got := len(c.serv.LagHistory()); got != 3 {
+		t.Errorf("len(LagHistory()) = %d, want 3", got)
+	}
+}
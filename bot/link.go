@@ -0,0 +1,1040 @@
+package bot
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The version of TS6 spoken by server links, and the capabilities they
+// announce in CAPAB.
+const (
+	TS6_VERSION = "6"
+	TS6_CAPAB   = "QS EX IE KLN UNKLN ENCAP TB EUID"
+)
+
+// The features of a TS6 (charybdis) network, which are not sent to servers
+// in RPL_ISUPPORT.
+var linkISupport = []string{
+	"CHANTYPES=#&",
+	"PREFIX=(ov)@+",
+	"CHANMODES=eIbq,k,flj,CFLMPQScgimnprstz",
+	"CASEMAPPING=" + CASEMAP_RFC1459,
+	"NICKLEN=31",
+}
+
+// The maximum length of the member list in an RPL_NAMREPLY.
+const linkNamesLen = 400
+
+// A Link configures a server-to-server connection, with which the bot joins
+// a TS6 network (ircd-blight, charybdis, ratbox, etc) as a server of its
+// own.  The bot's nick and user name become a pseudo-client of that server,
+// and the messages which pass over the link are translated to and from
+// their client forms, so handlers see (and write) the same messages as they
+// would over a client connection.  See NetState for the rest of the
+// network.
+type Link struct {
+	Name        string // our server name, e.g. "services.example.net"
+	SID         string // our server ID, e.g. "0SV"
+	Password    string // sent to the peer
+	Accept      string // expected from the peer, if not Password
+	Description string // shown in LINKS and WHOIS
+
+	Host      string // of the pseudo-clients (default Name)
+	UserModes string // of the pseudo-clients (default "+i")
+}
+
+// check returns an error if the link is not usable.
+func (l *Link) check() error {
+	switch {
+	case !ValidServerName(l.Name):
+		return errors.New("bot: invalid link server name")
+	case !ValidServerPrefix(l.SID):
+		return errors.New("bot: invalid link server ID")
+	case l.Password == "":
+		return errors.New("bot: link has no password")
+	}
+	return nil
+}
+
+// ConnectLink connects to a TS6 server as the server described by the link.
+// The connection uses TLS if tlsOpts is non-nil.
+func (b *Bot) ConnectLink(addr string, link *Link, tlsOpts *TLSOptions) error {
+	if err := link.check(); err != nil {
+		return err
+	}
+	conn, err := b.dial(addr, nil, tlsOpts)
+	if err != nil {
+		return err
+	}
+	s := b.initServer(addr, "", conn)
+	s.link = newLink(s, link)
+	s.start()
+	return nil
+}
+
+// Introduce adds a pseudo-client to a server linked with ConnectLink, and
+// returns its UID.  Messages written with its nick as their prefix are sent
+// from it.
+func (s *Server) Introduce(nick, user, real string) (string, error) {
+	if s.link == nil {
+		return "", errors.New("bot: not a server link")
+	}
+	return s.link.introduce(nick, user, real)
+}
+
+// A linkState translates the messages which pass over a server link.  Its
+// fields, and the network's state, are protected by the network's lock,
+// except for those protected by plock, which is taken while writing.
+type linkState struct {
+	serv *Server
+	conf Link
+	net  *NetState
+	echo chan *Message // client forms of the messages we send, for manage
+
+	peer    string // the uplink's SID, set with plock held too
+	me      string // the bot's UID
+	next    int    // the number of UIDs we have assigned
+	bursted bool   // we have sent our burst
+	synced  bool   // the peer has sent its burst
+
+	plock sync.Mutex
+	pings []string // tokens of unanswered PINGs, in the order sent
+}
+
+// newLink returns the state of a new link for the server, with the bot as
+// its first pseudo-client.
+func newLink(s *Server, conf *Link) *linkState {
+	l := &linkState{
+		serv: s,
+		conf: *conf,
+		net:  newNetState(s.isupport),
+		echo: make(chan *Message, 64),
+	}
+	if l.conf.Host == "" {
+		l.conf.Host = l.conf.Name
+	}
+	if l.conf.UserModes == "" {
+		l.conf.UserModes = "+i"
+	}
+	if l.conf.Accept == "" {
+		l.conf.Accept = l.conf.Password
+	}
+	if l.conf.Description == "" {
+		l.conf.Description = "github.com/kylelemons/blightbot " + VERSION
+	}
+	s.isupport.parse(append(append([]string{s.id.Nick}, linkISupport...), "are assumed"))
+
+	l.net.addServer(&NetServer{SID: l.conf.SID, Name: l.conf.Name, Description: l.conf.Description})
+	u := l.addClient(s.id.Nick, s.id.User, "github.com/kylelemons/blightbot "+VERSION)
+	l.me = u.UID
+	return l
+}
+
+// now returns the current time as a TS.
+func (l *linkState) now() int64 {
+	return l.serv.clock.Now().Unix()
+}
+
+// addClient adds a pseudo-client.  The lock must be held (or the link not
+// yet started).
+func (l *linkState) addClient(nick, user, real string) *NetUser {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	id := make([]byte, 6)
+	for i, n := len(id)-1, l.next; i >= 0; i, n = i-1, n/len(letters) {
+		id[i] = letters[n%len(letters)]
+	}
+	l.next++
+
+	u := &NetUser{
+		UID:      l.conf.SID + string(id),
+		Nick:     nick,
+		User:     user,
+		Host:     l.conf.Host,
+		IP:       "0",
+		Realname: real,
+		Server:   l.conf.SID,
+		TS:       l.now(),
+	}
+	applyUserModes(u, l.conf.UserModes)
+	l.net.addUser(u)
+	return u
+}
+
+func (l *linkState) introduce(nick, user, real string) (string, error) {
+	l.net.lock.Lock()
+	defer l.net.lock.Unlock()
+
+	if !l.serv.isupport.ValidNick(nick) {
+		return "", errors.New("bot: invalid nick " + strconv.Quote(nick))
+	}
+	if l.net.nick(nick) != nil {
+		return "", errors.New("bot: nick " + strconv.Quote(nick) + " is in use")
+	}
+	u := l.addClient(nick, user, real)
+	if l.bursted {
+		l.send(l.euid(u))
+	}
+	return u.UID, nil
+}
+
+// ours returns true if the user is one of our pseudo-clients.
+func (l *linkState) ours(u *NetUser) bool {
+	return u.Server == l.conf.SID
+}
+
+// client returns the pseudo-client with the nick, or the bot's if nick is
+// empty.
+func (l *linkState) client(nick string) *NetUser {
+	if nick == "" {
+		return l.net.users[l.me]
+	}
+	if u := l.net.nick(nick); u != nil && l.ours(u) {
+		return u
+	}
+	return nil
+}
+
+// in returns true if the bot is in the channel.
+func (l *linkState) in(ch *NetChannel) bool {
+	_, ok := ch.Members[l.me]
+	return ok
+}
+
+// mask returns the client form of a user's prefix.
+func mask(u *NetUser) string {
+	return u.ID().String()
+}
+
+// source returns the client form of a TS6 prefix.
+func (l *linkState) source(pfx string) string {
+	if u := l.net.users[pfx]; u != nil {
+		return mask(u)
+	}
+	if srv := l.net.servers[pfx]; srv != nil {
+		return srv.Name
+	}
+	return pfx
+}
+
+// peerName returns the name of the uplink.
+func (l *linkState) peerName() string {
+	if srv := l.net.servers[l.peer]; srv != nil {
+		return srv.Name
+	}
+	return l.serv.name
+}
+
+// isMe returns true if the name or SID is our own.
+func (l *linkState) isMe(target string) bool {
+	return target == l.conf.SID || strings.EqualFold(target, l.conf.Name)
+}
+
+// send writes a TS6 message immediately.
+func (l *linkState) send(m *Message) {
+	if l.serv.bot.LogLevel > 3 {
+		log.Printf("<< %s", l.serv.bot.redact(m))
+	}
+	l.serv.queueLines(PriorityImmediate, m, m.Bytes())
+}
+
+// euid returns the message introducing a pseudo-client.
+func (l *linkState) euid(u *NetUser) *Message {
+	// :sid EUID nick hops ts umodes user host ip uid realhost account :gecos
+	return NewMessage(l.conf.SID, CMD_EUID, u.Nick, "1", strconv.FormatInt(u.TS, 10),
+		u.Modes, u.User, u.Host, u.IP, u.UID, "*", "*", u.Realname)
+}
+
+// handshake sends our half of the link registration.
+func (l *linkState) handshake() {
+	c := l.conf
+	l.send(NewMessage("", CMD_PASS, c.Password, "TS", TS6_VERSION, c.SID))
+	l.send(NewMessage("", CMD_CAPAB, TS6_CAPAB))
+	l.send(NewMessage("", CMD_SERVER, c.Name, "1", c.Description))
+	l.send(NewMessage("", CMD_SVINFO, TS6_VERSION, TS6_VERSION, "0", strconv.FormatInt(l.now(), 10)))
+}
+
+// burst introduces our pseudo-clients, and marks the end of the burst with
+// a PING.  The lock must be held.
+func (l *linkState) burst() {
+	var clients []*NetUser
+	for _, u := range l.net.users {
+		if l.ours(u) {
+			clients = append(clients, u)
+		}
+	}
+	sort.Sort(netUserPtrSorter(clients))
+	for _, u := range clients {
+		l.send(l.euid(u))
+	}
+	l.bursted = true
+
+	// The empty token marks the end of the burst, and has no client PONG
+	l.send(NewMessage("", CMD_PING, ""))
+}
+
+// ping returns the TS6 form of a line, which differs only for the client
+// PINGs written by pingloop, Send and burst.  TS6 servers reply with our SID
+// rather than the token, so the tokens are kept in the order the PINGs are
+// written (ping is called by writeRaw) until their PONGs arrive.
+func (l *linkState) ping(line []byte) []byte {
+	if !bytes.HasPrefix(line, []byte(CMD_PING+" ")) {
+		return line
+	}
+	m := ParseMessage(strings.TrimRight(string(line), "\r\n"))
+	if m == nil || len(m.Args) != 1 {
+		return line
+	}
+	l.plock.Lock()
+	defer l.plock.Unlock()
+	l.pings = append(l.pings, m.Args[0])
+	return NewMessage(l.conf.SID, CMD_PING, l.conf.Name, l.peer).Bytes()
+}
+
+// fail returns an ERROR which closes the link.
+func (l *linkState) fail(reason string) []*Message {
+	l.send(NewMessage("", CMD_ERROR, "Closing Link: "+reason))
+	return []*Message{NewMessage("", CMD_ERROR, reason)}
+}
+
+// quit removes a user, and returns the QUIT for which ON_NETQUIT occurs.
+// visible is true if the bot shared a channel with the user.
+func (l *linkState) quit(u *NetUser, reason string) (quit *Message, visible bool) {
+	for _, ch := range l.net.chans {
+		if _, ok := ch.Members[u.UID]; ok && l.in(ch) {
+			visible = true
+		}
+	}
+	l.net.delUser(u)
+	return NewMessage(mask(u), CMD_QUIT, reason), visible
+}
+
+// reintroduce restores a pseudo-client which has been killed.
+func (l *linkState) reintroduce(u *NetUser) {
+	l.send(l.euid(u))
+	for _, name := range l.net.userChannels(u.UID) {
+		ch := l.net.getChannel(name)
+		l.send(NewMessage(l.conf.SID, CMD_SJOIN, strconv.FormatInt(ch.TS, 10), ch.Name, "+", ch.Members[u.UID]+u.UID))
+	}
+}
+
+// prefixModes returns the channel modes for the SJOIN prefixes.
+func prefixModes(prefix string) string {
+	return strings.NewReplacer("@", "o", "+", "v").Replace(prefix)
+}
+
+// setPrefix adds or removes the prefix of a PREFIX mode from a member.
+func setPrefix(prefix string, add bool, mode byte) string {
+	p := map[byte]string{'o': "@", 'v': "+"}[mode]
+	prefix = strings.Replace(prefix, p, "", -1)
+	if add {
+		prefix = strings.Replace(p+prefix, "+@", "@+", 1)
+	}
+	return prefix
+}
+
+// formatModes is the reverse of ParseModes.
+func formatModes(changes []ModeChange) []string {
+	var modes []byte
+	var params []string
+	add := byte(0)
+	for _, c := range changes {
+		sign := byte('-')
+		if c.Add {
+			sign = '+'
+		}
+		if sign != add {
+			modes, add = append(modes, sign), sign
+		}
+		modes = append(modes, c.Mode)
+		if c.Param != "" {
+			params = append(params, c.Param)
+		}
+	}
+	return append([]string{string(modes)}, params...)
+}
+
+// names returns the RPL_NAMREPLY and RPL_ENDOFNAMES for a channel.
+func (l *linkState) names(ch *NetChannel) []*Message {
+	var names []string
+	for uid, prefix := range ch.Members {
+		if u := l.net.users[uid]; u != nil {
+			names = append(names, prefix+u.Nick)
+		}
+	}
+	sort.Strings(names)
+
+	var out []*Message
+	srv, nick := l.peerName(), l.net.users[l.me].Nick
+	for len(names) > 0 {
+		n, size := 0, 0
+		for n < len(names) && (n == 0 || size+len(names[n]) < linkNamesLen) {
+			size += len(names[n]) + 1
+			n++
+		}
+		out = append(out, NewMessage(srv, RPL_NAMREPLY, nick, "=", ch.Name, strings.Join(names[:n], " ")))
+		names = names[n:]
+	}
+	return append(out, NewMessage(srv, RPL_ENDOFNAMES, nick, ch.Name, "End of /NAMES list."))
+}
+
+// topic returns the RPL_TOPIC and RPL_TOPICWHOTIME for a channel.
+func (l *linkState) topic(ch *NetChannel) []*Message {
+	if ch.Topic == "" {
+		return nil
+	}
+	srv, nick := l.peerName(), l.net.users[l.me].Nick
+	return []*Message{
+		NewMessage(srv, RPL_TOPIC, nick, ch.Name, ch.Topic),
+		NewMessage(srv, RPL_TOPICWHOTIME, nick, ch.Name, ch.TopicSetter, strconv.FormatInt(ch.TopicTS, 10)),
+	}
+}
+
+// Commands from the uplink whose client forms replace them.  Others are
+// also passed to handlers as they are, so that they may use them directly.
+var linkTranslated = map[string]bool{
+	CMD_PASS:    true,
+	CMD_JOIN:    true,
+	CMD_PART:    true,
+	CMD_KICK:    true,
+	CMD_NICK:    true,
+	CMD_QUIT:    true,
+	CMD_TOPIC:   true,
+	CMD_PRIVMSG: true,
+	CMD_NOTICE:  true,
+	CMD_PING:    true,
+	CMD_PONG:    true,
+	CMD_WHOIS:   true,
+	CMD_ERROR:   true,
+}
+
+// incoming returns the client forms of a message from the uplink, and the
+// network events it causes, updating the state of the network and replying
+// to the uplink as necessary.
+func (l *linkState) incoming(m *Message) (out []*Message, events []inbound) {
+	l.net.lock.Lock()
+	defer l.net.lock.Unlock()
+
+	src := l.source(m.Prefix)
+	emit := func(cmd string, args ...string) {
+		out = append(out, &Message{Tags: m.Tags, Prefix: src, Command: cmd, Args: args})
+	}
+	event := func(event string, msg *Message) {
+		events = append(events, inbound{event, msg})
+	}
+	quit := func(u *NetUser, reason string) {
+		msg, visible := l.quit(u, reason)
+		if visible {
+			out = append(out, msg)
+		}
+		event(ON_NETQUIT, msg)
+	}
+	a := m.Args
+	if len(m.Command) == 3 && m.Command[0] >= '0' && m.Command[0] <= '9' {
+		// :sid 401 uid target :No such nick/channel
+		if len(a) > 0 {
+			if u := l.net.users[a[0]]; u != nil {
+				a = append([]string{u.Nick}, a[1:]...)
+			}
+		}
+		emit(m.Command, a...)
+		return out, nil
+	}
+	if !linkTranslated[m.Command] {
+		defer func() { out = append(out, m) }()
+	}
+
+	switch m.Command {
+	case CMD_PASS:
+		// PASS password TS 6 :sid
+		if len(a) < 4 || a[1] != "TS" || !ValidServerPrefix(a[3]) {
+			return l.fail("not a TS6 link"), nil
+		}
+		if a[0] != l.conf.Accept {
+			return l.fail("bad password"), nil
+		}
+		l.plock.Lock()
+		l.peer = a[3]
+		l.plock.Unlock()
+	case CMD_SERVER:
+		// SERVER name hops :description
+		if l.peer == "" || len(a) < 3 {
+			return l.fail("SERVER before PASS"), nil
+		}
+		hops, _ := strconv.Atoi(a[1])
+		l.net.addServer(&NetServer{SID: l.peer, Name: a[0], Description: a[2], Hops: hops, Uplink: l.conf.SID})
+		event(ON_NETSERVER, m)
+		l.burst()
+	case CMD_SID:
+		// :uplink SID name hops sid :description
+		if len(a) < 4 {
+			break
+		}
+		hops, _ := strconv.Atoi(a[1])
+		l.net.addServer(&NetServer{SID: a[2], Name: a[0], Description: a[3], Hops: hops, Uplink: m.Prefix})
+		event(ON_NETSERVER, m)
+	case CMD_SQUIT:
+		// [:src] SQUIT sid :reason
+		if len(a) < 1 || l.isMe(a[0]) {
+			break
+		}
+		sid := a[0]
+		if srv := l.net.serverByName(a[0]); srv != nil {
+			sid = srv.SID
+		}
+		if _, ok := l.net.servers[sid]; !ok {
+			break
+		}
+		for _, u := range l.net.split(sid) {
+			quit(u, "*.net *.split")
+		}
+		event(ON_NETSPLIT, m)
+	case CMD_UID, CMD_EUID:
+		// :sid EUID nick hops ts umodes user host ip uid realhost account :gecos
+		// :sid UID nick hops ts umodes user host ip uid :gecos
+		if len(a) < 9 {
+			break
+		}
+		ts, _ := strconv.ParseInt(a[2], 10, 64)
+		u := &NetUser{
+			UID:      a[7],
+			Nick:     a[0],
+			User:     a[4],
+			Host:     a[5],
+			IP:       a[6],
+			Realname: a[len(a)-1],
+			Server:   m.Prefix,
+			TS:       ts,
+		}
+		applyUserModes(u, a[3])
+		if m.Command == CMD_EUID && len(a) > 10 && a[9] != "*" {
+			u.Account = a[9]
+		}
+		if old := l.client(u.Nick); old != nil {
+			log.Printf("[%s] link: %s (%s) collides with our %s", l.serv.name, u.Nick, u.UID, old.UID)
+		}
+		l.net.addUser(u)
+		event(ON_NETUSER, m)
+	case CMD_NICK:
+		// :uid NICK nick ts
+		u := l.net.users[m.Prefix]
+		if u == nil || len(a) < 1 {
+			break
+		}
+		for _, ch := range l.net.chans {
+			if _, ok := ch.Members[u.UID]; ok && l.in(ch) {
+				emit(CMD_NICK, a[0])
+				break
+			}
+		}
+		l.net.rename(u, a[0])
+		if len(a) > 1 {
+			u.TS, _ = strconv.ParseInt(a[1], 10, 64)
+		}
+	case CMD_MODE:
+		// :uid MODE uid :+modes
+		if u := l.net.users[m.Prefix]; u != nil && len(a) > 1 && a[0] == u.UID {
+			applyUserModes(u, a[1])
+		}
+	case CMD_ENCAP:
+		// :uid ENCAP * LOGIN account
+		// :sid ENCAP * SU uid [account]
+		// :src ENCAP * CHGHOST uid host
+		if len(a) < 3 {
+			break
+		}
+		switch a[1] {
+		case "LOGIN":
+			if u := l.net.users[m.Prefix]; u != nil {
+				u.Account = a[2]
+			}
+		case "SU":
+			if u := l.net.users[a[2]]; u != nil {
+				u.Account = ""
+				if len(a) > 3 {
+					u.Account = a[3]
+				}
+			}
+		case "CHGHOST":
+			if u := l.net.users[a[2]]; u != nil && len(a) > 3 {
+				u.Host = a[3]
+			}
+		}
+	case CMD_CHGHOST:
+		// :src CHGHOST uid host
+		if len(a) < 2 {
+			break
+		}
+		if u := l.net.users[a[0]]; u != nil {
+			u.Host = a[1]
+		}
+	case CMD_QUIT:
+		// :uid QUIT :reason
+		if u := l.net.users[m.Prefix]; u != nil {
+			reason := ""
+			if len(a) > 0 {
+				reason = a[0]
+			}
+			quit(u, reason)
+		}
+	case CMD_KILL:
+		// :src KILL uid :path (reason)
+		if len(a) < 1 {
+			break
+		}
+		u := l.net.users[a[0]]
+		if u == nil {
+			break
+		}
+		if l.ours(u) {
+			l.serv.Log("link: %s killed by %s", u.Nick, src)
+			l.reintroduce(u)
+			break
+		}
+		quit(u, "Killed")
+	case CMD_SJOIN:
+		// :sid SJOIN ts #chan +modes [params...] :[@][+]uid...
+		if len(a) < 4 {
+			break
+		}
+		ts, _ := strconv.ParseInt(a[0], 10, 64)
+		ch := l.net.channel(a[1], ts)
+		keep := true
+		if ts < ch.TS {
+			l.net.lowerTS(ch, ts)
+		} else if ts > ch.TS {
+			// The older channel's modes and statuses win
+			keep = false
+		}
+		if keep {
+			l.net.applyModes(ch, ParseModes(l.serv.isupport, a[2], a[3:len(a)-1]))
+		}
+		for _, tok := range strings.Fields(a[len(a)-1]) {
+			uid := strings.TrimLeft(tok, "@+")
+			prefix := tok[:len(tok)-len(uid)]
+			u := l.net.users[uid]
+			if u == nil {
+				continue
+			}
+			if !keep {
+				prefix = ""
+			}
+			ch.Members[uid] = prefix
+			if !l.in(ch) {
+				continue
+			}
+			out = append(out, NewMessage(mask(u), CMD_JOIN, ch.Name))
+			if modes := prefixModes(prefix); modes != "" {
+				args := []string{ch.Name, "+" + modes}
+				for range modes {
+					args = append(args, u.Nick)
+				}
+				emit(CMD_MODE, args...)
+			}
+		}
+	case CMD_JOIN:
+		// :uid JOIN ts #chan +
+		// :uid JOIN 0
+		u := l.net.users[m.Prefix]
+		if u == nil || len(a) < 1 {
+			break
+		}
+		if a[0] == "0" {
+			for _, name := range l.net.userChannels(u.UID) {
+				ch := l.net.getChannel(name)
+				if l.in(ch) {
+					emit(CMD_PART, ch.Name)
+				}
+				l.net.part(ch, u.UID)
+			}
+			break
+		}
+		if len(a) < 2 {
+			break
+		}
+		ts, _ := strconv.ParseInt(a[0], 10, 64)
+		ch := l.net.channel(a[1], ts)
+		if ts < ch.TS {
+			l.net.lowerTS(ch, ts)
+		}
+		ch.Members[u.UID] = ""
+		if l.in(ch) {
+			emit(CMD_JOIN, ch.Name)
+		}
+	case CMD_PART:
+		// :uid PART #chan[,#chan...] [:reason]
+		u := l.net.users[m.Prefix]
+		if u == nil || len(a) < 1 {
+			break
+		}
+		for _, name := range strings.Split(a[0], ",") {
+			ch := l.net.getChannel(name)
+			if ch == nil {
+				continue
+			}
+			if l.in(ch) {
+				emit(CMD_PART, append([]string{ch.Name}, a[1:]...)...)
+			}
+			l.net.part(ch, u.UID)
+		}
+	case CMD_KICK:
+		// :src KICK #chan uid :reason
+		if len(a) < 2 {
+			break
+		}
+		ch, u := l.net.getChannel(a[0]), l.net.users[a[1]]
+		if ch == nil || u == nil {
+			break
+		}
+		if l.in(ch) {
+			emit(CMD_KICK, append([]string{ch.Name, u.Nick}, a[2:]...)...)
+		}
+		l.net.part(ch, u.UID)
+	case CMD_TMODE:
+		// :src TMODE ts #chan +modes [params...]
+		if len(a) < 3 {
+			break
+		}
+		ts, _ := strconv.ParseInt(a[0], 10, 64)
+		ch := l.net.getChannel(a[1])
+		if ch == nil || ts > ch.TS {
+			break
+		}
+		changes := ParseModes(l.serv.isupport, a[2], a[3:])
+		l.net.applyModes(ch, changes)
+		for i, c := range changes {
+			if c.Mode != 'o' && c.Mode != 'v' {
+				continue
+			}
+			if u := l.net.users[c.Param]; u != nil {
+				changes[i].Param = u.Nick
+			}
+		}
+		if l.in(ch) && len(changes) > 0 {
+			emit(CMD_MODE, append([]string{ch.Name}, formatModes(changes)...)...)
+		}
+	case CMD_BMASK:
+		// :sid BMASK ts #chan type :masks
+		if len(a) < 4 || len(a[2]) != 1 {
+			break
+		}
+		ts, _ := strconv.ParseInt(a[0], 10, 64)
+		ch := l.net.getChannel(a[1])
+		if ch == nil || ts > ch.TS {
+			break
+		}
+		var changes []ModeChange
+		for _, mask := range strings.Fields(a[3]) {
+			changes = append(changes, ModeChange{Add: true, Mode: a[2][0], Param: mask})
+		}
+		l.net.applyModes(ch, changes)
+		if l.in(ch) && len(changes) > 0 {
+			emit(CMD_MODE, append([]string{ch.Name}, formatModes(changes)...)...)
+		}
+	case CMD_TB:
+		// :sid TB #chan ts [setter] :topic
+		if len(a) < 3 {
+			break
+		}
+		ch := l.net.getChannel(a[0])
+		if ch == nil {
+			break
+		}
+		ch.TopicTS, _ = strconv.ParseInt(a[1], 10, 64)
+		ch.Topic, ch.TopicSetter = a[len(a)-1], src
+		if len(a) > 3 {
+			ch.TopicSetter = a[2]
+		}
+		if l.in(ch) {
+			out = append(out, l.topic(ch)...)
+		}
+	case CMD_TOPIC:
+		// :uid TOPIC #chan :topic
+		if len(a) < 2 {
+			break
+		}
+		ch := l.net.getChannel(a[0])
+		if ch == nil {
+			break
+		}
+		ch.Topic, ch.TopicSetter, ch.TopicTS = a[1], src, l.now()
+		if u := l.net.users[m.Prefix]; u != nil {
+			ch.TopicSetter = u.Nick
+		}
+		if l.in(ch) {
+			emit(CMD_TOPIC, ch.Name, a[1])
+		}
+	case CMD_PRIVMSG, CMD_NOTICE:
+		// :src PRIVMSG target :text
+		if len(a) < 2 {
+			break
+		}
+		targets := strings.Split(a[0], ",")
+		for i, target := range targets {
+			if u := l.net.users[target]; u != nil {
+				targets[i] = u.Nick
+			}
+		}
+		emit(m.Command, strings.Join(targets, ","), a[1])
+	case CMD_PING:
+		// [:src] PING origin [dest]
+		if len(a) < 1 || len(a) > 1 && !l.isMe(a[1]) {
+			break
+		}
+		if l.bursted && !l.synced {
+			// The uplink has finished its burst
+			l.synced = true
+			srv := l.peerName()
+			out = append(out, NewMessage(srv, RPL_WELCOME, l.net.users[l.me].Nick,
+				"Welcome to the network, linked to "+srv+" as "+l.conf.Name))
+		}
+		emit(CMD_PING, a[0])
+	case CMD_PONG:
+		// :src PONG origin :dest
+		if len(a) > 0 && l.isMe(a[len(a)-1]) {
+			l.plock.Lock()
+			token, ok := "", len(l.pings) > 0
+			if ok {
+				token, l.pings = l.pings[0], l.pings[1:]
+			}
+			l.plock.Unlock()
+			if token != "" {
+				emit(CMD_PONG, a[0], token)
+			}
+			if ok {
+				break
+			}
+		}
+		emit(CMD_PONG, a...)
+	case CMD_WHOIS:
+		// :uid WHOIS target :nick
+		if len(a) < 2 {
+			break
+		}
+		from := NewMessage(l.conf.SID, "")
+		reply := func(cmd string, args ...string) {
+			from.Command, from.Args = cmd, append([]string{m.Prefix}, args...)
+			l.send(from)
+		}
+		if u := l.client(a[1]); u != nil {
+			reply(RPL_WHOISUSER, u.Nick, u.User, u.Host, "*", u.Realname)
+			reply(RPL_WHOISSERVER, u.Nick, l.conf.Name, l.conf.Description)
+		} else {
+			reply(ERR_NOSUCHNICK, a[1], "No such nick/channel")
+		}
+		reply(RPL_ENDOFWHOIS, a[1], "End of /WHOIS list.")
+	case CMD_ERROR:
+		emit(CMD_ERROR, a...)
+	}
+	return out, events
+}
+
+// outgoing returns the TS6 forms of a message from the bot, updating the
+// state of the network and passing the client forms of any changes to
+// manage.  Client commands with no TS6 form are dropped; other commands are
+// sent as they are.
+func (l *linkState) outgoing(m *Message) (out []*Message) {
+	l.net.lock.Lock()
+	defer l.net.lock.Unlock()
+
+	var echo []*Message
+	defer func() {
+		for _, e := range echo {
+			select {
+			case l.echo <- e:
+			default:
+				l.serv.Log("link: dropped %s", l.serv.bot.redact(e))
+			}
+		}
+	}()
+
+	u := l.client(m.Prefix)
+	if u == nil {
+		l.serv.Log("link: no pseudo-client %q", m.Prefix)
+		return nil
+	}
+	send := func(pfx, cmd string, args ...string) {
+		out = append(out, &Message{Tags: m.Tags, Prefix: pfx, Command: cmd, Args: args})
+	}
+	part := func(names, reason []string) {
+		for _, name := range names {
+			ch := l.net.getChannel(name)
+			if ch == nil {
+				continue
+			}
+			if _, ok := ch.Members[u.UID]; !ok {
+				continue
+			}
+			args := append([]string{ch.Name}, reason...)
+			if l.in(ch) {
+				echo = append(echo, NewMessage(mask(u), CMD_PART, args...))
+			}
+			l.net.part(ch, u.UID)
+			send(u.UID, CMD_PART, args...)
+		}
+	}
+	a := m.Args
+
+	switch m.Command {
+	case CMD_PRIVMSG, CMD_NOTICE:
+		// PRIVMSG target :text -> :uid PRIVMSG target :text
+		if len(a) < 2 {
+			break
+		}
+		targets := strings.Split(a[0], ",")
+		for i, target := range targets {
+			if t := l.net.nick(target); t != nil {
+				targets[i] = t.UID
+			}
+		}
+		send(u.UID, m.Command, strings.Join(targets, ","), a[1])
+	case CMD_JOIN:
+		// JOIN #chan[,#chan...] [keys]
+		// -> :uid JOIN ts #chan +, or :sid SJOIN ts #chan +nt :@uid if new
+		if len(a) < 1 {
+			break
+		}
+		if a[0] == "0" {
+			part(l.net.userChannels(u.UID), nil)
+			break
+		}
+		for _, name := range strings.Split(a[0], ",") {
+			if !l.serv.IsChannel(name) {
+				continue
+			}
+			ch := l.net.getChannel(name)
+			if ch != nil {
+				if _, ok := ch.Members[u.UID]; ok {
+					continue
+				}
+				ch.Members[u.UID] = ""
+				send(u.UID, CMD_JOIN, strconv.FormatInt(ch.TS, 10), ch.Name, "+")
+			} else {
+				ch = l.net.channel(name, l.now())
+				ch.Members[u.UID] = "@"
+				l.net.applyModes(ch, ParseModes(l.serv.isupport, "+nt", nil))
+				send(l.conf.SID, CMD_SJOIN, strconv.FormatInt(ch.TS, 10), ch.Name, "+nt", "@"+u.UID)
+			}
+			if !l.in(ch) {
+				continue
+			}
+			echo = append(echo, NewMessage(mask(u), CMD_JOIN, ch.Name))
+			if u.UID == l.me {
+				echo = append(echo, l.topic(ch)...)
+				echo = append(echo, l.names(ch)...)
+			}
+		}
+	case CMD_PART:
+		// PART #chan[,#chan...] [:reason] -> :uid PART #chan [:reason]
+		if len(a) < 1 {
+			break
+		}
+		part(strings.Split(a[0], ","), a[1:])
+	case CMD_KICK:
+		// KICK #chan nick[,nick...] [:reason] -> :uid KICK #chan uid :reason
+		if len(a) < 2 {
+			break
+		}
+		ch := l.net.getChannel(a[0])
+		if ch == nil {
+			break
+		}
+		for _, nick := range strings.Split(a[1], ",") {
+			victim := l.net.nick(nick)
+			if victim == nil {
+				continue
+			}
+			if _, ok := ch.Members[victim.UID]; !ok {
+				continue
+			}
+			reason := victim.Nick
+			if len(a) > 2 {
+				reason = a[2]
+			}
+			if l.in(ch) {
+				echo = append(echo, NewMessage(mask(u), CMD_KICK, ch.Name, victim.Nick, reason))
+			}
+			l.net.part(ch, victim.UID)
+			send(u.UID, CMD_KICK, ch.Name, victim.UID, reason)
+		}
+	case CMD_MODE:
+		// MODE #chan +modes [params...] -> :uid TMODE ts #chan +modes [params...]
+		// Mode queries and user modes have no TS6 form.
+		if len(a) < 2 || !l.serv.IsChannel(a[0]) {
+			break
+		}
+		ch := l.net.getChannel(a[0])
+		if ch == nil {
+			break
+		}
+		changes := ParseModes(l.serv.isupport, a[1], a[2:])
+		if len(changes) == 0 {
+			break
+		}
+		ids := make([]ModeChange, len(changes))
+		copy(ids, changes)
+		for i, c := range changes {
+			if c.Mode != 'o' && c.Mode != 'v' {
+				continue
+			}
+			if target := l.net.nick(c.Param); target != nil {
+				ids[i].Param = target.UID
+			}
+		}
+		l.net.applyModes(ch, ids)
+		if l.in(ch) {
+			echo = append(echo, NewMessage(mask(u), CMD_MODE, append([]string{ch.Name}, formatModes(changes)...)...))
+		}
+		send(u.UID, CMD_TMODE, append([]string{strconv.FormatInt(ch.TS, 10), ch.Name}, formatModes(ids)...)...)
+	case CMD_TOPIC:
+		// TOPIC #chan :topic -> :uid TOPIC #chan :topic
+		if len(a) < 2 {
+			break
+		}
+		ch := l.net.getChannel(a[0])
+		if ch == nil {
+			break
+		}
+		ch.Topic, ch.TopicSetter, ch.TopicTS = a[1], u.Nick, l.now()
+		if l.in(ch) {
+			echo = append(echo, NewMessage(mask(u), CMD_TOPIC, ch.Name, a[1]))
+		}
+		send(u.UID, CMD_TOPIC, ch.Name, a[1])
+	case CMD_NICK:
+		// NICK nick -> :uid NICK nick ts
+		if len(a) < 1 || !l.serv.isupport.ValidNick(a[0]) {
+			break
+		}
+		if t := l.net.nick(a[0]); t != nil && t != u {
+			l.serv.Log("link: nick %q is in use", a[0])
+			break
+		}
+		echo = append(echo, NewMessage(mask(u), CMD_NICK, a[0]))
+		l.net.rename(u, a[0])
+		u.TS = l.now()
+		send(u.UID, CMD_NICK, u.Nick, strconv.FormatInt(u.TS, 10))
+	case CMD_QUIT:
+		// QUIT [:reason] -> :sid SQUIT sid :reason
+		reason := "Leaving"
+		if len(a) > 0 {
+			reason = a[0]
+		}
+		send(l.conf.SID, CMD_SQUIT, l.conf.SID, reason)
+	case CMD_PONG:
+		// PONG origin -> :sid PONG name :origin
+		if len(a) < 1 {
+			break
+		}
+		send(l.conf.SID, CMD_PONG, l.conf.Name, a[len(a)-1])
+	case CMD_PASS, CMD_USER, CMD_CAP, CMD_AUTHENTICATE, CMD_WHO, CMD_NAMES,
+		CMD_LIST, CMD_ISON, CMD_MONITOR:
+		l.serv.Log("link: dropped %s", l.serv.bot.redact(m))
+	default:
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newLinkConn returns a testConn for a server link, whose other end plays
+// the uplink.
+func newLinkConn(t *testing.T, b *Bot, link *Link) *testConn {
+	conn, local := FakeConn()
+	b.SetFlood(0, 0)
+	s := b.initServer("hub", "", conn)
+	s.link = newLink(s, link)
+	s.start()
+	return startTestConn(t, s, local)
+}
+
+func TestLink(t *testing.T) {
+	b := New("bot", "bot")
+	b.SetClock(NewVirtualClock(time.Unix(1700000000, 0)))
+	b.OnConnect(func(e string, s *Server, m *Message) {
+		s.WriteMessage(NewMessage("", CMD_JOIN, "#chan"))
+	})
+	b.OnEvent(ON_CHANMSG, func(e string, s *Server, m *Message) {
+		s.WriteMessage(NewMessage("", CMD_PRIVMSG, m.Args[0], "echo: "+m.Args[1]))
+	})
+	b.OnEvent(ON_PRIVMSG, func(e string, s *Server, m *Message) {
+		s.WriteMessage(NewMessage("", CMD_NOTICE, m.ID().Nick, "hi "+m.ID().Nick))
+	})
+
+	c := newLinkConn(t, b, &Link{
+		Name:        "bot.example.net",
+		SID:         "0BB",
+		Password:    "secret",
+		Description: "Bot server",
+	})
+	defer c.Close()
+	s := c.serv
+
+	c.expectLine("PASS secret TS 6 0BB")
+	c.expectLine("CAPAB :" + TS6_CAPAB)
+	c.expectLine("SERVER bot.example.net 1 :Bot server")
+	c.expectLine("SVINFO 6 6 0 1700000000")
+
+	c.Send(
+		"PASS secret TS 6 :1HB",
+		"CAPAB :QS EX IE ENCAP TB EUID",
+		"SERVER hub.example.net 1 :Hub",
+	)
+	c.expectLine(":0BB EUID bot 1 1700000000 +i bot bot.example.net 0 0BBAAAAAA * * :github.com/kylelemons/blightbot " + VERSION)
+	c.expectLine(":0BB PING bot.example.net 1HB")
+
+	c.Send(
+		"SVINFO 6 6 0 :1700000000",
+		":1HB EUID alice 1 1699999000 +i alice a.example 127.0.0.1 1HBAAAAAB * * :Alice",
+		":1HB EUID carol 1 1699999001 +i carol c.example 127.0.0.1 1HBAAAAAC * * :Carol",
+		":1HB SJOIN 1600000000 #chan +nt :@1HBAAAAAB 1HBAAAAAC",
+		":1HB TB #chan 1600000100 alice :Welcome to #chan",
+		":1HB PING hub.example.net :0BB",
+		":1HB PONG hub.example.net :0BB",
+	)
+	c.expectLine(":0BB PONG bot.example.net hub.example.net")
+	c.expectLine(":0BBAAAAAA JOIN 1600000000 #chan +")
+	c.Sync()
+
+	ch := s.GetChannel("#chan")
+	if ch == nil {
+		t.Fatalf("not in #chan after joining")
+	}
+	if topic, setter, at := ch.Topic(); topic != "Welcome to #chan" || setter != "alice" || at.Unix() != 1600000100 {
+		t.Errorf("topic = %q, %q, %s", topic, setter, at)
+	}
+	if got, want := len(ch.Members()), 3; got != want {
+		t.Errorf("%d members, want %d: %v", got, want, ch.Members())
+	}
+	if !ch.IsOp("alice") || ch.IsOp("carol") {
+		t.Errorf("ops: alice %v, carol %v; want true, false", ch.IsOp("alice"), ch.IsOp("carol"))
+	}
+
+	// Messages are translated in both directions
+	c.Send(":1HBAAAAAB PRIVMSG #chan :hello")
+	c.expectLine(":0BBAAAAAA PRIVMSG #chan :echo: hello")
+	c.Send(":1HBAAAAAC PRIVMSG 0BBAAAAAA :psst")
+	c.expectLine(":0BBAAAAAA NOTICE 1HBAAAAAC :hi carol")
+
+	c.Send(":1HBAAAAAB TMODE 1600000000 #chan +v 1HBAAAAAC")
+	c.Sync()
+	if !ch.HasMode("carol", 'v') {
+		t.Errorf("carol is not voiced after TMODE")
+	}
+	c.Send(":1HBAAAAAC QUIT :bye")
+	c.Sync()
+	if _, ok := ch.Member("carol"); ok {
+		t.Errorf("carol is still in #chan after QUIT")
+	}
+
+	c.Send(":1HBAAAAAB WHOIS 0BBAAAAAA :bot")
+	c.expectLine(":0BB 311 1HBAAAAAB bot bot bot.example.net * :github.com/kylelemons/blightbot " + VERSION)
+	c.expectLine(":0BB 312 1HBAAAAAB bot bot.example.net :Bot server")
+	c.expectLine(":0BB 318 1HBAAAAAB bot :End of /WHOIS list.")
+
+	// The bot's own changes are seen as they would be over a client
+	// connection
+	s.WriteMessage(NewMessage("", CMD_TOPIC, "#chan", "New topic"))
+	c.expectLine(":0BBAAAAAA TOPIC #chan :New topic")
+	c.Sync()
+	if topic, setter, _ := ch.Topic(); topic != "New topic" || setter != "bot" {
+		t.Errorf("topic = %q, %q; want %q, %q", topic, setter, "New topic", "bot")
+	}
+	s.WriteMessage(NewMessage("", CMD_MODE, "#chan", "+o", "alice"))
+	s.WriteMessage(NewMessage("", CMD_MODE, "#chan", "-o", "alice"))
+	c.expectLine(":0BBAAAAAA TMODE 1600000000 #chan -o 1HBAAAAAB")
+	c.Sync()
+	if ch.IsOp("alice") {
+		t.Errorf("alice is still an op after -o")
+	}
+
+	uid, err := s.Introduce("helper", "helper", "Helper")
+	if err != nil {
+		t.Fatalf("Introduce: %s", err)
+	}
+	if want := "0BBAAAAAB"; uid != want {
+		t.Errorf("Introduce = %q, want %q", uid, want)
+	}
+	c.expectLine(":0BB EUID helper 1 1700000000 +i helper bot.example.net 0 0BBAAAAAB * * Helper")
+	if _, err := s.Introduce("alice", "alice", "Alice"); err == nil {
+		t.Errorf("Introduce(alice) succeeded")
+	}
+	s.WriteMessage(NewMessage("helper", CMD_PRIVMSG, "alice", "hi"))
+	c.expectLine(":0BBAAAAAB PRIVMSG 1HBAAAAAB hi")
+
+	// Send waits for the PONG to a TS6 PING
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.Send(context.Background(), NewMessage("", CMD_PRIVMSG, "#chan", "sent"))
+	}()
+	c.expectLine(":0BBAAAAAA PRIVMSG #chan sent")
+	c.expectLine(":0BB PING bot.example.net 1HB")
+	c.Send(":1HB PONG hub.example.net :0BB")
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("Send: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Send still waiting after PONG")
+	}
+
+	// A killed pseudo-client is reintroduced
+	c.Send(":1HBAAAAAB KILL 0BBAAAAAA :a.example!alice (go away)")
+	c.expectLine(":0BB EUID bot 1 1700000000 +i bot bot.example.net 0 0BBAAAAAA * * :github.com/kylelemons/blightbot " + VERSION)
+	c.expectLine(":0BB SJOIN 1600000000 #chan + 0BBAAAAAA")
+
+	c.Send(":1HB SQUIT 1HB :shutting down")
+	c.Sync()
+	if got := len(ch.Members()); got != 1 {
+		t.Errorf("%d members after SQUIT, want 1: %v", got, ch.Members())
+	}
+}
+
+func TestLinkPassword(t *testing.T) {
+	b := New("bot", "bot")
+	c := newLinkConn(t, b, &Link{
+		Name:     "bot.example.net",
+		SID:      "0BB",
+		Password: "secret",
+	})
+	defer c.Close()
+
+	c.Send("PASS wrong TS 6 :1HB")
+	c.expectLine("ERROR :Closing Link: bad password")
+	select {
+	case <-c.serv.Done():
+	case <-time.After(time.Second):
+		t.Errorf("link still connected after bad password")
+	}
+}
+
+func TestLinkCheck(t *testing.T) {
+	tests := []struct {
+		link Link
+		ok   bool
+	}{
+		{Link{Name: "bot.example.net", SID: "0BB", Password: "pw"}, true},
+		{Link{Name: "bot", SID: "0BB", Password: "pw"}, false},
+		{Link{Name: "bot.example.net", SID: "BBB", Password: "pw"}, false},
+		{Link{Name: "bot.example.net", SID: "0BB"}, false},
+	}
+	for _, test := range tests {
+		if err := test.link.check(); (err == nil) != test.ok {
+			t.Errorf("%+v.check() = %v, want ok=%v", test.link, err, test.ok)
+		}
+	}
+}
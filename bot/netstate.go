@@ -0,0 +1,438 @@
+package bot
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A NetState is the view of the network from a server link (see
+// ConnectLink): every server, user and channel, as introduced in the bursts
+// and kept up to date afterwards.  See ON_NETSERVER, ON_NETSPLIT,
+// ON_NETUSER and ON_NETQUIT for its events.
+type NetState struct {
+	lock    sync.RWMutex
+	isup    *ISupport
+	servers map[string]*NetServer  // by SID
+	users   map[string]*NetUser    // by UID
+	uids    map[string]string      // UIDs by lowercase nick
+	chans   map[string]*NetChannel // by lowercase name
+}
+
+// A NetServer is a server on the network.
+type NetServer struct {
+	SID         string
+	Name        string
+	Description string
+	Hops        int
+	Uplink      string // the SID of the server it is linked to, or "" for us
+}
+
+// A NetUser is a user on the network.
+type NetUser struct {
+	UID      string
+	Nick     string
+	User     string
+	Host     string
+	IP       string
+	Realname string
+	Modes    string // user modes, e.g. "+io"
+	Account  string // services account, or "" if not logged in
+	Server   string // SID
+	TS       int64  // when the nick was taken
+}
+
+// ID returns the identity of the user.
+func (u *NetUser) ID() *Identity {
+	return &Identity{Nick: u.Nick, User: u.User, Host: u.Host}
+}
+
+// A NetChannel is a channel on the network.
+type NetChannel struct {
+	Name    string
+	TS      int64
+	Modes   map[byte]string   // parameters (or "") of the modes which are set
+	Lists   map[byte][]string // masks of the list modes (bans, etc)
+	Members map[string]string // status prefixes (e.g. "@") by UID
+
+	Topic       string
+	TopicSetter string
+	TopicTS     int64
+}
+
+// copy returns a deep copy of the channel.
+func (ch *NetChannel) copy() NetChannel {
+	c := *ch
+	c.Modes = make(map[byte]string, len(ch.Modes))
+	for k, v := range ch.Modes {
+		c.Modes[k] = v
+	}
+	c.Lists = make(map[byte][]string, len(ch.Lists))
+	for k, v := range ch.Lists {
+		c.Lists[k] = append([]string(nil), v...)
+	}
+	c.Members = make(map[string]string, len(ch.Members))
+	for k, v := range ch.Members {
+		c.Members[k] = v
+	}
+	return c
+}
+
+func newNetState(isup *ISupport) *NetState {
+	return &NetState{
+		isup:    isup,
+		servers: map[string]*NetServer{},
+		users:   map[string]*NetUser{},
+		uids:    map[string]string{},
+		chans:   map[string]*NetChannel{},
+	}
+}
+
+// NetState returns the state of the network, if the server is a server
+// link, or nil.
+func (s *Server) NetState() *NetState {
+	if s.link == nil {
+		return nil
+	}
+	return s.link.net
+}
+
+// Server returns the server with the given SID.
+func (n *NetState) Server(sid string) (NetServer, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	srv, ok := n.servers[sid]
+	if !ok {
+		return NetServer{}, false
+	}
+	return *srv, true
+}
+
+// ServerByName returns the server with the given name.
+func (n *NetState) ServerByName(name string) (NetServer, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	srv := n.serverByName(name)
+	if srv == nil {
+		return NetServer{}, false
+	}
+	return *srv, true
+}
+
+// Servers returns every server on the network, sorted by SID.
+func (n *NetState) Servers() []NetServer {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	servers := make([]NetServer, 0, len(n.servers))
+	for _, srv := range n.servers {
+		servers = append(servers, *srv)
+	}
+	sort.Sort(netServerSorter(servers))
+	return servers
+}
+
+// User returns the user with the given UID.
+func (n *NetState) User(uid string) (NetUser, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	u, ok := n.users[uid]
+	if !ok {
+		return NetUser{}, false
+	}
+	return *u, true
+}
+
+// UserByNick returns the user with the given nick.
+func (n *NetState) UserByNick(nick string) (NetUser, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	u := n.nick(nick)
+	if u == nil {
+		return NetUser{}, false
+	}
+	return *u, true
+}
+
+// Users returns every user on the network, sorted by UID.
+func (n *NetState) Users() []NetUser {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	users := make([]NetUser, 0, len(n.users))
+	for _, u := range n.users {
+		users = append(users, *u)
+	}
+	sort.Sort(netUserSorter(users))
+	return users
+}
+
+// UsersOn returns the users on the server with the given SID, sorted by UID.
+func (n *NetState) UsersOn(sid string) []NetUser {
+	var users []NetUser
+	for _, u := range n.Users() {
+		if u.Server == sid {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// ServerOf returns the server which the user with the given nick (or UID) is
+// on.
+func (n *NetState) ServerOf(nick string) (NetServer, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	u := n.users[nick]
+	if u == nil {
+		u = n.nick(nick)
+	}
+	if u == nil {
+		return NetServer{}, false
+	}
+	srv, ok := n.servers[u.Server]
+	if !ok {
+		return NetServer{}, false
+	}
+	return *srv, true
+}
+
+// Channel returns the channel with the given name.
+func (n *NetState) Channel(name string) (NetChannel, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	ch, ok := n.chans[n.isup.ToLower(name)]
+	if !ok {
+		return NetChannel{}, false
+	}
+	return ch.copy(), true
+}
+
+// Channels returns every channel on the network, sorted by name.
+func (n *NetState) Channels() []NetChannel {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	chans := make([]NetChannel, 0, len(n.chans))
+	for _, ch := range n.chans {
+		chans = append(chans, ch.copy())
+	}
+	sort.Sort(netChannelSorter(chans))
+	return chans
+}
+
+// UserChannels returns the names of the channels the user with the given
+// UID is in, sorted.
+func (n *NetState) UserChannels(uid string) []string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.userChannels(uid)
+}
+
+// The methods below must be called with the lock held.
+
+// serverByName returns the server with the name, or nil.
+func (n *NetState) serverByName(name string) *NetServer {
+	for _, srv := range n.servers {
+		if strings.EqualFold(srv.Name, name) {
+			return srv
+		}
+	}
+	return nil
+}
+
+// userChannels returns the names of the user's channels, sorted.
+func (n *NetState) userChannels(uid string) []string {
+	var names []string
+	for _, ch := range n.chans {
+		if _, ok := ch.Members[uid]; ok {
+			names = append(names, ch.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nick returns the user with the nick, or nil.
+func (n *NetState) nick(nick string) *NetUser {
+	return n.users[n.uids[n.isup.ToLower(nick)]]
+}
+
+func (n *NetState) addServer(srv *NetServer) {
+	n.servers[srv.SID] = srv
+}
+
+func (n *NetState) addUser(u *NetUser) {
+	n.users[u.UID] = u
+	n.uids[n.isup.ToLower(u.Nick)] = u.UID
+}
+
+// rename changes a user's nick.
+func (n *NetState) rename(u *NetUser, nick string) {
+	if n.uids[n.isup.ToLower(u.Nick)] == u.UID {
+		delete(n.uids, n.isup.ToLower(u.Nick))
+	}
+	u.Nick = nick
+	n.uids[n.isup.ToLower(nick)] = u.UID
+}
+
+// delUser removes a user from the network and its channels.
+func (n *NetState) delUser(u *NetUser) {
+	for _, ch := range n.chans {
+		if _, ok := ch.Members[u.UID]; ok {
+			n.part(ch, u.UID)
+		}
+	}
+	delete(n.users, u.UID)
+	if n.uids[n.isup.ToLower(u.Nick)] == u.UID {
+		delete(n.uids, n.isup.ToLower(u.Nick))
+	}
+}
+
+// split removes a server and those behind it, and returns their users, who
+// must then be removed.
+func (n *NetState) split(sid string) []*NetUser {
+	var users []*NetUser
+	for child, srv := range n.servers {
+		if srv.Uplink == sid {
+			users = append(users, n.split(child)...)
+		}
+	}
+	for _, u := range n.users {
+		if u.Server == sid {
+			users = append(users, u)
+		}
+	}
+	delete(n.servers, sid)
+	sort.Sort(netUserPtrSorter(users))
+	return users
+}
+
+// channel returns the channel with the name, creating it with the TS if it
+// does not exist.
+func (n *NetState) channel(name string, ts int64) *NetChannel {
+	key := n.isup.ToLower(name)
+	ch := n.chans[key]
+	if ch == nil {
+		ch = &NetChannel{
+			Name:    name,
+			TS:      ts,
+			Modes:   map[byte]string{},
+			Lists:   map[byte][]string{},
+			Members: map[string]string{},
+		}
+		n.chans[key] = ch
+	}
+	return ch
+}
+
+// getChannel returns the channel with the name, or nil.
+func (n *NetState) getChannel(name string) *NetChannel {
+	return n.chans[n.isup.ToLower(name)]
+}
+
+// part removes a member from a channel, and forgets the channel once it is
+// empty.
+func (n *NetState) part(ch *NetChannel, uid string) {
+	delete(ch.Members, uid)
+	if len(ch.Members) == 0 {
+		delete(n.chans, n.isup.ToLower(ch.Name))
+	}
+}
+
+// lowerTS resets a channel which has lost to an older one of the same name
+// across a link: it takes the older TS, and its modes and statuses are
+// cleared.
+func (n *NetState) lowerTS(ch *NetChannel, ts int64) {
+	ch.TS = ts
+	ch.Modes = map[byte]string{}
+	ch.Lists = map[byte][]string{}
+	for uid := range ch.Members {
+		ch.Members[uid] = ""
+	}
+}
+
+// applyModes applies mode changes to a channel.  The parameters of status
+// modes are UIDs.
+func (n *NetState) applyModes(ch *NetChannel, changes []ModeChange) {
+	prefix, _ := n.isup.Prefix()
+	list, _, _, _ := n.isup.ChanModes()
+	for _, c := range changes {
+		switch {
+		case strings.IndexByte(prefix, c.Mode) >= 0:
+			if p, ok := ch.Members[c.Param]; ok {
+				ch.Members[c.Param] = setPrefix(p, c.Add, c.Mode)
+			}
+		case strings.IndexByte(list, c.Mode) >= 0:
+			masks := ch.Lists[c.Mode]
+			for i, mask := range masks {
+				if strings.EqualFold(mask, c.Param) {
+					masks = append(masks[:i], masks[i+1:]...)
+					break
+				}
+			}
+			if c.Add {
+				masks = append(masks, c.Param)
+			}
+			if len(masks) > 0 {
+				ch.Lists[c.Mode] = masks
+			} else {
+				delete(ch.Lists, c.Mode)
+			}
+		case c.Add:
+			ch.Modes[c.Mode] = c.Param
+		default:
+			delete(ch.Modes, c.Mode)
+		}
+	}
+}
+
+// applyUserModes applies a user mode string (e.g. "+o-i") to a user.
+func applyUserModes(u *NetUser, modes string) {
+	set := strings.TrimPrefix(u.Modes, "+")
+	add := true
+	for i := 0; i < len(modes); i++ {
+		switch m := modes[i]; m {
+		case '+', '-':
+			add = m == '+'
+		default:
+			set = strings.Replace(set, string(m), "", -1)
+			if add {
+				set += string(m)
+			}
+		}
+	}
+	b := []byte(set)
+	sort.Sort(byteSorter(b))
+	u.Modes = "+" + string(b)
+}
+
+type netServerSorter []NetServer
+
+func (s netServerSorter) Len() int           { return len(s) }
+func (s netServerSorter) Less(i, j int) bool { return s[i].SID < s[j].SID }
+func (s netServerSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type netUserSorter []NetUser
+
+func (u netUserSorter) Len() int           { return len(u) }
+func (u netUserSorter) Less(i, j int) bool { return u[i].UID < u[j].UID }
+func (u netUserSorter) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+type netUserPtrSorter []*NetUser
+
+func (u netUserPtrSorter) Len() int           { return len(u) }
+func (u netUserPtrSorter) Less(i, j int) bool { return u[i].UID < u[j].UID }
+func (u netUserPtrSorter) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+type netChannelSorter []NetChannel
+
+func (c netChannelSorter) Len() int           { return len(c) }
+func (c netChannelSorter) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c netChannelSorter) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNetState(t *testing.T) {
+	b := New("bot", "bot")
+	b.SetClock(NewVirtualClock(time.Unix(1700000000, 0)))
+
+	var lock sync.Mutex
+	var events []string
+	record := func(e string, s *Server, m *Message) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, e+" "+strings.TrimSpace(m.String()))
+	}
+	for _, e := range []string{ON_NETSERVER, ON_NETSPLIT, ON_NETUSER, ON_NETQUIT} {
+		b.OnEvent(e, record).Sync()
+	}
+
+	c := newLinkConn(t, b, &Link{
+		Name:     "bot.example.net",
+		SID:      "0BB",
+		Password: "secret",
+	})
+	defer c.Close()
+	net := c.serv.NetState()
+
+	c.Send(
+		"PASS secret TS 6 :1HB",
+		"CAPAB :QS EX IE ENCAP TB EUID",
+		"SERVER hub.example.net 1 :Hub",
+		":1HB SID leaf.example.net 2 2LF :Leaf",
+		":1HB EUID alice 1 1699999000 +i alice a.example 127.0.0.1 1HBAAAAAB * alice :Alice",
+		":2LF EUID carol 2 1699999001 +iw carol c.example 127.0.0.1 2LFAAAAAC * * :Carol",
+		":1HB SJOIN 1600000000 #chan +ntk key :@1HBAAAAAB 2LFAAAAAC",
+		":1HB BMASK 1600000000 #chan b :*!*@bad.example *!*@worse.example",
+		":1HB TB #chan 1600000100 alice :Welcome to #chan",
+		":1HB PING hub.example.net :0BB",
+	)
+	c.Sync()
+
+	if srv, ok := net.ServerOf("carol"); !ok || srv.SID != "2LF" || srv.Uplink != "1HB" {
+		t.Errorf("ServerOf(carol) = %+v, %v; want 2LF behind 1HB", srv, ok)
+	}
+	if srv, ok := net.ServerOf("1HBAAAAAB"); !ok || srv.Name != "hub.example.net" {
+		t.Errorf("ServerOf(1HBAAAAAB) = %+v, %v; want hub.example.net", srv, ok)
+	}
+	if u, ok := net.UserByNick("ALICE"); !ok || u.Account != "alice" || u.Host != "a.example" {
+		t.Errorf("UserByNick(ALICE) = %+v, %v", u, ok)
+	}
+	if got, want := len(net.Servers()), 3; got != want {
+		t.Errorf("%d servers, want %d: %+v", got, want, net.Servers())
+	}
+
+	ch, ok := net.Channel("#CHAN")
+	if !ok {
+		t.Fatalf("no #chan after SJOIN")
+	}
+	if ch.TS != 1600000000 || ch.Modes['k'] != "key" {
+		t.Errorf("#chan TS %d, modes %v", ch.TS, ch.Modes)
+	}
+	if got, want := ch.Lists['b'], []string{"*!*@bad.example", "*!*@worse.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bans = %q, want %q", got, want)
+	}
+	if ch.Topic != "Welcome to #chan" || ch.TopicSetter != "alice" || ch.TopicTS != 1600000100 {
+		t.Errorf("topic = %q, %q, %d", ch.Topic, ch.TopicSetter, ch.TopicTS)
+	}
+	if got, want := ch.Members, map[string]string{"1HBAAAAAB": "@", "2LFAAAAAC": ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+
+	// An older channel's TS wins, dropping the newer channel's modes
+	c.Send(":2LF SJOIN 1500000000 #chan +s :2LFAAAAAC")
+	c.Sync()
+	ch, _ = net.Channel("#chan")
+	if got, want := ch.Members, map[string]string{"1HBAAAAAB": "", "2LFAAAAAC": ""}; ch.TS != 1500000000 || !reflect.DeepEqual(got, want) {
+		t.Errorf("after older SJOIN: TS %d, members %v; want 1500000000, %v", ch.TS, got, want)
+	}
+	if _, ok := ch.Modes['s']; !ok || len(ch.Lists['b']) != 0 {
+		t.Errorf("after older SJOIN: modes %v, lists %v", ch.Modes, ch.Lists)
+	}
+
+	// A netsplit drops the users behind the server
+	c.Send(":1HB SQUIT 2LF :leaf gone")
+	c.Sync()
+	if _, ok := net.UserByNick("carol"); ok {
+		t.Errorf("carol still on the network after SQUIT")
+	}
+	if _, ok := net.Server("2LF"); ok {
+		t.Errorf("2LF still on the network after SQUIT")
+	}
+	if got := net.UserChannels("1HBAAAAAB"); !reflect.DeepEqual(got, []string{"#chan"}) {
+		t.Errorf("UserChannels(alice) = %q", got)
+	}
+
+	c.Send(":1HBAAAAAB QUIT :bye")
+	c.Sync()
+	if _, ok := net.Channel("#chan"); ok {
+		t.Errorf("#chan still exists after its last member quit")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{
+		"onnetserver SERVER hub.example.net 1 Hub",
+		"onnetserver :1HB SID leaf.example.net 2 2LF Leaf",
+		"onnetuser :1HB EUID alice 1 1699999000 +i alice a.example 127.0.0.1 1HBAAAAAB * alice Alice",
+		"onnetuser :2LF EUID carol 2 1699999001 +iw carol c.example 127.0.0.1 2LFAAAAAC * * Carol",
+		"onnetquit :carol!carol@c.example QUIT :*.net *.split",
+		"onnetsplit :1HB SQUIT 2LF :leaf gone",
+		"onnetquit :alice!alice@a.example QUIT bye",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events:\n got %q\nwant %q", events, want)
+	}
+}
@@ -0,0 +1,226 @@
+package bot
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Default reconnect settings.
+const (
+	DefaultMinBackoff = 5 * time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+	DefaultJitter     = 0.25
+)
+
+// A Network is an IRC network to which the bot stays connected, reconnecting
+// whenever the connection is lost.
+type Network struct {
+	// Name identifies the network in logs.  If it is empty, the first
+	// address is used.
+	Name string
+
+	// Addrs lists the servers (host:port) in the network.  They are tried in
+	// turn, moving to the next address whenever a connection fails.
+	Addrs []string
+
+	// Pass is the server password, if any.
+	Pass string
+
+	// Channels lists the channels to join once the bot first registers,
+	// each optionally followed by a space and its key.  After reconnecting,
+	// the bot rejoins the channels it was in instead.
+	Channels []string
+
+	// TLS, if non-nil, causes connections to be made using TLS.
+	TLS *TLSOptions
+
+	// Net, if non-nil, configures the proxy, bind address and address
+	// family preference for TCP connections.
+	Net *NetOptions
+
+	// AddrNet, if non-nil, holds the network options for particular
+	// addresses, used in place of Net.
+	AddrNet map[string]*NetOptions
+
+	// Encoding, if non-nil, replaces the bot's encoding (see SetEncoding)
+	// for the network's servers.
+	Encoding *Encoding
+
+	// Link, if non-nil, connects the bot to the network as a server (see
+	// ConnectLink), rather than as a client.
+	Link *Link
+
+	// Transport, if non-nil, returns the dialer used to connect to an
+	// address in place of TCP (and TLS).  If it returns nil, TCP is used.
+	Transport func(addr string) Dialer
+
+	// The delay before reconnecting starts at MinBackoff and doubles after
+	// each failed attempt, up to MaxBackoff.  Each delay is adjusted randomly
+	// by up to the Jitter fraction of itself.  Zero values use the defaults
+	// above, and a negative Jitter disables it.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Jitter     float64
+}
+
+// backoff returns the delay before the given reconnect attempt (starting
+// at 0).
+func (n *Network) backoff(attempt int) time.Duration {
+	min, max, jitter := n.MinBackoff, n.MaxBackoff, n.Jitter
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	if jitter == 0 {
+		jitter = DefaultJitter
+	}
+
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if jitter > 0 {
+		delay += time.Duration(jitter * (2*rand.Float64() - 1) * float64(delay))
+	}
+	return delay
+}
+
+// ConnectNetwork connects to the network, and keeps reconnecting whenever
+// the connection is lost.  Channels which the bot was in when it was
+// disconnected are rejoined when it reconnects.  The first connection is made
+// in the background, so ConnectNetwork only returns an error if the network
+// is invalid.
+func (b *Bot) ConnectNetwork(n *Network) error {
+	if len(n.Addrs) == 0 {
+		return errors.New("bot: network has no addresses")
+	}
+	if n.Name == "" {
+		n.Name = n.Addrs[0]
+	}
+	if n.Link != nil {
+		if err := n.Link.check(); err != nil {
+			return err
+		}
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.maintain(n)
+	}()
+	return nil
+}
+
+// maintain keeps the bot connected to the network until the bot is closed or
+// the server is told to quit.
+func (b *Bot) maintain(n *Network) {
+	rejoin := n.Channels
+	for next, attempt := 0, 0; ; attempt++ {
+		addr := n.Addrs[next%len(n.Addrs)]
+		log.Printf("[%s] Connecting to %q...", n.Name, addr)
+
+		conn, err := b.dialNetwork(n, addr)
+		if err != nil {
+			log.Printf("[%s] connect: %s", n.Name, err)
+			next++
+		} else {
+			s := b.initServer(addr, n.Pass, conn)
+			s.network, s.rejoin = n, rejoin
+			if n.Link != nil {
+				s.link = newLink(s, n.Link)
+			}
+			s.start()
+			<-s.done
+			if s.quitting() {
+				return
+			}
+
+			// Stick with this address as long as we can register with it
+			if s.registered {
+				rejoin = s.joined()
+				attempt = 0
+			} else {
+				next++
+			}
+		}
+
+		if b.ctx.Err() != nil {
+			return
+		}
+		delay := n.backoff(attempt)
+		log.Printf("[%s] Reconnecting in %s", n.Name, delay)
+		select {
+		case <-b.getClock().After(delay):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// dialNetwork connects to an address in the network.
+func (b *Bot) dialNetwork(n *Network, addr string) (io.ReadWriteCloser, error) {
+	if n.Transport != nil {
+		if d := n.Transport(addr); d != nil {
+			return d.Dial(b.ctx)
+		}
+	}
+	netOpts := n.Net
+	if opts, ok := n.AddrNet[addr]; ok {
+		netOpts = opts
+	}
+	return b.dial(addr, netOpts, n.TLS)
+}
+
+// dial connects to the given address using the network options, and TLS if
+// tlsOpts is non-nil.
+func (b *Bot) dial(addr string, netOpts *NetOptions, tlsOpts *TLSOptions) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   DialTimeout,
+		KeepAlive: b.ping,
+	}
+	return dialTCP(b.ctx, dialer, addr, netOpts, tlsOpts)
+}
+
+// Network returns the network the server belongs to, or nil if it was not
+// connected with ConnectNetwork.
+func (s *Server) Network() *Network {
+	return s.network
+}
+
+// joined returns the channels the bot is in, with their keys, in the form
+// used by rejoin.
+func (s *Server) joined() []string {
+	var chans []string
+	for _, ch := range s.Channels() {
+		entry := ch.Name()
+		if key, ok := ch.Mode('k'); ok && key != "" {
+			entry += " " + key
+		}
+		chans = append(chans, entry)
+	}
+	return chans
+}
+
+// rejoinChannels rejoins the channels the bot was in before it reconnected.
+func (s *Server) rejoinChannels() {
+	for _, entry := range s.rejoin {
+		s.WriteMessage(NewMessage("", CMD_JOIN, strings.Fields(entry)...))
+	}
+}
+
+// Servers returns the servers to which the bot is currently connected.
+func (b *Bot) Servers() []*Server {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return append([]*Server(nil), b.servers...)
+}
@@ -0,0 +1,142 @@
+package bot
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	n := &Network{MinBackoff: 1 * time.Second, MaxBackoff: 10 * time.Second, Jitter: -1}
+	for attempt, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if got, want := n.backoff(attempt), want*time.Second; got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+
+	n.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := n.backoff(2); got < 2*time.Second || got > 6*time.Second {
+			t.Fatalf("backoff(2) with jitter = %s, want 2s-6s", got)
+		}
+	}
+}
+
+// ircConn is the server side of a connection from the bot.
+type ircConn struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func accept(t *testing.T, l net.Listener) *ircConn {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &ircConn{t, conn, bufio.NewReader(conn)}
+}
+
+func (c *ircConn) Send(lines ...string) {
+	for _, line := range lines {
+		io.WriteString(c.conn, line+"\r\n")
+	}
+}
+
+func (c *ircConn) Expect(want string) {
+	for {
+		line, err := c.in.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading %q: %s", want, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == want {
+			return
+		}
+		c.t.Logf("skipping %q", line)
+	}
+}
+
+func TestConnectNetwork(t *testing.T) {
+	// An address which refuses connections
+	bad, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	bad.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	b := New("n", "u")
+	b.SetFlood(0, 0)
+	connected := make(chan *Server, 2)
+	b.OnConnect(func(e string, s *Server, m *Message) {
+		connected <- s
+	})
+
+	n := &Network{
+		Name:       "test",
+		Addrs:      []string{bad.Addr().String(), l.Addr().String()},
+		Channels:   []string{"#first key"},
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Jitter:     -1,
+	}
+	if err := b.ConnectNetwork(n); err != nil {
+		t.Fatalf("ConnectNetwork: %s", err)
+	}
+
+	c := accept(t, l)
+	c.Expect("NICK n")
+	c.Send(":serv 001 n :Welcome")
+	c.Expect("JOIN #first key")
+	c.Send(
+		":n!u@h JOIN #chan",
+		":serv 324 n #chan +k secret",
+		":n!u@h JOIN #other",
+		"PING :sync",
+	)
+	c.Expect("PONG sync")
+
+	first := <-connected
+	if got := b.Servers(); len(got) != 1 || got[0] != first {
+		t.Errorf("Servers() = %v, want [%p]", got, first)
+	}
+	if got := first.Network(); got != n {
+		t.Errorf("Network() = %p, want %p", got, n)
+	}
+
+	// Drop the connection; the bot should reconnect and rejoin the channels
+	// it was in, rather than those it first joined
+	c.conn.Close()
+	select {
+	case <-first.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server did not disconnect")
+	}
+
+	c = accept(t, l)
+	defer c.conn.Close()
+	c.Expect("NICK n")
+	c.Send(":serv 001 n :Welcome back")
+	c.Expect("JOIN #chan secret")
+	c.Expect("JOIN #other")
+
+	second := <-connected
+	if got := b.Servers(); len(got) != 1 || got[0] != second {
+		t.Errorf("Servers() = %v, want [%p]", got, second)
+	}
+
+	go b.Close()
+	c.Expect("QUIT :" + QuitMessage)
+	c.conn.Close()
+	<-b.Done()
+}
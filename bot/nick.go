@@ -0,0 +1,210 @@
+package bot
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// DefaultRegainInterval is how often the bot checks whether its nick has
+// become available, on servers which don't support MONITOR.
+const DefaultRegainInterval = 1 * time.Minute
+
+// When the bot's nick and alternates are refused during registration,
+// underscores are appended to the refused nick a few times before trying
+// random nicks starting with fallbackNick.
+const (
+	maxNickRetries = 3
+	fallbackNick   = "blight"
+)
+
+// Services commands used to take the bot's nick back from whoever is using
+// it.
+const (
+	NICKSERV_REGAIN = "REGAIN"
+	NICKSERV_GHOST  = "GHOST"
+)
+
+// NickServ holds the credentials used to take the bot's nick back from
+// whoever is using it.
+type NickServ struct {
+	Service  string // defaults to "NickServ"
+	Password string
+	Command  string // NICKSERV_REGAIN (the default) or NICKSERV_GHOST
+}
+
+// SetAltNicks sets the nicks to try, in order, if the bot's nick is in use
+// or refused when it connects.
+func (b *Bot) SetAltNicks(nicks ...string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.altNicks = append([]string(nil), nicks...)
+}
+
+// SetRegain sets how often the bot checks (with ISON) whether its nick has
+// become available while it is using another.  Servers which support
+// MONITOR notify the bot instead.  An interval of zero disables checking.
+func (b *Bot) SetRegain(interval time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.regain = interval
+}
+
+// SetNickServ sets the credentials with which the bot asks services for its
+// nick back when someone else is using it.  If ns is nil, services are not
+// used.
+func (b *Bot) SetNickServ(ns *NickServ) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nickserv = ns
+}
+
+// nickConfig returns the bot's nick settings.
+func (b *Bot) nickConfig() (alts []string, regain time.Duration, ns *NickServ) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.altNicks, b.regain, b.nickserv
+}
+
+// Nick returns the bot's current nick on the server.
+func (s *Server) Nick() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.id.Nick
+}
+
+// setNick records a change of the bot's nick.
+func (s *Server) setNick(nick string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.id.Nick = nick
+}
+
+// nickRefused handles a reply refusing a nick.  During registration, the
+// next nick is tried; afterwards, the bot keeps the nick it has.
+func (s *Server) nickRefused(m *Message) {
+	if s.registered {
+		s.Log("nick refused: %s", ErrorReply(m))
+		return
+	}
+
+	// :server 433 * nick :Nickname is already in use
+	refused := s.id.Nick
+	switch {
+	case len(m.Args) > 2:
+		refused = m.Args[1]
+	case len(m.Args) > 1:
+		// Some servers leave out our nick
+		refused = m.Args[0]
+	}
+	if s.IsChannel(refused) {
+		// ERR_UNAVAILRESOURCE is also used for channels
+		return
+	}
+
+	nick := s.nextNick(refused, m.Command == ERR_ERRONEUSNICKNAME)
+	s.setNick(nick)
+	s.send(NewMessage("", CMD_NICK, nick))
+}
+
+// nextNick returns the nick to try after one was refused during
+// registration.
+func (s *Server) nextNick(refused string, erroneous bool) string {
+	alts, _, _ := s.bot.nickConfig()
+	try := s.nickTry
+	s.nickTry++
+
+	switch {
+	case try < len(alts):
+		return alts[try]
+	case !erroneous && try < len(alts)+maxNickRetries:
+		return refused + "_"
+	}
+	return fmt.Sprintf("%s%03d", fallbackNick, rand.Intn(1000))
+}
+
+// regain starts trying to take back the bot's nick if it is using another.
+func (s *Server) regain() {
+	nick := s.bot.id.Nick
+	if s.isupport.EqualFold(s.id.Nick, nick) {
+		if s.monitoring {
+			s.monitoring = false
+			s.WriteMessage(NewMessage("", CMD_MONITOR, "-", nick))
+		}
+		return
+	}
+
+	_, interval, ns := s.bot.nickConfig()
+	if ns != nil && !s.ghosted {
+		s.ghosted = true
+		service, cmd := ns.Service, ns.Command
+		if service == "" {
+			service = "NickServ"
+		}
+		if cmd == "" {
+			cmd = NICKSERV_REGAIN
+		}
+		s.WriteMessage(NewMessage("", CMD_PRIVMSG, service, cmd+" "+nick+" "+ns.Password))
+		if cmd == NICKSERV_GHOST {
+			s.WriteMessage(NewMessage("", CMD_NICK, nick))
+		}
+	}
+
+	if _, ok := s.isupport.Get("MONITOR"); ok {
+		if !s.monitoring {
+			s.monitoring = true
+			s.WriteMessage(NewMessage("", CMD_MONITOR, "+", nick))
+		}
+		return
+	}
+	if interval > 0 && !s.regaining {
+		s.regaining = true
+		go s.regainloop(nick, interval)
+	}
+}
+
+// regainloop periodically checks whether the bot's nick is available.
+func (s *Server) regainloop(nick string, interval time.Duration) {
+	for {
+		select {
+		case <-s.clock.After(interval):
+		case <-s.done:
+			return
+		}
+		if !s.isupport.EqualFold(s.Nick(), nick) {
+			s.WritePriority(NewMessage("", CMD_ISON, nick), PriorityBulk)
+		}
+	}
+}
+
+// nickStatus takes the bot's nick back if an RPL_ISON or RPL_MONOFFLINE says
+// it is available.
+func (s *Server) nickStatus(m *Message) {
+	nick := s.bot.id.Nick
+	if len(m.Args) < 2 || s.isupport.EqualFold(s.id.Nick, nick) {
+		return
+	}
+
+	switch m.Command {
+	case RPL_ISON:
+		// :server 303 me :nick1 nick2...
+		for _, online := range strings.Fields(m.Args[1]) {
+			if s.isupport.EqualFold(online, nick) {
+				return
+			}
+		}
+	case RPL_MONOFFLINE:
+		// :server 731 me :nick1,nick2...
+		offline := false
+		for _, target := range strings.Split(m.Args[1], ",") {
+			if s.isupport.EqualFold(target, nick) {
+				offline = true
+			}
+		}
+		if !offline {
+			return
+		}
+	}
+	s.WriteMessage(NewMessage("", CMD_NICK, nick))
+}
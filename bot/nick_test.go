@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNickRefused(t *testing.T) {
+	b := New("n", "u")
+	b.SetAltNicks("alt1", "alt2")
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	c.expectLine("NICK n")
+	c.Send(":serv 433 * n :Nickname is already in use")
+	c.expectLine("NICK alt1")
+	c.Send(":serv 437 * alt1 :Nick/channel is temporarily unavailable")
+	c.expectLine("NICK alt2")
+	c.Send(":serv 433 * alt2 :Nickname is already in use")
+	c.expectLine("NICK alt2_")
+	c.Send(":serv 432 * alt2_ :Erroneous Nickname")
+
+	line := <-c.lines
+	if nick := strings.TrimPrefix(line, "NICK "); !strings.HasPrefix(nick, fallbackNick) || len(nick) != len(fallbackNick)+3 {
+		t.Errorf("after erroneous nick, sent %q, want a random nick", line)
+	}
+
+	// Once registered, refused nicks are ignored
+	c.Send(
+		":serv 001 blight123 :Welcome",
+		":serv 433 blight123 other :Nickname is already in use",
+	)
+	for _, line := range c.Sync() {
+		if strings.HasPrefix(line, "NICK") {
+			t.Errorf("sent %q after registration", line)
+		}
+	}
+	if got, want := c.serv.Nick(), "blight123"; got != want {
+		t.Errorf("Nick() = %q, want %q", got, want)
+	}
+}
+
+func TestRegain(t *testing.T) {
+	b := New("n", "u")
+	b.SetRegain(10 * time.Millisecond)
+	b.SetNickServ(&NickServ{Password: "secret", Command: NICKSERV_GHOST})
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	c.Send(
+		":serv 433 * n :Nickname is already in use",
+		":serv 001 n_ :Welcome",
+	)
+	c.expectLine("PRIVMSG NickServ :GHOST n secret")
+	c.expectLine("NICK n")
+	c.Send(":serv 433 n_ n :Nickname is already in use")
+
+	// Without MONITOR, the bot polls with ISON
+	c.expectLine("ISON n")
+	c.Send(":serv 303 n_ :n")
+	c.expectLine("ISON n")
+	c.Send(":serv 303 n_ :")
+	c.expectLine("NICK n")
+	c.Send(":n_!u@h NICK n")
+	c.Sync()
+	if got, want := c.serv.Nick(), "n"; got != want {
+		t.Errorf("Nick() = %q, want %q", got, want)
+	}
+}
+
+func TestRegainMonitor(t *testing.T) {
+	b := New("n", "u")
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	c.Send(
+		":serv 005 n_ MONITOR=100 :are supported by this server",
+		":serv 001 n_ :Welcome",
+	)
+	c.expectLine("MONITOR + n")
+	c.Send(
+		":serv 730 n_ :n!x@y",
+		":serv 731 n_ :n",
+	)
+	c.expectLine("NICK n")
+	c.Send(":n_!u@h NICK n")
+	c.expectLine("MONITOR - n")
+}
@@ -0,0 +1,24 @@
+package bot
+
+// Numerics which are not described in RFC 2812 but are in common use.
+const (
+	RPL_LISTSTART    = "321"
+	RPL_CREATIONTIME = "329"
+	RPL_WHOISACCOUNT = "330"
+	RPL_TOPICWHOTIME = "333"
+	RPL_WHOSPCRPL    = "354"
+	RPL_HOSTHIDDEN   = "396"
+	RPL_WHOISSECURE  = "671"
+	RPL_MONONLINE    = "730"
+	RPL_MONOFFLINE   = "731"
+
+	RPL_LOGGEDIN    = "900"
+	RPL_LOGGEDOUT   = "901"
+	ERR_NICKLOCKED  = "902"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+	RPL_SASLMECHS   = "908"
+)
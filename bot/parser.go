@@ -2,11 +2,26 @@ package bot
 
 import (
 	"bytes"
+	"sort"
 	"strings"
+	"time"
+)
+
+// Well-known message tags
+const (
+	TAG_TIME    = "time"
+	TAG_MSGID   = "msgid"
+	TAG_ACCOUNT = "account"
+	TAG_LABEL   = "label"
+	TAG_BATCH   = "batch"
+
+	// The format of the server-time tag
+	ServerTimeFormat = "2006-01-02T15:04:05.000Z"
 )
 
 // A Message represents a parsed line from the IRC server.
 type Message struct {
+	Tags    map[string]string
 	Prefix  string
 	Command string
 	Args    []string
@@ -23,11 +38,126 @@ func NewMessage(pfx, cmd string, args ...string) *Message {
 
 // Copy copies the message.  This is a deep copy.
 func (m Message) Copy() *Message {
-	return &Message{
+	c := &Message{
 		Prefix:  m.Prefix,
 		Command: m.Command,
 		Args:    append(make([]string, 0, len(m.Args)), m.Args...),
 	}
+	if m.Tags != nil {
+		c.Tags = make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			c.Tags[k] = v
+		}
+	}
+	return c
+}
+
+// Tag returns the value of the given tag and whether it was present.
+func (m *Message) Tag(key string) (string, bool) {
+	val, ok := m.Tags[key]
+	return val, ok
+}
+
+// SetTag sets the given tag on the message.  An empty value is sent as a
+// tag with no value.
+func (m *Message) SetTag(key, val string) {
+	if m.Tags == nil {
+		m.Tags = map[string]string{}
+	}
+	m.Tags[key] = val
+}
+
+// Time returns the time at which the server says the message was sent
+// (from the server-time tag), if it is present and valid.
+func (m *Message) Time() (time.Time, bool) {
+	val, ok := m.Tags[TAG_TIME]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// IsClientTag returns true if the tag is a client-only tag, which is passed
+// through the server unmodified (e.g. "+typing").
+func IsClientTag(key string) bool {
+	return strings.HasPrefix(key, "+")
+}
+
+// EscapeTag escapes a tag value for use on the wire.
+func EscapeTag(val string) string {
+	if strings.IndexAny(val, ";\\ \r\n") < 0 {
+		return val
+	}
+	b := make([]byte, 0, len(val)+8)
+	for i := 0; i < len(val); i++ {
+		switch c := val[i]; c {
+		case ';':
+			b = append(b, '\\', ':')
+		case ' ':
+			b = append(b, '\\', 's')
+		case '\\':
+			b = append(b, '\\', '\\')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\n':
+			b = append(b, '\\', 'n')
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// UnescapeTag unescapes a tag value from the wire.  Invalid escapes are
+// replaced by the escaped character, and a trailing backslash is dropped.
+func UnescapeTag(val string) string {
+	if strings.IndexByte(val, '\\') < 0 {
+		return val
+	}
+	b := make([]byte, 0, len(val))
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+		if i++; i >= len(val) {
+			break
+		}
+		switch c := val[i]; c {
+		case ':':
+			b = append(b, ';')
+		case 's':
+			b = append(b, ' ')
+		case 'r':
+			b = append(b, '\r')
+		case 'n':
+			b = append(b, '\n')
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// parseTags parses the tags portion of a message (without the leading @).
+func parseTags(raw string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, val := tag, ""
+		if eq := strings.IndexByte(tag, '='); eq >= 0 {
+			key, val = tag[:eq], UnescapeTag(tag[eq+1:])
+		}
+		tags[key] = val
+	}
+	return tags
 }
 
 // ID returns the Identity of the sender of the message.
@@ -58,6 +188,14 @@ func ParseMessage(line string) *Message {
 		return nil
 	}
 	m := new(Message)
+	if line[0] == '@' {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) <= 1 {
+			return nil
+		}
+		m.Tags = parseTags(split[0][1:])
+		line = strings.TrimLeft(split[1], " ")
+	}
 	if line[0] == ':' {
 		split := strings.SplitN(line, " ", 2)
 		if len(split) <= 1 {
@@ -66,12 +204,20 @@ func ParseMessage(line string) *Message {
 		m.Prefix = string(split[0][1:])
 		line = split[1]
 	}
-	split := strings.SplitN(line, ":", 2)
-	args := strings.Split(strings.TrimSpace(split[0]), " ")
+	// The trailing argument is the first one starting with a colon
+	var trailing *string
+	if i := strings.Index(line, " :"); i >= 0 {
+		t := line[i+2:]
+		line, trailing = line[:i], &t
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
 	m.Command = strings.ToUpper(args[0])
 	m.Args = args[1:]
-	if len(split) > 1 {
-		m.Args = append(m.Args, string(split[1]))
+	if trailing != nil {
+		m.Args = append(m.Args, *trailing)
 	}
 	return m
 }
@@ -79,6 +225,27 @@ func ParseMessage(line string) *Message {
 // Bytes composes the message into a set of bytes for writing.
 func (m *Message) Bytes() []byte {
 	b := bytes.NewBuffer(make([]byte, 0, 128))
+	// Write the tags
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for k := range m.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteByte('@')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(k)
+			if v := m.Tags[k]; v != "" {
+				b.WriteByte('=')
+				b.WriteString(EscapeTag(v))
+			}
+		}
+		b.WriteByte(' ')
+	}
 	// Write the message
 	if len(m.Prefix) > 0 {
 		b.WriteByte(':')
@@ -88,7 +255,7 @@ func (m *Message) Bytes() []byte {
 	b.WriteString(m.Command)
 	for i, arg := range m.Args {
 		b.WriteByte(' ')
-		if i == len(m.Args)-1 && strings.IndexAny(arg, " :") >= 0 {
+		if i == len(m.Args)-1 && (arg == "" || strings.IndexAny(arg, " :") >= 0) {
 			// "escape" the long argument
 			b.WriteByte(':')
 		}
@@ -1,10 +1,13 @@
 package bot
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 var messageTests = []struct {
+	Tags        map[string]string
 	Prefix, Cmd string
 	Args        []string
 	Expect      string
@@ -33,11 +36,43 @@ var messageTests = []struct {
 		Args:   []string{"C", "D"},
 		Expect: ":A B C D\n",
 	},
+	{
+		Prefix: "serv",
+		Cmd:    "005",
+		Args:   []string{"n", "TARGMAX=PRIVMSG:4,JOIN:", "are supported"},
+		Expect: ":serv 005 n TARGMAX=PRIVMSG:4,JOIN: :are supported\n",
+	},
+	{
+		Tags:   map[string]string{TAG_MSGID: "abc", TAG_TIME: "2012-06-30T23:59:59.419Z"},
+		Prefix: "nick!user@host",
+		Cmd:    "PRIVMSG",
+		Args:   []string{"#chan", "hello there"},
+		Expect: "@msgid=abc;time=2012-06-30T23:59:59.419Z :nick!user@host PRIVMSG #chan :hello there\n",
+	},
+	{
+		Tags:   map[string]string{"+example.com/key": "a;b c\\d\r\n"},
+		Cmd:    "TAGMSG",
+		Args:   []string{"#chan"},
+		Expect: "@+example.com/key=a\\:b\\sc\\\\d\\r\\n TAGMSG #chan\n",
+	},
+	{
+		Tags:   map[string]string{"+draft/typing": "", TAG_ACCOUNT: "bob"},
+		Prefix: "a!b@c",
+		Cmd:    "PRIVMSG",
+		Args:   []string{"#chan", "x y"},
+		Expect: "@+draft/typing;account=bob :a!b@c PRIVMSG #chan :x y\n",
+	},
+	{
+		Cmd:    "PRIVMSG",
+		Args:   []string{"#chan", ""},
+		Expect: "PRIVMSG #chan :\n",
+	},
 }
 
 func TestBuildMessage(t *testing.T) {
 	for i, test := range messageTests {
 		m := &Message{
+			Tags:    test.Tags,
 			Prefix:  test.Prefix,
 			Command: test.Cmd,
 			Args:    test.Args,
@@ -51,24 +86,91 @@ func TestBuildMessage(t *testing.T) {
 func TestParseMesage(t *testing.T) {
 	for i, test := range messageTests {
 		m := ParseMessage(test.Expect)
+		if !reflect.DeepEqual(test.Tags, m.Tags) {
+			t.Errorf("%d. tags = %q, want %q", i, m.Tags, test.Tags)
+		}
 		if test.Prefix != m.Prefix {
-			t.Errorf("#d. prefix = %q, want %q", i, m.Prefix, test.Prefix)
+			t.Errorf("%d. prefix = %q, want %q", i, m.Prefix, test.Prefix)
 		}
 		if test.Cmd != m.Command {
-			t.Errorf("#d. command = %q, want %q", i, m.Command, test.Cmd)
+			t.Errorf("%d. command = %q, want %q", i, m.Command, test.Cmd)
 		}
 		if len(test.Args) != len(m.Args) {
-			t.Errorf("#d. args = %v, want %v", i, m.Args, test.Args)
+			t.Errorf("%d. args = %v, want %v", i, m.Args, test.Args)
 		} else {
 			for j := 0; j < len(test.Args) && j < len(m.Args); j++ {
 				if test.Args[j] != m.Args[j] {
-					t.Errorf("#d. arg[%d] = %q, want %q", i, m.Args[j], test.Args[j])
+					t.Errorf("%d. arg[%d] = %q, want %q", i, j, m.Args[j], test.Args[j])
 				}
 			}
 		}
 	}
 }
 
+func TestRoundTrip(t *testing.T) {
+	for i, test := range messageTests {
+		if got, want := ParseMessage(test.Expect).String(), test.Expect; got != want {
+			t.Errorf("%d. round trip = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestUnescapeTag(t *testing.T) {
+	tests := []struct {
+		In, Out string
+	}{
+		{"plain", "plain"},
+		{"a\\:b", "a;b"},
+		{"a\\sb", "a b"},
+		{"a\\\\b", "a\\b"},
+		{"a\\bc", "abc"},
+		{"trailing\\", "trailing"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got, want := UnescapeTag(test.In), test.Out; got != want {
+			t.Errorf("UnescapeTag(%q) = %q, want %q", test.In, got, want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	m := ParseMessage("@a=1;;b;c=;a=2 CMD")
+	want := map[string]string{"a": "2", "b": "", "c": ""}
+	if !reflect.DeepEqual(m.Tags, want) {
+		t.Errorf("tags = %q, want %q", m.Tags, want)
+	}
+	if got, want := m.Command, "CMD"; got != want {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+
+	if m := ParseMessage("@a=1"); m != nil {
+		t.Errorf("tags only = %q, want nil", m)
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	m := ParseMessage("@time=2012-06-30T23:59:59.419Z :n!u@h PRIVMSG #c :hi")
+	got, ok := m.Time()
+	if !ok {
+		t.Fatalf("time missing")
+	}
+	if want := time.Date(2012, 6, 30, 23, 59, 59, 419e6, time.UTC); !got.Equal(want) {
+		t.Errorf("time = %v, want %v", got, want)
+	}
+	if got, want := got.Format(ServerTimeFormat), m.Tags[TAG_TIME]; got != want {
+		t.Errorf("formatted = %q, want %q", got, want)
+	}
+
+	if _, ok := ParseMessage("@time=bogus PING :x").Time(); ok {
+		t.Errorf("bogus time parsed")
+	}
+	if _, ok := ParseMessage("PING :x").Time(); ok {
+		t.Errorf("missing time parsed")
+	}
+}
+
 var parseBench = ":irc.example.com NOTICE user :*** This is a test"
 
 func BenchmarkParseMessage(b *testing.B) {
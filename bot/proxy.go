@@ -0,0 +1,319 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// NetOptions configures how TCP connections to servers are made.
+type NetOptions struct {
+	// Proxy is the URL of the proxy through which to connect, if any:
+	// socks5://[user:pass@]host:port or http://[user:pass@]host:port (for
+	// HTTP CONNECT).  Server names are resolved by the proxy.
+	Proxy string
+
+	// Bind is the local IP address from which to connect, if any.
+	Bind string
+
+	// PreferIPv6 causes IPv6 addresses to be tried before IPv4 addresses
+	// when a name resolves to both.
+	PreferIPv6 bool
+}
+
+// Dial connects to the address (host:port) using the options.  A nil
+// *NetOptions dials directly.
+func (o *NetOptions) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	if o == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	return o.dial(ctx, dialer, addr)
+}
+
+// dial connects to the address using the given dialer and the options.
+func (o *NetOptions) dial(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	if o.Bind != "" {
+		ip := net.ParseIP(o.Bind)
+		if ip == nil {
+			return nil, fmt.Errorf("bind: invalid IP address %q", o.Bind)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if o.Proxy == "" {
+		return o.dialDirect(ctx, dialer, addr)
+	}
+
+	proxy, err := url.Parse(o.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %s", err)
+	}
+	var connect func(conn net.Conn, addr string, user *url.Userinfo) (net.Conn, error)
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		connect = socks5Connect
+	case "http":
+		connect = httpConnect
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme %q", proxy.Scheme)
+	}
+
+	conn, err := o.dialDirect(ctx, dialer, proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %s", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(DialTimeout))
+	}
+	pconn, err := connect(conn, addr, proxy.User)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return pconn, nil
+}
+
+// dialDirect connects to the address, trying IPv6 addresses first if they
+// are preferred.
+func (o *NetOptions) dialDirect(ctx context.Context, dialer *net.Dialer, addr string) (net.Conn, error) {
+	if !o.PreferIPv6 {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(ipv6First(ips))
+
+	err = errors.New("no addresses")
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+type ipv6First []net.IPAddr
+
+func (a ipv6First) Len() int           { return len(a) }
+func (a ipv6First) Less(i, j int) bool { return a[i].IP.To4() == nil && a[j].IP.To4() != nil }
+func (a ipv6First) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// SOCKS5 protocol values (RFC 1928 and RFC 1929)
+const (
+	socksVersion  = 0x05
+	socksNoAuth   = 0x00
+	socksUserPass = 0x02
+	socksConnect  = 0x01
+	socksIPv4     = 0x01
+	socksDomain   = 0x03
+	socksIPv6     = 0x04
+)
+
+var socksErrors = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect
+// to addr.
+func socks5Connect(conn net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portstr)
+	}
+
+	methods := []byte{socksNoAuth}
+	if user != nil {
+		methods = append(methods, socksUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != socksVersion {
+		return nil, fmt.Errorf("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if user == nil {
+			return nil, errors.New("SOCKS5 proxy requires authentication")
+		}
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return nil, errors.New("SOCKS5 username or password too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0 {
+			return nil, errors.New("SOCKS5 authentication failed")
+		}
+	default:
+		return nil, errors.New("no acceptable SOCKS5 authentication methods")
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	switch ip := net.ParseIP(host); {
+	case ip != nil && ip.To4() != nil:
+		req = append(append(req, socksIPv4), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, socksIPv6), ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		req = append(append(req, socksDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if rep := int(head[1]); rep != 0 {
+		if rep < len(socksErrors) {
+			return nil, errors.New(socksErrors[rep])
+		}
+		return nil, fmt.Errorf("SOCKS5 error %d", rep)
+	}
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, err
+		}
+		skip = int(n[0])
+	default:
+		return nil, fmt.Errorf("bad SOCKS5 address type %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn to connect to
+// addr.
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if in.Buffered() > 0 {
+		// The server has already started talking
+		return &bufferedConn{conn, in}, nil
+	}
+	return conn, nil
+}
+
+// A bufferedConn is a connection from which some data has already been read
+// into a buffer.
+type bufferedConn struct {
+	net.Conn
+	in *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+// dialTCP connects to the address with the given dialer and options.
+func dialTCP(ctx context.Context, dialer *net.Dialer, addr string, netOpts *NetOptions, tlsOpts *TLSOptions) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if netOpts == nil {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = netOpts.dial(ctx, dialer, addr)
+	}
+	if err != nil || tlsOpts == nil {
+		return conn, err
+	}
+
+	conf, err := tlsOpts.Config(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tconn := tls.Client(conn, conf)
+	hctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	if err := tconn.HandshakeContext(hctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
@@ -0,0 +1,174 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSOCKS5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	b := New("n", "u")
+	n := &Network{
+		Addrs: []string{"irc.example:6667"},
+		Net:   &NetOptions{Proxy: "socks5://user:pass@" + l.Addr().String()},
+	}
+	if err := b.ConnectNetwork(n); err != nil {
+		t.Fatalf("ConnectNetwork: %s", err)
+	}
+
+	c := accept(t, l)
+	defer c.conn.Close()
+	expect := func(desc string, want ...byte) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c.in, got); err != nil {
+			t.Fatalf("reading %s: %s", desc, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s = %x, want %x", desc, got, want)
+		}
+	}
+	expect("greeting", socksVersion, 2, socksNoAuth, socksUserPass)
+	c.conn.Write([]byte{socksVersion, socksUserPass})
+	expect("auth", append(append([]byte{1, 4}, "user"...), append([]byte{4}, "pass"...)...)...)
+	c.conn.Write([]byte{1, 0})
+	expect("request", append(append([]byte{socksVersion, socksConnect, 0, socksDomain, 11}, "irc.example"...), 0x1A, 0x0B)...)
+	c.conn.Write([]byte{socksVersion, 0, 0, socksIPv4, 10, 0, 0, 1, 0x1A, 0x0B})
+
+	// From here on, the proxy stands in for the server
+	c.Expect("NICK n")
+}
+
+func TestHTTPConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("reading CONNECT: %s", err)
+			return
+		}
+		if got, want := req.Method+" "+req.RequestURI, "CONNECT irc.example:6697"; got != want {
+			t.Errorf("request = %q, want %q", got, want)
+		}
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+		if got := req.Header.Get("Proxy-Authorization"); got != auth {
+			t.Errorf("Proxy-Authorization = %q, want %q", got, auth)
+		}
+		// The server may start talking before we have read the response
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n:serv NOTICE * :hello\r\n")
+		io.Copy(io.Discard, conn)
+	}()
+
+	opts := &NetOptions{Proxy: "http://user:pass@" + l.Addr().String()}
+	conn, err := opts.Dial(context.Background(), "irc.example:6697")
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading: %s", err)
+	}
+	if got, want := line, ":serv NOTICE * :hello\r\n"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestBind(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	opts := &NetOptions{Bind: "127.0.0.1", PreferIPv6: true}
+	conn, err := opts.Dial(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	if got := conn.LocalAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("local address = %s, want 127.0.0.1", got)
+	}
+
+	opts.Bind = "localhost"
+	if _, err := opts.Dial(context.Background(), l.Addr().String()); err == nil {
+		t.Errorf("Dial with bind %q succeeded, want error", opts.Bind)
+	}
+}
+
+func TestIPv6First(t *testing.T) {
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}
+	sort.Stable(ipv6First(ips))
+	var got []string
+	for _, ip := range ips {
+		got = append(got, ip.String())
+	}
+	want := []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sorted = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestAddrNet(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	// The address's own options replace the network's
+	b := New("n", "u")
+	n := &Network{
+		Addrs: []string{"irc.example:6667"},
+		Net:   &NetOptions{Proxy: "http://127.0.0.1:1"},
+		AddrNet: map[string]*NetOptions{
+			"irc.example:6667": {Proxy: "socks5://" + l.Addr().String()},
+		},
+	}
+	if err := b.ConnectNetwork(n); err != nil {
+		t.Fatalf("ConnectNetwork: %s", err)
+	}
+
+	c := accept(t, l)
+	defer c.conn.Close()
+	got := make([]byte, 3)
+	if _, err := io.ReadFull(c.in, got); err != nil {
+		t.Fatalf("reading greeting: %s", err)
+	}
+	if want := []byte{socksVersion, 1, socksNoAuth}; !bytes.Equal(got, want) {
+		t.Errorf("greeting = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,494 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The labeled-response capability, and the batch capability it requires.
+// When both have been negotiated, queries are labeled so that their replies
+// can be told apart from those to other commands.
+const (
+	CAP_BATCH   = "batch"
+	CAP_LABELED = "labeled-response"
+)
+
+// How a message relates to a pending query.
+const (
+	replyNone = iota // not part of the reply
+	replyData        // part of the reply
+	replyEnd         // the last message of the reply
+)
+
+// A query is a command whose reply is being collected.
+type query struct {
+	cmd   string // the command sent
+	key   string // the target of the command, which error replies name
+	match func(m *Message) int
+
+	label string // the label sent with the command, if any
+	batch string // the labeled-response batch, once it has been opened
+
+	// Set before done is closed
+	replies []*Message
+	err     error
+	done    chan struct{}
+}
+
+// add adds the message to the reply if it belongs to it, and returns how it
+// relates to the query.  Error replies end the query.
+func (q *query) add(m *Message, f *ISupport) int {
+	if isErrorNumeric(m.Command) && len(m.Args) > 1 {
+		if q.label != "" || f.EqualFold(m.Args[1], q.key) || strings.EqualFold(m.Args[1], q.cmd) {
+			if q.err == nil {
+				q.err = newNumericError(m)
+			}
+			return replyEnd
+		}
+	}
+	r := q.match(m)
+	if r != replyNone {
+		q.replies = append(q.replies, m)
+	}
+	return r
+}
+
+// query sends the message and waits for its reply, which consists of the
+// messages for which match returns replyData up to the one for which it
+// returns replyEnd.  If the server supports labeled-response, the reply is
+// the labeled response instead.  Error numerics naming key (or the command)
+// are returned as a *NumericError.
+func (s *Server) query(ctx context.Context, m *Message, key string, match func(m *Message) int) ([]*Message, error) {
+	q, m := s.startQuery(m, key, match)
+	if _, err := s.WriteMessage(m); err != nil {
+		s.dropQuery(q)
+		return nil, err
+	}
+	return s.waitQuery(ctx, q)
+}
+
+// startQuery adds a pending query for the message, and returns the message
+// to send, which is labeled if the server supports labeled-response.
+func (s *Server) startQuery(m *Message, key string, match func(m *Message) int) (*query, *Message) {
+	q := &query{
+		cmd:   m.Command,
+		key:   key,
+		match: match,
+		done:  make(chan struct{}),
+	}
+	if s.labeled() {
+		q.label = fmt.Sprintf("q%d", atomic.AddUint32(&s.labels, 1))
+		m = m.Copy()
+		m.SetTag(TAG_LABEL, q.label)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.queries = append(s.queries, q)
+	return q, m
+}
+
+// waitQuery waits for the reply to a query.
+func (s *Server) waitQuery(ctx context.Context, q *query) ([]*Message, error) {
+	select {
+	case <-q.done:
+		return q.replies, q.err
+	case <-ctx.Done():
+		s.dropQuery(q)
+		return nil, ctx.Err()
+	case <-s.done:
+		s.dropQuery(q)
+		return nil, ErrClosed
+	}
+}
+
+// labeled returns true if the server supports labeled-response.
+func (s *Server) labeled() bool {
+	return s.HasCap(CAP_LABELED) && s.HasCap(CAP_BATCH)
+}
+
+// Send writes the message like WriteMessage, and waits until the server has
+// processed it.  If the server rejected it, the error reply is returned as a
+// *NumericError.
+func (s *Server) Send(ctx context.Context, m *Message) error {
+	return s.SendPriority(ctx, m, priority(m))
+}
+
+// SendPriority is like Send, but queues the message with the given priority.
+func (s *Server) SendPriority(ctx context.Context, m *Message, p Priority) error {
+	target := ""
+	if len(m.Args) > 0 {
+		target = m.Args[0]
+	}
+	if s.labeled() {
+		// The reply is the error, an ACK, or something else (an echo, etc)
+		q, m := s.startQuery(m, target, func(m *Message) int { return replyNone })
+		if _, err := s.WritePriority(m, p); err != nil {
+			s.dropQuery(q)
+			return err
+		}
+		_, err := s.waitQuery(ctx, q)
+		return err
+	}
+
+	// The server replies in order, so any error will arrive before the PONG
+	// to a PING sent after the message.
+	token := fmt.Sprintf("send%d", atomic.AddUint32(&s.labels, 1))
+	q, m := s.startQuery(m, target, func(m *Message) int {
+		if m.Command == CMD_PONG && len(m.Args) > 0 && m.Args[len(m.Args)-1] == token {
+			return replyEnd
+		}
+		return replyNone
+	})
+	if _, err := s.WritePriority(m, p); err != nil {
+		s.dropQuery(q)
+		return err
+	}
+	// Queue the PING with the message's target, so it is sent after it
+	ping := NewMessage("", CMD_PING, token)
+	if _, err := s.queueLines(p, m, ping.Bytes()); err != nil {
+		s.dropQuery(q)
+		return err
+	}
+	_, err := s.waitQuery(ctx, q)
+	return err
+}
+
+// dropQuery stops waiting for the reply to a query.
+func (s *Server) dropQuery(q *query) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, pending := range s.queries {
+		if pending == q {
+			s.queries = append(s.queries[:i], s.queries[i+1:]...)
+			return
+		}
+	}
+}
+
+// finishQuery completes a query.  The server lock must be held.
+func (s *Server) finishQuery(q *query) {
+	for i, pending := range s.queries {
+		if pending == q {
+			s.queries = append(s.queries[:i], s.queries[i+1:]...)
+			close(q.done)
+			return
+		}
+	}
+}
+
+// findQuery returns the pending query for which f returns true, or nil.  The
+// server lock must be held.
+func (s *Server) findQuery(f func(q *query) bool) *query {
+	for _, q := range s.queries {
+		if f(q) {
+			return q
+		}
+	}
+	return nil
+}
+
+// answer passes an incoming message to the query it is a reply to, if any.
+func (s *Server) answer(m *Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.queries) == 0 {
+		return
+	}
+
+	if label, ok := m.Tag(TAG_LABEL); ok {
+		q := s.findQuery(func(q *query) bool { return q.label == label })
+		if q == nil {
+			return
+		}
+		switch {
+		case m.Command == CMD_BATCH && len(m.Args) > 1 && strings.HasPrefix(m.Args[0], "+") && m.Args[1] == CAP_LABELED:
+			q.batch = m.Args[0][1:]
+		case m.Command == CMD_ACK:
+			s.finishQuery(q)
+		default:
+			// A reply consisting of a single message
+			q.add(m, s.isupport)
+			s.finishQuery(q)
+		}
+		return
+	}
+	if ref, ok := m.Tag(TAG_BATCH); ok {
+		if q := s.findQuery(func(q *query) bool { return q.batch == ref }); q != nil {
+			q.add(m, s.isupport)
+		}
+		return
+	}
+	if m.Command == CMD_BATCH && len(m.Args) > 0 && strings.HasPrefix(m.Args[0], "-") {
+		ref := m.Args[0][1:]
+		if q := s.findQuery(func(q *query) bool { return q.batch != "" && q.batch == ref }); q != nil {
+			s.finishQuery(q)
+		}
+		return
+	}
+
+	// Without labels, replies arrive in the order the commands were sent
+	for _, q := range s.queries {
+		if q.label != "" {
+			continue
+		}
+		switch q.add(m, s.isupport) {
+		case replyData:
+			return
+		case replyEnd:
+			s.finishQuery(q)
+			return
+		}
+	}
+}
+
+// WhoisInfo is the reply to a WHOIS query.
+type WhoisInfo struct {
+	Nick     string
+	User     string
+	Host     string
+	Realname string
+
+	Server     string
+	ServerInfo string
+
+	Channels []string // with their status prefixes (e.g. "@#chan")
+	Account  string   // the services account, if logged in
+	Away     string   // the away message, if away
+	Operator bool
+	Secure   bool // connected using TLS
+
+	Idle   time.Duration
+	SignOn time.Time
+}
+
+// Whois looks up the user with the given nick.
+func (s *Server) Whois(ctx context.Context, nick string) (*WhoisInfo, error) {
+	replies, err := s.query(ctx, NewMessage("", CMD_WHOIS, nick), nick, func(m *Message) int {
+		if len(m.Args) < 2 || !s.isupport.EqualFold(m.Args[1], nick) {
+			return replyNone
+		}
+		switch m.Command {
+		case RPL_AWAY, RPL_WHOISUSER, RPL_WHOISSERVER, RPL_WHOISOPERATOR,
+			RPL_WHOISIDLE, RPL_WHOISCHANNELS, RPL_WHOISACCOUNT, RPL_WHOISSECURE:
+			return replyData
+		case RPL_ENDOFWHOIS:
+			return replyEnd
+		}
+		return replyNone
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &WhoisInfo{Nick: nick}
+	for _, m := range replies {
+		args := m.Args[1:]
+		switch m.Command {
+		case RPL_WHOISUSER:
+			// :server 311 me nick user host * :realname
+			if len(args) > 4 {
+				info.Nick, info.User, info.Host, info.Realname = args[0], args[1], args[2], args[4]
+			}
+		case RPL_WHOISSERVER:
+			// :server 312 me nick server :info
+			if len(args) > 2 {
+				info.Server, info.ServerInfo = args[1], args[2]
+			}
+		case RPL_WHOISOPERATOR:
+			info.Operator = true
+		case RPL_WHOISSECURE:
+			info.Secure = true
+		case RPL_WHOISIDLE:
+			// :server 317 me nick idle [signon] :seconds idle[, signon time]
+			if len(args) > 2 {
+				idle, _ := strconv.Atoi(args[1])
+				info.Idle = time.Duration(idle) * time.Second
+			}
+			if len(args) > 3 {
+				if signon, err := strconv.ParseInt(args[2], 10, 64); err == nil {
+					info.SignOn = time.Unix(signon, 0)
+				}
+			}
+		case RPL_WHOISCHANNELS:
+			// :server 319 me nick :@#chan +#other...
+			if len(args) > 1 {
+				info.Channels = append(info.Channels, strings.Fields(args[1])...)
+			}
+		case RPL_WHOISACCOUNT:
+			// :server 330 me nick account :is logged in as
+			if len(args) > 1 {
+				info.Account = args[1]
+			}
+		case RPL_AWAY:
+			// :server 301 me nick :away message
+			if len(args) > 1 {
+				info.Away = args[1]
+			}
+		}
+	}
+	return info, nil
+}
+
+// WhoReply is an entry in the reply to a WHO query.
+type WhoReply struct {
+	Channel  string // a channel the user is in, or "*"
+	User     string
+	Host     string
+	Server   string
+	Nick     string
+	Flags    string // H (here) or G (gone), followed by * for operators and status prefixes
+	Hops     int
+	Realname string
+}
+
+// Who lists the users matching the mask, which may be a channel.
+func (s *Server) Who(ctx context.Context, mask string) ([]WhoReply, error) {
+	replies, err := s.query(ctx, NewMessage("", CMD_WHO, mask), mask, func(m *Message) int {
+		switch {
+		case m.Command == RPL_WHOREPLY:
+			return replyData
+		case m.Command == RPL_ENDOFWHO && len(m.Args) > 1 && s.isupport.EqualFold(m.Args[1], mask):
+			return replyEnd
+		}
+		return replyNone
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var who []WhoReply
+	for _, m := range replies {
+		// :server 352 me #chan user host server nick flags :hops realname
+		if m.Command != RPL_WHOREPLY || len(m.Args) < 8 {
+			continue
+		}
+		w := WhoReply{
+			Channel:  m.Args[1],
+			User:     m.Args[2],
+			Host:     m.Args[3],
+			Server:   m.Args[4],
+			Nick:     m.Args[5],
+			Flags:    m.Args[6],
+			Realname: m.Args[7],
+		}
+		if sp := strings.IndexByte(w.Realname, ' '); sp >= 0 {
+			w.Hops, _ = strconv.Atoi(w.Realname[:sp])
+			w.Realname = w.Realname[sp+1:]
+		}
+		who = append(who, w)
+	}
+	return who, nil
+}
+
+// Names lists the members of a channel.
+func (s *Server) Names(ctx context.Context, channel string) ([]Member, error) {
+	replies, err := s.query(ctx, NewMessage("", CMD_NAMES, channel), channel, func(m *Message) int {
+		switch {
+		case m.Command == RPL_NAMREPLY && len(m.Args) > 3 && s.isupport.EqualFold(m.Args[2], channel):
+			return replyData
+		case m.Command == RPL_ENDOFNAMES && len(m.Args) > 1 && s.isupport.EqualFold(m.Args[1], channel):
+			return replyEnd
+		}
+		return replyNone
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	modes, prefixes := s.isupport.Prefix()
+	var members []Member
+	for _, m := range replies {
+		// :server 353 me = #chan :[@]nick [+]nick...
+		if m.Command != RPL_NAMREPLY {
+			continue
+		}
+		for _, name := range strings.Fields(m.Args[3]) {
+			if member, ok := parseMember(name, modes, prefixes); ok {
+				members = append(members, member)
+			}
+		}
+	}
+	return members, nil
+}
+
+// ListEntry is an entry in the reply to a LIST query.
+type ListEntry struct {
+	Channel string
+	Users   int
+	Topic   string
+}
+
+// List lists the channels matching the mask, or all channels if the mask is
+// empty.
+func (s *Server) List(ctx context.Context, mask string) ([]ListEntry, error) {
+	m := NewMessage("", CMD_LIST)
+	if mask != "" {
+		m.Args = append(m.Args, mask)
+	}
+	replies, err := s.query(ctx, m, mask, func(m *Message) int {
+		switch m.Command {
+		case RPL_LISTSTART, RPL_LIST:
+			return replyData
+		case RPL_LISTEND:
+			return replyEnd
+		}
+		return replyNone
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var list []ListEntry
+	for _, m := range replies {
+		// :server 322 me #chan users :topic
+		if m.Command != RPL_LIST || len(m.Args) < 3 {
+			continue
+		}
+		e := ListEntry{Channel: m.Args[1]}
+		e.Users, _ = strconv.Atoi(m.Args[2])
+		if len(m.Args) > 3 {
+			e.Topic = m.Args[3]
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// Mode looks up the modes of a channel, or of the bot itself.  The mode
+// string (e.g. "+ntk") is returned with the parameters of the modes which
+// have them.
+func (s *Server) Mode(ctx context.Context, target string) (modes string, params []string, err error) {
+	isChan := s.IsChannel(target)
+	replies, err := s.query(ctx, NewMessage("", CMD_MODE, target), target, func(m *Message) int {
+		switch {
+		case isChan && m.Command == RPL_CHANNELMODEIS && len(m.Args) > 2 && s.isupport.EqualFold(m.Args[1], target):
+			return replyEnd
+		case !isChan && m.Command == RPL_UMODEIS && len(m.Args) > 1:
+			return replyEnd
+		}
+		return replyNone
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, m := range replies {
+		switch m.Command {
+		case RPL_CHANNELMODEIS:
+			// :server 324 me #chan +modes [params...]
+			return m.Args[2], m.Args[3:], nil
+		case RPL_UMODEIS:
+			// :server 221 me +modes
+			return m.Args[1], nil, nil
+		}
+	}
+	return "", nil, fmt.Errorf("bot: no reply to MODE %s", target)
+}
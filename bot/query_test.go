@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expectLine waits for the server to write the given line.
+func (c *testConn) expectLine(want string) {
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case line := <-c.lines:
+			if line == want {
+				return
+			}
+			c.t.Logf("skipping %q", line)
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestQueries(t *testing.T) {
+	b := New("n", "u")
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Send(":serv 001 n :Welcome")
+	c.Sync()
+
+	ctx := context.Background()
+
+	// Replies to other queries and unrelated numerics are ignored
+	whois := make(chan *WhoisInfo)
+	go func() {
+		info, err := c.serv.Whois(ctx, "Someone")
+		if err != nil {
+			t.Errorf("Whois: %s", err)
+		}
+		whois <- info
+	}()
+	c.expectLine("WHOIS Someone")
+	c.Send(
+		":serv 311 n someone user host * :Real Name",
+		":serv 311 n other x y * :Other",
+		":serv 319 n someone :@#chan #other",
+		":serv 317 n someone 42 1600000000 :seconds idle, signon time",
+		":serv 330 n someone acct :is logged in as",
+		":serv 318 n someone :End of /WHOIS list.",
+	)
+	want := &WhoisInfo{
+		Nick:     "someone",
+		User:     "user",
+		Host:     "host",
+		Realname: "Real Name",
+		Channels: []string{"@#chan", "#other"},
+		Account:  "acct",
+		Idle:     42 * time.Second,
+		SignOn:   time.Unix(1600000000, 0),
+	}
+	if got := <-whois; !reflect.DeepEqual(got, want) {
+		t.Errorf("Whois:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	// Errors naming the target fail the query
+	go func() {
+		_, err := c.serv.Whois(ctx, "nobody")
+		if e, ok := err.(*NumericError); !ok || e.Numeric != ERR_NOSUCHNICK || e.Target != "nobody" {
+			t.Errorf("Whois(nobody) error = %#v, want ERR_NOSUCHNICK", err)
+		}
+		whois <- nil
+	}()
+	c.expectLine("WHOIS nobody")
+	c.Send(":serv 401 n nobody :No such nick/channel")
+	<-whois
+
+	names := make(chan []Member)
+	go func() {
+		members, err := c.serv.Names(ctx, "#chan")
+		if err != nil {
+			t.Errorf("Names: %s", err)
+		}
+		names <- members
+	}()
+	c.expectLine("NAMES #chan")
+	c.Send(
+		":serv 353 n = #chan :@op +voice",
+		":serv 353 n = #chan :plain",
+		":serv 366 n #chan :End of /NAMES list.",
+	)
+	wantNames := []Member{{"op", "o"}, {"voice", "v"}, {"plain", ""}}
+	if got := <-names; !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("Names = %v, want %v", got, wantNames)
+	}
+
+	// Queries can be cancelled
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.serv.List(cctx, "#nothing"); err != context.DeadlineExceeded {
+		t.Errorf("List with timeout = %v, want %v", err, context.DeadlineExceeded)
+	}
+	c.serv.lock.RLock()
+	if n := len(c.serv.queries); n != 0 {
+		t.Errorf("%d queries pending after timeout", n)
+	}
+	c.serv.lock.RUnlock()
+}
+
+func TestLabeledQueries(t *testing.T) {
+	b := New("n", "u")
+	b.RequestCap(CAP_BATCH, CAP_LABELED)
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Send(
+		":serv CAP * LS :batch labeled-response",
+		":serv CAP * ACK :batch labeled-response",
+		":serv 001 n :Welcome",
+	)
+	c.Sync()
+
+	ctx := context.Background()
+	type result struct {
+		who []WhoReply
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		who, err := c.serv.Who(ctx, "#chan")
+		done <- result{who, err}
+	}()
+	c.expectLine("@label=q1 WHO #chan")
+	c.Send(
+		// An unlabeled reply to someone else's WHO is not part of ours
+		":serv 352 n #chan x y serv z H :0 Z",
+		":serv 315 n #chan :End of /WHO list.",
+		"@label=q1 :serv BATCH +b1 labeled-response",
+		"@batch=b1 :serv 352 n #chan user host serv nick H@ :3 Real Name",
+		"@batch=b1 :serv 315 n #chan :End of /WHO list.",
+		":serv BATCH -b1",
+	)
+	want := []WhoReply{{
+		Channel:  "#chan",
+		User:     "user",
+		Host:     "host",
+		Server:   "serv",
+		Nick:     "nick",
+		Flags:    "H@",
+		Hops:     3,
+		Realname: "Real Name",
+	}}
+	if got := <-done; got.err != nil || !reflect.DeepEqual(got.who, want) {
+		t.Errorf("Who = %+v, %v, want %+v", got.who, got.err, want)
+	}
+
+	modes := make(chan error)
+	go func() {
+		_, _, err := c.serv.Mode(ctx, "#secret")
+		modes <- err
+	}()
+	c.expectLine("@label=q2 MODE #secret")
+	c.Send("@label=q2 :serv 442 n #secret :You're not on that channel")
+	if err, ok := (<-modes).(*NumericError); !ok || err.Numeric != ERR_NOTONCHANNEL {
+		t.Errorf("Mode error = %v, want ERR_NOTONCHANNEL", err)
+	}
+}
@@ -0,0 +1,186 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recordings hold a server's traffic, one line per message:
+//
+//	# comment
+//	<RFC 3339 time> >> <line received from the server>
+//	<RFC 3339 time> << <line sent to the server>
+//
+// Received lines are recorded exactly as read; sent lines are redacted as
+// they are in the log.
+const (
+	RECORD_IN  = ">>"
+	RECORD_OUT = "<<"
+)
+
+// A Recorder opens the file in which to record a server's traffic.
+type Recorder func(server string) (io.WriteCloser, error)
+
+// SetRecorder causes the traffic of servers connected after the call to be
+// recorded.  A nil recorder stops recording.
+func (b *Bot) SetRecorder(r Recorder) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.recorder = r
+}
+
+// getRecorder returns the bot's recorder.
+func (b *Bot) getRecorder() Recorder {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.recorder
+}
+
+// RecordDir returns a Recorder which records each connection in its own
+// file in dir, named after the server and the time it connected.
+func RecordDir(dir string) Recorder {
+	return func(server string) (io.WriteCloser, error) {
+		name := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`/\:*?"<>| `, r) {
+				return '_'
+			}
+			return r
+		}, server)
+		name += time.Now().Format("-20060102-150405.000") + ".irc"
+		return os.Create(filepath.Join(dir, name))
+	}
+}
+
+// record wraps the connection so that its traffic is recorded, if the bot
+// has a recorder.
+func (b *Bot) record(name string, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	rec := b.getRecorder()
+	if rec == nil {
+		return rwc
+	}
+	w, err := rec(name)
+	if err != nil {
+		log.Printf("[%s] record: %s", name, err)
+		return rwc
+	}
+	fmt.Fprintf(w, "# %s %s\n", name, VERSION)
+	return &recordConn{
+		ReadWriteCloser: rwc,
+		clock:           b.getClock(),
+		redact:          b.redact,
+		w:               w,
+	}
+}
+
+// A recordConn records the lines read from and written to a connection.
+type recordConn struct {
+	io.ReadWriteCloser
+	clock  Clock
+	redact func(*Message) string
+
+	lock    sync.Mutex
+	w       io.WriteCloser
+	in, out []byte // partial lines
+	closed  bool
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.record(RECORD_IN, &c.in, p[:n])
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	// Record first, so that the lines are recorded in the order they are
+	// sent, before anything the server says in reply
+	c.record(RECORD_OUT, &c.out, p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func (c *recordConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.w.Close()
+	}
+	return err
+}
+
+// record writes the complete lines in buf and data to the recording,
+// leaving the rest in buf.
+func (c *recordConn) record(dir string, buf *[]byte, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+
+	*buf = append(*buf, data...)
+	for {
+		nl := bytes.IndexByte(*buf, '\n')
+		if nl < 0 {
+			return
+		}
+		line := strings.TrimRight(string((*buf)[:nl]), "\r")
+		*buf = (*buf)[nl+1:]
+		if line == "" {
+			continue
+		}
+		if dir == RECORD_OUT {
+			if m := ParseMessage(line); m != nil {
+				line = strings.TrimRight(c.redact(m), "\r\n")
+			}
+		}
+		fmt.Fprintf(c.w, "%s %s %s\n", c.clock.Now().UTC().Format(time.RFC3339Nano), dir, line)
+	}
+}
+
+// A recorded line
+type recorded struct {
+	at   time.Time
+	dir  string
+	line string
+}
+
+// readRecording reads the lines of a recording.
+func readRecording(r io.Reader) ([]recorded, error) {
+	var lines []recorded
+	in := bufio.NewReader(r)
+	for num := 1; ; num++ {
+		text, err := in.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return lines, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		text = strings.TrimRight(text, "\r\n")
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 3)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("bot: recording line %d: too few fields", num)
+		}
+		at, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("bot: recording line %d: %s", num, err)
+		}
+		if fields[1] != RECORD_IN && fields[1] != RECORD_OUT {
+			return nil, fmt.Errorf("bot: recording line %d: bad direction %q", num, fields[1])
+		}
+		lines = append(lines, recorded{at, fields[1], fields[2]})
+	}
+}
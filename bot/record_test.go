@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A recording is a buffer which can be closed.
+type recording struct {
+	bytes.Buffer
+	closed chan struct{}
+}
+
+func (r *recording) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func TestRecord(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewVirtualClock(start)
+	rec := &recording{closed: make(chan struct{})}
+
+	b := New("n", "u")
+	b.SetClock(clock)
+	b.SetRecorder(func(server string) (io.WriteCloser, error) {
+		return rec, nil
+	})
+	b.OnConnect(func(e string, s *Server, m *Message) {
+		s.WriteMessage(NewMessage("", CMD_PRIVMSG, "NickServ", "IDENTIFY secret"))
+	})
+	c := newTestConn(t, b)
+	c.expectLine("USER u . . :github.com/kylelemons/blightbot " + VERSION)
+	clock.Advance(time.Second)
+	c.Send(":serv 001 n :Welcome")
+	c.expectLine("PRIVMSG NickServ :IDENTIFY secret")
+	c.Close()
+	<-rec.closed
+
+	want := []string{
+		"# s:p " + VERSION,
+		"2026-01-02T03:04:05Z << NICK n",
+		"2026-01-02T03:04:05Z << USER u . . :github.com/kylelemons/blightbot " + VERSION,
+		"2026-01-02T03:04:06Z >> :serv 001 n :Welcome",
+		"2026-01-02T03:04:06Z << PRIVMSG NickServ :IDENTIFY <redacted>",
+	}
+	got := strings.Split(strings.TrimSpace(rec.String()), "\n")
+	if len(got) > len(want) {
+		got = got[:len(want)] // the test connection's syncs
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recording:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	recording := strings.Join([]string{
+		"# irc.example " + VERSION,
+		"2026-01-02T03:04:05Z << NICK n",
+		"2026-01-02T03:04:05Z << USER u . . :github.com/kylelemons/blightbot " + VERSION,
+		"2026-01-02T03:04:06Z >> :serv 001 n :Welcome",
+		"2026-01-02T03:04:06Z << JOIN #chan",
+		"2026-01-02T03:04:07Z >> :n!u@h JOIN #chan",
+		"2026-01-02T03:05:05Z << PING :blight-bot-1",
+		"2026-01-02T03:05:06Z >> :serv PONG serv :blight-bot-1",
+		"2026-01-02T03:05:08Z >> :a!u@h TOPIC #chan :hello there",
+		"2026-01-02T03:05:10Z >> :a!u@h PRIVMSG #chan :!topic",
+		"2026-01-02T03:05:10Z << PRIVMSG #chan :a: hello there (a, 03:05:08)",
+	}, "\n")
+
+	b := New("n", "u")
+	b.SetFlood(0, 0)
+	if _, err := b.Replay("irc.example", strings.NewReader(recording)); err == nil {
+		t.Errorf("Replay with the system clock succeeded")
+	}
+	b.SetClock(NewVirtualClock(time.Time{}))
+	b.OnConnect(func(e string, s *Server, m *Message) {
+		s.WriteMessage(NewMessage("", CMD_JOIN, "#chan"))
+	})
+	b.OnCommand(CMD_PRIVMSG, func(e string, s *Server, m *Message) {
+		topic, setter, at := s.GetChannel(m.Args[0]).Topic()
+		s.WriteMessage(NewMessage("", CMD_PRIVMSG, m.Args[0],
+			fmt.Sprintf("%s: %s (%s, %s)", m.ID().Nick, topic, setter, at.Format("15:04:05"))))
+	})
+
+	r, err := b.Replay("irc.example", strings.NewReader(recording))
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	defer r.Close()
+	if err := r.Wait(); err != nil {
+		t.Fatalf("Wait: %s", err)
+	}
+	r.waitSent(len(r.Recorded()))
+	if got, want := r.Sent(), r.Recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replay sent:\n%s\nrecording sent:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got, want := r.Clock().Now(), time.Date(2026, 1, 2, 3, 5, 10, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("clock = %s, want %s", got, want)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(0, 0))
+	late, early := clock.After(2*time.Second), clock.After(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-early:
+		t.Errorf("fired before its time")
+	default:
+	}
+	clock.Advance(time.Second)
+	if got := <-early; !got.Equal(time.Unix(1, 0)) {
+		t.Errorf("early fired with %s, want %s", got, time.Unix(1, 0))
+	}
+	if got := clock.Waiting(); got != 1 {
+		t.Errorf("Waiting() = %d, want 1", got)
+	}
+	clock.Set(time.Unix(10, 0))
+	<-late
+}
@@ -0,0 +1,207 @@
+package bot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The prefix of the PING tokens with which a replay waits for the server to
+// handle each line.
+const replayPrefix = "blight-replay-"
+
+// How long a replay waits for the server to send each line that it sent in
+// the recording, before moving on without it.
+const replayWait = 250 * time.Millisecond
+
+// A Replay feeds a recording (see Recorder) through a Server, so that the
+// bot's handlers see the recorded traffic as they did when it was recorded.
+type Replay struct {
+	serv  *Server
+	clock *VirtualClock
+	conn  net.Conn // our end of the server's connection
+
+	lock     sync.Mutex
+	sent     []string // by the server during the replay, redacted
+	recorded []string // sent in the recording
+
+	synced chan string   // tokens of PONGs to our PINGs
+	more   chan struct{} // signalled when a line is added to sent
+	done   chan struct{}
+	err    error // set before done is closed
+}
+
+// Replay connects a server, with the given name, to the recording.  The
+// lines the server received are sent to it in order, each once it has
+// handled the one before, and the bot's clock (which must be a
+// VirtualClock; see SetClock) is advanced to the time of each recorded line
+// in turn, so timers fire as they did.
+func (b *Bot) Replay(name string, recording io.Reader) (*Replay, error) {
+	clock, ok := b.getClock().(*VirtualClock)
+	if !ok {
+		return nil, errors.New("bot: replay requires a VirtualClock")
+	}
+	lines, err := readRecording(recording)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) > 0 {
+		clock.Set(lines[0].at)
+	}
+
+	local, remote := net.Pipe()
+	r := &Replay{
+		clock:  clock,
+		conn:   local,
+		synced: make(chan string, 1),
+		more:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	for _, l := range lines {
+		if l.dir != RECORD_OUT {
+			continue
+		}
+		if m := ParseMessage(l.line); m != nil {
+			r.recorded = append(r.recorded, strings.TrimRight(b.redact(m), "\r\n"))
+		}
+	}
+	r.serv = b.newServer(name, "", remote)
+	go r.read()
+	go r.feed(lines)
+	return r, nil
+}
+
+// read collects the lines sent by the server.
+func (r *Replay) read() {
+	defer close(r.synced)
+	in := bufio.NewReader(r.conn)
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		m := ParseMessage(strings.TrimRight(line, "\r\n"))
+		if m == nil {
+			continue
+		}
+		if m.Command == CMD_PONG && len(m.Args) > 0 {
+			if token := m.Args[len(m.Args)-1]; strings.HasPrefix(token, replayPrefix) {
+				select {
+				case r.synced <- token:
+				case <-r.done:
+				}
+				continue
+			}
+		}
+		r.lock.Lock()
+		r.sent = append(r.sent, strings.TrimRight(r.serv.bot.redact(m), "\r\n"))
+		r.lock.Unlock()
+
+		select {
+		case r.more <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// feed sends the received lines to the server.
+func (r *Replay) feed(lines []recorded) {
+	defer close(r.done)
+
+	last := -1 // the last received line
+	for i, l := range lines {
+		if l.dir == RECORD_IN {
+			last = i
+		}
+	}
+
+	out := 0 // the number of recorded lines sent so far
+	for i, l := range lines {
+		r.clock.Set(l.at)
+		if l.dir != RECORD_IN {
+			// Let the server catch up, so that its lines are sent at the
+			// same (virtual) time as they were
+			out++
+			r.waitSent(out)
+			continue
+		}
+
+		token := fmt.Sprintf("%s%d", replayPrefix, i)
+		synced := false
+		if _, err := io.WriteString(r.conn, l.line+"\r\n"+"PING :"+token+"\r\n"); err == nil {
+			for got := range r.synced {
+				if got == token {
+					synced = true
+					break
+				}
+			}
+		}
+		if !synced {
+			<-r.serv.Done()
+			if i < last {
+				r.err = fmt.Errorf("bot: server disconnected after %q", l.line)
+			}
+			return
+		}
+	}
+}
+
+// waitSent waits up to replayWait for the server to have sent n lines.
+func (r *Replay) waitSent(n int) {
+	timeout := time.NewTimer(replayWait)
+	defer timeout.Stop()
+	for {
+		r.lock.Lock()
+		sent := len(r.sent)
+		r.lock.Unlock()
+		if sent >= n {
+			return
+		}
+		select {
+		case <-r.more:
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// Wait waits until every line of the recording has been replayed, or the
+// server has disconnected.  It returns an error if the server disconnected
+// before the end of the recording.
+func (r *Replay) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// Server returns the server through which the recording is replayed.
+func (r *Replay) Server() *Server { return r.serv }
+
+// Clock returns the virtual clock, which may be advanced further once the
+// replay is done.
+func (r *Replay) Clock() *VirtualClock { return r.clock }
+
+// Sent returns the lines sent by the server so far, redacted as they would
+// be in a recording.
+func (r *Replay) Sent() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.sent...)
+}
+
+// Recorded returns the lines the server sent in the recording, for
+// comparison with Sent.
+func (r *Replay) Recorded() []string {
+	return append([]string(nil), r.recorded...)
+}
+
+// Close disconnects the server.
+func (r *Replay) Close() error {
+	err := r.conn.Close()
+	<-r.serv.Done()
+	return err
+}
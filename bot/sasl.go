@@ -0,0 +1,228 @@
+package bot
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// SASL mechanisms
+const (
+	SASL_PLAIN    = "PLAIN"
+	SASL_EXTERNAL = "EXTERNAL"
+)
+
+const (
+	CMD_AUTHENTICATE = "AUTHENTICATE"
+
+	// The maximum length of a single AUTHENTICATE payload
+	saslChunk = 400
+)
+
+// SASL holds the credentials with which to authenticate during registration.
+type SASL struct {
+	// Mechanism is one of SASL_PLAIN or SASL_EXTERNAL.
+	Mechanism string
+
+	// User is the account name.  For EXTERNAL, it may be left empty to let
+	// the server choose the account from the client certificate.
+	User string
+
+	// Pass is the account password.  It is not used for EXTERNAL.
+	Pass string
+
+	// Required causes the connection to be aborted if authentication fails
+	// or the server does not support SASL.
+	Required bool
+}
+
+// payload returns the AUTHENTICATE payload for the mechanism.
+func (a *SASL) payload() []byte {
+	switch a.Mechanism {
+	case SASL_PLAIN:
+		return []byte(a.User + "\x00" + a.User + "\x00" + a.Pass)
+	default:
+		return []byte(a.User)
+	}
+}
+
+// SetSASL sets the credentials with which the bot authenticates on servers it
+// connects to.  If sasl is nil, SASL is disabled.
+func (b *Bot) SetSASL(sasl *SASL) {
+	if sasl != nil {
+		b.RequestCap("sasl")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.sasl = sasl
+}
+
+// Account returns the services account the bot is logged into on the server,
+// if any.
+func (s *Server) Account() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.account
+}
+
+// saslConfig returns the SASL configuration of the bot.
+func (s *Server) saslConfig() *SASL {
+	s.bot.lock.RLock()
+	defer s.bot.lock.RUnlock()
+
+	return s.bot.sasl
+}
+
+// saslStart begins authentication.  It is called when the sasl capability is
+// acknowledged during registration.
+func (s *Server) saslStart() {
+	auth := s.saslConfig()
+	if auth == nil || !s.capNeg || s.saslActive {
+		return
+	}
+
+	if mechs, _ := s.CapValue("sasl"); mechs != "" {
+		supported := false
+		for _, mech := range strings.Split(mechs, ",") {
+			if mech == auth.Mechanism {
+				supported = true
+			}
+		}
+		if !supported {
+			s.Log("SASL mechanism %s not supported (server offers %s)", auth.Mechanism, mechs)
+			s.saslDone(false)
+			return
+		}
+	}
+
+	s.saslActive = true
+	s.capHold()
+	s.send(NewMessage("", CMD_AUTHENTICATE, auth.Mechanism))
+}
+
+// saslDone finishes authentication.  If it failed and authentication is
+// required, the connection is closed.
+func (s *Server) saslDone(ok bool) {
+	if s.saslActive {
+		s.saslActive = false
+		defer s.capRelease()
+	}
+
+	auth := s.saslConfig()
+	if ok || auth == nil || !auth.Required {
+		return
+	}
+
+	s.Log("SASL authentication failed, disconnecting")
+	s.send(NewMessage("", CMD_QUIT, "SASL authentication failed"))
+	s.capNeg = false
+	s.conn.Close()
+}
+
+// handleSASL processes AUTHENTICATE messages and the SASL numerics.
+func (s *Server) handleSASL(m *Message) {
+	switch m.Command {
+	case CMD_AUTHENTICATE:
+		auth := s.saslConfig()
+		if !s.saslActive || auth == nil || len(m.Args) < 1 || m.Args[0] != "+" {
+			return
+		}
+		enc := base64.StdEncoding.EncodeToString(auth.payload())
+		for len(enc) >= saslChunk {
+			s.send(NewMessage("", CMD_AUTHENTICATE, enc[:saslChunk]))
+			enc = enc[saslChunk:]
+		}
+		if enc == "" {
+			enc = "+"
+		}
+		s.send(NewMessage("", CMD_AUTHENTICATE, enc))
+	case RPL_LOGGEDIN:
+		// :server 900 <nick> <nick>!<ident>@<host> <account> :<text>
+		if len(m.Args) < 3 {
+			return
+		}
+		s.lock.Lock()
+		s.account = m.Args[2]
+		s.lock.Unlock()
+		s.Log("Logged in as %s", m.Args[2])
+	case RPL_LOGGEDOUT:
+		s.lock.Lock()
+		s.account = ""
+		s.lock.Unlock()
+	case RPL_SASLSUCCESS:
+		s.saslDone(true)
+	case ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED:
+		if len(m.Args) > 1 {
+			s.Log("SASL: %s", m.Args[len(m.Args)-1])
+		}
+		s.saslDone(false)
+	case ERR_SASLALREADY:
+		s.saslDone(true)
+	}
+}
+
+// redact returns the message as a string suitable for logging, with any
+// credentials removed, including the arguments of commands sent to NickServ
+// or to any of the other services given.
+func redact(m *Message, services ...string) string {
+	if m == nil {
+		return "<nil>"
+	}
+
+	hide := -1
+	switch m.Command {
+	case CMD_PASS:
+		hide = 0
+	case CMD_OPER:
+		hide = 1
+	case CMD_AUTHENTICATE:
+		if len(m.Args) > 0 {
+			switch m.Args[0] {
+			case "+", "*", SASL_PLAIN, SASL_EXTERNAL:
+			default:
+				hide = 0
+			}
+		}
+	case CMD_PRIVMSG:
+		if len(m.Args) > 1 && isService(m.Args[0], services) {
+			words := strings.SplitN(m.Args[1], " ", 2)
+			if len(words) > 1 {
+				red := m.Copy()
+				red.Args[1] = words[0] + " <redacted>"
+				return red.String()
+			}
+		}
+	}
+	if hide < 0 || hide >= len(m.Args) {
+		return m.String()
+	}
+
+	red := m.Copy()
+	for i := hide; i < len(red.Args); i++ {
+		red.Args[i] = "<redacted>"
+	}
+	return red.String()
+}
+
+// isService returns true if the target is NickServ or one of the services.
+func isService(target string, services []string) bool {
+	if strings.EqualFold(target, "NickServ") {
+		return true
+	}
+	for _, service := range services {
+		if strings.EqualFold(target, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns the message as redact does, also treating the bot's
+// NickServ service (see SetNickServ) as a service.
+func (b *Bot) redact(m *Message) string {
+	if _, _, ns := b.nickConfig(); ns != nil && ns.Service != "" {
+		return redact(m, ns.Service)
+	}
+	return redact(m)
+}
@@ -0,0 +1,40 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		Msg  *Message
+		Want string
+	}{
+		{NewMessage("", CMD_PASS, "hunter2"), "PASS <redacted>\n"},
+		{NewMessage("", CMD_OPER, "name", "hunter2"), "OPER name <redacted>\n"},
+		{NewMessage("", CMD_AUTHENTICATE, SASL_PLAIN), "AUTHENTICATE PLAIN\n"},
+		{NewMessage("", CMD_AUTHENTICATE, "+"), "AUTHENTICATE +\n"},
+		{NewMessage("", CMD_AUTHENTICATE, "YWNjdABhY2N0AHNlY3JldA=="), "AUTHENTICATE <redacted>\n"},
+		{NewMessage("", CMD_PRIVMSG, "NickServ", "IDENTIFY hunter2"), "PRIVMSG NickServ :IDENTIFY <redacted>\n"},
+		{NewMessage("", CMD_PRIVMSG, "nickserv", "GHOST nick hunter2"), "PRIVMSG nickserv :GHOST <redacted>\n"},
+		{NewMessage("", CMD_PRIVMSG, "#chan", "IDENTIFY hunter2"), "PRIVMSG #chan :IDENTIFY hunter2\n"},
+		{nil, "<nil>"},
+	}
+
+	for _, test := range tests {
+		if got, want := redact(test.Msg), test.Want; got != want {
+			t.Errorf("redact(%q) = %q, want %q", test.Msg, got, want)
+		}
+	}
+}
+
+func TestRedactService(t *testing.T) {
+	b := New("n", "u")
+	msg := NewMessage("", CMD_PRIVMSG, "NickServ@services.example", "REGAIN n hunter2")
+	if got, want := b.redact(msg), "PRIVMSG NickServ@services.example :REGAIN <redacted>\n"; got == want {
+		t.Errorf("redact(%q) = %q before SetNickServ", msg, got)
+	}
+	b.SetNickServ(&NickServ{Service: "NickServ@services.example", Password: "hunter2"})
+	if got, want := b.redact(msg), "PRIVMSG NickServ@services.example :REGAIN <redacted>\n"; got != want {
+		t.Errorf("redact(%q) = %q, want %q", msg, got, want)
+	}
+}
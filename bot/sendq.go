@@ -0,0 +1,386 @@
+package bot
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// A Priority determines the order in which queued messages are sent.
+type Priority int
+
+const (
+	// PriorityImmediate messages bypass the queue and the flood limit.  PONG
+	// and QUIT are always sent immediately.
+	PriorityImmediate Priority = iota
+
+	// PriorityNormal is used for most messages.
+	PriorityNormal
+
+	// PriorityBulk messages are only sent when there are no normal messages
+	// waiting, for instance long command output or announcements.
+	PriorityBulk
+
+	lanes = 2
+)
+
+// Default flood control settings: a burst of 5 lines, and then one line every
+// two seconds.
+const (
+	DefaultFloodBurst    = 5
+	DefaultFloodInterval = 2 * time.Second
+)
+
+// ErrClosed is returned when writing to a server which has disconnected.
+var ErrClosed = errors.New("bot: server connection closed")
+
+// ErrPriority is returned when writing with a Priority which is not one of
+// those above.
+var ErrPriority = errors.New("bot: invalid priority")
+
+// valid returns true if the priority is one of those above.
+func (p Priority) valid() bool {
+	return p >= PriorityImmediate && p <= PriorityBulk
+}
+
+// SetFlood sets the flood control settings for servers which connect after
+// it is called.  Up to burst lines may be sent at once, after which one line
+// is sent every interval.  If interval is zero, flood control is disabled.
+func (b *Bot) SetFlood(burst int, interval time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.floodBurst, b.floodInterval = burst, interval
+}
+
+// QueueStats holds statistics about a server's send queue.
+type QueueStats struct {
+	Depth   int // Total messages waiting to be sent
+	Normal  int // Messages waiting at PriorityNormal
+	Bulk    int // Messages waiting at PriorityBulk
+	Targets int // Distinct targets with messages waiting
+	Sent    int // Messages sent through the queue
+	Dropped int // Messages discarded when the server disconnected
+}
+
+// A bucket is a token bucket for rate limiting.
+type bucket struct {
+	burst    float64
+	interval time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newBucket(burst int, interval time.Duration) *bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{
+		burst:    float64(burst),
+		interval: interval,
+		tokens:   float64(burst),
+	}
+}
+
+// refill adds the tokens which have accumulated since the last call.
+func (b *bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// delay returns how long until a token is available.
+func (b *bucket) delay(now time.Time) time.Duration {
+	if b.interval <= 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(b.interval))
+}
+
+// take consumes a token.  Tokens may be taken when none are available (for
+// messages which bypass the queue), which delays subsequent messages.
+func (b *bucket) take(now time.Time) {
+	if b.interval <= 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens--
+}
+
+// A queued message, already encoded for the wire.
+type queued struct {
+	line   []byte
+	target string
+}
+
+// A lane holds the messages at a single priority, and sends them round-robin
+// among their targets so that one target cannot starve another.
+type lane struct {
+	order   []string
+	pending map[string][]queued
+	depth   int
+}
+
+func (l *lane) push(q queued) {
+	if l.pending == nil {
+		l.pending = map[string][]queued{}
+	}
+	if len(l.pending[q.target]) == 0 {
+		l.order = append(l.order, q.target)
+	}
+	l.pending[q.target] = append(l.pending[q.target], q)
+	l.depth++
+}
+
+func (l *lane) pop() (queued, bool) {
+	if len(l.order) == 0 {
+		return queued{}, false
+	}
+	target := l.order[0]
+	msgs := l.pending[target]
+	q := msgs[0]
+	l.order = l.order[1:]
+	if len(msgs) > 1 {
+		l.pending[target] = msgs[1:]
+		l.order = append(l.order, target)
+	} else {
+		delete(l.pending, target)
+	}
+	l.depth--
+	return q, true
+}
+
+// A sendQueue holds messages waiting to be sent to a server.
+type sendQueue struct {
+	lock   sync.Mutex
+	lanes  [lanes]lane
+	ready  chan bool
+	closed bool
+	sent   int
+	drops  int
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		ready: make(chan bool, 1),
+	}
+}
+
+// push adds lines for the given target to the queue.  The lines will be sent
+// in order, though lines for other targets may be sent between them.
+func (q *sendQueue) push(p Priority, target string, lines ...[]byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	for _, line := range lines {
+		q.lanes[p-PriorityNormal].push(queued{line, target})
+	}
+
+	select {
+	case q.ready <- true:
+	default:
+	}
+	return nil
+}
+
+// pop removes the next message to send from the queue.
+func (q *sendQueue) pop() (queued, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i := range q.lanes {
+		if msg, ok := q.lanes[i].pop(); ok {
+			q.sent++
+			return msg, true
+		}
+	}
+	return queued{}, false
+}
+
+// empty returns true if there are no messages waiting.
+func (q *sendQueue) empty() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i := range q.lanes {
+		if q.lanes[i].depth > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// close discards any waiting messages and causes further pushes to fail.
+func (q *sendQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for i := range q.lanes {
+		q.drops += q.lanes[i].depth
+		q.lanes[i] = lane{}
+	}
+	close(q.ready)
+}
+
+func (q *sendQueue) stats() QueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	st := QueueStats{
+		Normal:  q.lanes[0].depth,
+		Bulk:    q.lanes[1].depth,
+		Sent:    q.sent,
+		Dropped: q.drops,
+	}
+	st.Depth = st.Normal + st.Bulk
+	targets := map[string]bool{}
+	for i := range q.lanes {
+		for t := range q.lanes[i].pending {
+			targets[t] = true
+		}
+	}
+	st.Targets = len(targets)
+	return st
+}
+
+// QueueStats returns statistics about the server's send queue.
+func (s *Server) QueueStats() QueueStats {
+	return s.sendq.stats()
+}
+
+// QueueDepth returns the number of messages waiting to be sent.
+func (s *Server) QueueDepth() int {
+	return s.sendq.stats().Depth
+}
+
+// sender sends queued messages to the server, subject to flood control.
+func (s *Server) sender() {
+	for {
+		if s.sendq.empty() {
+			if _, ok := <-s.sendq.ready; !ok {
+				return
+			}
+			continue
+		}
+
+		// Wait for a token before choosing the message, so that a normal
+		// message queued in the meantime goes before a bulk one.
+		for {
+			s.wlock.Lock()
+			d := s.flood.delay(s.clock.Now())
+			s.wlock.Unlock()
+			if d <= 0 {
+				break
+			}
+			<-s.clock.After(d)
+		}
+
+		msg, ok := s.sendq.pop()
+		if !ok {
+			continue
+		}
+		if _, err := s.writeRaw(msg.line); err != nil {
+			s.Log("write: %s", err)
+		}
+	}
+}
+
+// writeRaw writes the line to the connection, counting it against the flood
+// limit.  It is safe to call from multiple goroutines.
+func (s *Server) writeRaw(line []byte) (int, error) {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	if s.link != nil {
+		line = s.link.ping(line)
+	}
+	s.flood.take(s.clock.Now())
+	return s.conn.Write(line)
+}
+
+// queueLines writes the encoded lines, which are all for the same target as
+// m, to the server at the given priority.
+func (s *Server) queueLines(p Priority, m *Message, lines ...[]byte) (int, error) {
+	if !p.valid() {
+		return 0, ErrPriority
+	}
+	lines = s.encode(m, lines)
+	n := 0
+	if p == PriorityImmediate {
+		for _, line := range lines {
+			w, err := s.writeRaw(line)
+			n += w
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+
+	// Messages are grouped by their first argument, which for most messages
+	// that are likely to be queued (PRIVMSG, NOTICE, MODE, etc) is the
+	// target.
+	target := ""
+	if m != nil && len(m.Args) > 0 {
+		target = s.ToLower(m.Args[0])
+	}
+	if err := s.sendq.push(p, target, lines...); err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		n += len(line)
+	}
+	return n, nil
+}
+
+// priority returns the default priority of the message.
+func priority(m *Message) Priority {
+	switch m.Command {
+	case CMD_PONG, CMD_QUIT:
+		return PriorityImmediate
+	}
+	return PriorityNormal
+}
+
+// WritePriority writes the message to the server at the given priority.
+// PRIVMSG and NOTICE messages which are too long for one line are split (see
+// SplitText), or sent as a multiline batch if the server supports it.  An
+// invalid priority returns ErrPriority.
+func (s *Server) WritePriority(m *Message, p Priority) (int, error) {
+	if !p.valid() {
+		return 0, ErrPriority
+	}
+	m = s.outgoing(m)
+	msgs := s.split(m)
+	if s.link != nil {
+		var ts6 []*Message
+		for _, msg := range msgs {
+			ts6 = append(ts6, s.link.outgoing(msg)...)
+		}
+		msgs = ts6
+	}
+	lines := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		if s.bot.LogLevel > 3 {
+			log.Printf("<< %s", s.bot.redact(msg))
+		}
+		lines[i] = msg.Bytes()
+	}
+	return s.queueLines(p, m, lines...)
+}
@@ -0,0 +1,149 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSendQueueOrder(t *testing.T) {
+	q := newSendQueue()
+	for _, m := range []struct {
+		pri    Priority
+		target string
+		line   string
+	}{
+		{PriorityBulk, "#c", "c1"},
+		{PriorityNormal, "#a", "a1"},
+		{PriorityNormal, "#a", "a2"},
+		{PriorityNormal, "#a", "a3"},
+		{PriorityNormal, "#b", "b1"},
+		{PriorityBulk, "#c", "c2"},
+		{PriorityNormal, "#b", "b2"},
+	} {
+		if err := q.push(m.pri, m.target, []byte(m.line)); err != nil {
+			t.Fatalf("push(%q): %s", m.line, err)
+		}
+	}
+
+	if got, want := q.stats(), (QueueStats{Depth: 7, Normal: 5, Bulk: 2, Targets: 3}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	var got []string
+	for {
+		m, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, string(m.line))
+	}
+	if want := []string{"a1", "b1", "a2", "b2", "a3", "c1", "c2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	q.push(PriorityNormal, "", []byte("lost"))
+	q.close()
+	if err := q.push(PriorityNormal, "", []byte("late")); err != ErrClosed {
+		t.Errorf("push after close = %v, want %v", err, ErrClosed)
+	}
+	if got, want := q.stats(), (QueueStats{Sent: 7, Dropped: 1}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := newBucket(2, 2*time.Second)
+
+	steps := []struct {
+		at    time.Duration
+		take  int
+		delay time.Duration
+	}{
+		{0, 0, 0},
+		{0, 2, 2 * time.Second},
+		{1 * time.Second, 0, 1 * time.Second},
+		{2 * time.Second, 1, 2 * time.Second},
+		{10 * time.Second, 0, 0},
+		{10 * time.Second, 2, 2 * time.Second},
+		{10 * time.Second, 1, 4 * time.Second}, // bypassing the queue
+	}
+	for _, step := range steps {
+		now := start.Add(step.at)
+		for i := 0; i < step.take; i++ {
+			b.take(now)
+		}
+		if got, want := b.delay(now), step.delay; got != want {
+			t.Errorf("at %s after taking %d: delay = %s, want %s", step.at, step.take, got, want)
+		}
+	}
+
+	if d := newBucket(1, 0).delay(start); d != 0 {
+		t.Errorf("unlimited delay = %s, want 0", d)
+	}
+}
+
+func TestFlood(t *testing.T) {
+	b := New("n", "u")
+	c := newTestConn(t, b)
+	defer c.Close()
+	c.Sync()
+
+	// Flood control is disabled by newTestConn, so set it up by hand, with
+	// the burst already used up so that everything is queued.
+	start := time.Now()
+	c.serv.wlock.Lock()
+	c.serv.flood = newBucket(2, 50*time.Millisecond)
+	c.serv.flood.take(start)
+	c.serv.flood.take(start)
+	c.serv.wlock.Unlock()
+
+	c.serv.WriteMessage(NewMessage("", CMD_QUIT, "bye"))
+	for i := 0; i < 3; i++ {
+		c.serv.WriteMessage(NewMessage("", CMD_PRIVMSG, "#a", "spam"))
+	}
+	c.serv.WriteMessage(NewMessage("", CMD_PRIVMSG, "#b", "hello"))
+
+	var got []string
+	for len(got) < 5 {
+		select {
+		case line := <-c.lines:
+			got = append(got, line)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timed out; got %q", got)
+		}
+	}
+	want := []string{
+		"QUIT bye",
+		"PRIVMSG #a spam",
+		"PRIVMSG #b hello",
+		"PRIVMSG #a spam",
+		"PRIVMSG #a spam",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	// QUIT bypasses the queue, but still delays the messages after it
+	if elapsed, min := time.Since(start), 200*time.Millisecond; elapsed < min {
+		t.Errorf("sent in %s, want at least %s", elapsed, min)
+	}
+	if got, want := c.serv.QueueDepth(), 0; got != want {
+		t.Errorf("queue depth = %d, want %d", got, want)
+	}
+}
+
+func TestWritePriorityInvalid(t *testing.T) {
+	b := New("n", "u")
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	for _, p := range []Priority{PriorityImmediate - 1, PriorityBulk + 1} {
+		if _, err := c.serv.WritePriority(NewMessage("", CMD_PRIVMSG, "#a", "hi"), p); err != ErrPriority {
+			t.Errorf("WritePriority(%d) = %v, want %v", p, err, ErrPriority)
+		}
+	}
+	c.serv.WritePriority(NewMessage("", CMD_PRIVMSG, "#a", "ok"), PriorityBulk)
+	c.expectLine("PRIVMSG #a ok")
+}
@@ -2,17 +2,26 @@ package bot
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	ReadChannelBuffer = 32
+	DialTimeout       = 30 * time.Second
+
+	// How long to wait for the server to close the connection after QUIT
+	QuitTimeout = 5 * time.Second
+
+	// The quit message used when the bot is closed
+	QuitMessage = "github.com/kylelemons/blightbot " + VERSION
 )
 
 type Server struct {
@@ -21,41 +30,177 @@ type Server struct {
 	name string
 	pass string
 	conn io.ReadWriteCloser
-	pong chan bool
+	pong chan string // tokens of PONGs to pingloop
+
+	// Outgoing messages
+	sendq   *sendQueue
+	wlock   sync.Mutex
+	flood   *bucket // protected by wlock
+	batches uint32  // atomic
+	labels  uint32  // atomic
+
+	isupport *ISupport
+	clock    Clock
+	enc      *Encoding // set when started
 
 	lock     sync.RWMutex
 	channels map[string]*Channel
-
-	inc chan *Message
+	users    map[string]*User
+	capAvail map[string]string
+	caps     map[string]string
+	account  string
+	host     string
+	queries  []*query // pending, in the order they were sent
+
+	// Set before the server is started
+	network *Network
+	rejoin  []string
+	link    *linkState // for server links
+
+	// Only accessed by manage
+	registered bool
+	capNeg     bool
+	capHolds   int
+	saslActive bool
+	nickTry    int  // refused nicks during registration
+	ghosted    bool // asked services for our nick
+	monitoring bool // watching our nick with MONITOR
+	regaining  bool // regainloop is running
+
+	// Lag measurement, protected by lock
+	lag     time.Duration   // round trip time of the last PING
+	lags    []time.Duration // recent round trip times, oldest first
+	pingAt  time.Time       // when the unanswered PING was sent, if any
+	lagging bool            // whether ON_LAG last reported lag
+
+	quit int32 // atomic; set once Quit has been called
+	inc  chan inbound
+	evs  chan inbound // events from other goroutines, for manage
+	done chan struct{}
 }
 
-func (s *Server) Bot() *Bot     { return s.bot }
-func (s *Server) ID() *Identity { return s.id }
-func (s *Server) Name() string  { return s.name }
+func (s *Server) Bot() *Bot    { return s.bot }
+func (s *Server) Name() string { return s.name }
+
+// ID returns a copy of the bot's identity on this server.
+func (s *Server) ID() *Identity {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	id := *s.id
+	return &id
+}
 
 func (s *Server) Me(id *Identity) bool {
-	return id.Nick == s.id.Nick
+	return s.isupport.EqualFold(id.Nick, s.Nick())
 }
 
-func (b *Bot) newServer(name, pass string, rwc io.ReadWriteCloser) {
-	s := &Server{
+func (b *Bot) newServer(name, pass string, rwc io.ReadWriteCloser) *Server {
+	s := b.initServer(name, pass, rwc)
+	s.start()
+	return s
+}
+
+// initServer returns a new Server for the connection, which must be started
+// before use.
+func (b *Bot) initServer(name, pass string, rwc io.ReadWriteCloser) *Server {
+	rwc = b.record(name, rwc)
+	return &Server{
 		bot:      b,
-		id:       b.id,
+		id:       &Identity{Nick: b.id.Nick, User: b.id.User}, // each server tracks its own nick
 		name:     name,
 		pass:     pass,
-		pong:     make(chan bool, 1),
+		pong:     make(chan string, 1),
 		conn:     rwc,
-		inc:      make(chan *Message, 32),
+		inc:      make(chan inbound, 32),
+		evs:      make(chan inbound, 8),
 		channels: map[string]*Channel{},
+		users:    map[string]*User{},
+		isupport: new(ISupport),
+		clock:    b.getClock(),
+		sendq:    newSendQueue(),
+		capAvail: map[string]string{},
+		caps:     map[string]string{},
+		done:     make(chan struct{}),
 	}
+}
 
+// start adds the server to the bot and starts processing messages.  If the
+// bot has been closed, the connection is closed immediately.
+func (s *Server) start() {
+	b := s.bot
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	if b.ctx.Err() != nil {
+		atomic.StoreInt32(&s.quit, 1)
+		s.conn.Close()
+	}
 	b.servers = append(b.servers, s)
+	s.flood = newBucket(b.floodBurst, b.floodInterval)
+	if s.link != nil {
+		// Server links are not flood limited
+		s.flood = newBucket(b.floodBurst, 0)
+	}
+	s.enc = b.encoding
+	if s.network != nil && s.network.Encoding != nil {
+		s.enc = s.network.Encoding
+	}
+	if s.enc == nil {
+		s.enc = new(Encoding)
+	}
 
 	go s.manage()
+	go s.sender()
 	go s.reader()
-	go s.pingloop()
+	go s.pingloop(s.clock.After(b.ping))
+}
+
+// stopped removes the server from the bot once it has disconnected.
+func (s *Server) stopped() {
+	b := s.bot
+	b.lock.Lock()
+	for i, serv := range b.servers {
+		if serv == s {
+			b.servers = append(b.servers[:i], b.servers[i+1:]...)
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	s.trigger(ON_DISCONNECT, nil)
+	close(s.done)
+}
+
+// Done returns a channel which is closed when the server disconnects.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Quit sends QUIT to the server (bypassing the send queue) and waits for the
+// server to close the connection, closing it ourselves if the server takes
+// longer than QuitTimeout.  If the server belongs to a network, the bot does
+// not reconnect.
+func (s *Server) Quit(reason string) error {
+	atomic.StoreInt32(&s.quit, 1)
+
+	msg := NewMessage("", CMD_QUIT)
+	if reason != "" {
+		msg.Args = append(msg.Args, reason)
+	}
+	_, err := s.send(msg)
+
+	select {
+	case <-s.done:
+	case <-s.clock.After(QuitTimeout):
+		s.conn.Close()
+		<-s.done
+	}
+	return err
+}
+
+// quitting returns true if Quit has been called.
+func (s *Server) quitting() bool {
+	return atomic.LoadInt32(&s.quit) != 0
 }
 
 func (b *Bot) Connect(server string) error {
@@ -85,135 +230,233 @@ func (b *Bot) ConnectPass(server, pass string) error {
 	return nil
 }
 
-func (s *Server) pingloop() {
+// pingloop sends a PING when next fires, and then each ping interval after
+// the PONG to the last.
+func (s *Server) pingloop(next <-chan time.Time) {
 	defer func() {
 		s.conn.Close()
 	}()
 
 	ping, timeout := s.bot.ping, s.bot.timeout
 
-	message := []byte("PING :blight-bot\n")
-	for {
-		time.Sleep(ping)
-		if _, err := s.conn.Write(message); err != nil {
-			log.Printf("ping: %s")
+	for seq := 1; ; seq++ {
+		select {
+		case <-next:
+		case <-s.done:
 			return
 		}
-		select {
-		case <-s.pong:
-		case <-time.After(timeout):
-			io.WriteString(s.conn, "QUIT :ping time exceeded\n")
-			time.Sleep(1 * time.Second)
+
+		token := fmt.Sprintf("%s%d", pingPrefix, seq)
+		line := []byte("PING :" + token + "\n")
+		sent := s.clock.Now()
+		if _, err := s.writeRaw(line); err != nil {
+			log.Printf("ping: %s", err)
 			return
 		}
+		s.pinged(sent)
+
+		var slow <-chan time.Time
+		if threshold := s.bot.lagThreshold(); threshold > 0 {
+			slow = s.clock.After(threshold)
+		}
+		deadline := s.clock.After(timeout)
+	wait:
+		for {
+			select {
+			case got := <-s.pong:
+				if got != token {
+					// A late reply to an earlier PING
+					continue
+				}
+				s.ponged(s.clock.Now().Sub(sent))
+				break wait
+			case <-slow:
+				// Still waiting; we are lagging already
+				s.checkLag()
+			case <-s.done:
+				return
+			case <-deadline:
+				s.writeRaw([]byte("QUIT :ping time exceeded\n"))
+				select {
+				case <-s.clock.After(1 * time.Second):
+				case <-s.done:
+				}
+				return
+			}
+		}
+		next = s.clock.After(ping)
 	}
 }
 
 func (s *Server) manage() {
+	defer s.stopped()
 	defer s.conn.Close()
-	defer s.trigger(ON_DISCONNECT, nil)
-	if s.pass != "" {
-		fmt.Fprintf(s.conn, "PASS %s\n", s.pass)
+	defer s.sendq.close()
+	var echo chan *Message
+	if s.link != nil {
+		echo = s.link.echo
+		s.link.handshake()
+	} else {
+		if s.pass != "" {
+			s.send(NewMessage("", CMD_PASS, s.pass))
+		}
+		s.capStart()
+		s.send(NewMessage("", CMD_NICK, s.id.Nick))
+		s.send(NewMessage("", CMD_USER, s.id.User, ".", ".",
+			"github.com/kylelemons/blightbot "+VERSION))
 	}
-	fmt.Fprintf(s.conn, "NICK %s\nUSER %s . . :%s\n",
-		s.id.Nick, s.id.User, "github.com/kylelemons/blightbot "+VERSION)
 	for {
 		select {
 		case inc, ok := <-s.inc:
 			if !ok {
-				io.WriteString(s.conn, "QUIT :read closed\n")
+				if !s.quitting() {
+					s.writeRaw([]byte("QUIT :read closed\n"))
+				}
 				return
 			}
-			if s.bot.LogLevel > 3 {
-				log.Printf(">> %s", inc)
+			if inc.event != "" {
+				s.trigger(inc.event, inc.msg)
+				continue
 			}
-			switch inc.Command {
-			case RPL_WELCOME:
-				s.trigger(ON_CONNECT, inc)
-				if len(inc.Args) > 0 {
-					s.id.Nick = inc.Args[0]
-				}
-			case ERR_NICKNAMEINUSE:
-				nick := s.id.Nick
-				if len(inc.Args) > 1 {
-					nick = inc.Args[0]
-				}
-				nick += "_"
-				fmt.Fprintf(s.conn, "NICK %s\n", nick)
-			case CMD_JOIN:
-				if len(inc.Args) < 1 {
-					break
-				}
-				channame := inc.Args[0]
+			s.dispatch(inc.msg)
+		case ev := <-s.evs:
+			s.trigger(ev.event, ev.msg)
+		case inc := <-echo:
+			// The client form of a message sent over a server link
+			s.dispatch(inc)
+		}
+	}
+}
 
-				user := inc.ID()
-				if !s.Me(user) {
-					break
-				}
-				s.newChannel(channame)
+// dispatch handles an incoming message, and triggers its events.
+func (s *Server) dispatch(inc *Message) {
+	if s.bot.LogLevel > 3 {
+		log.Printf(">> %s", s.bot.redact(inc))
+	}
+	switch inc.Command {
+	case CMD_CAP:
+		s.handleCap(inc)
+	case CMD_AUTHENTICATE, RPL_LOGGEDIN, RPL_LOGGEDOUT, RPL_SASLSUCCESS,
+		ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED,
+		ERR_SASLALREADY:
+		s.handleSASL(inc)
+	case ERR_UNKNOWNCOMMAND:
+		if len(inc.Args) > 1 && inc.Args[1] == CMD_CAP {
+			// The server doesn't support capability negotiation
+			s.capNeg = false
+		}
+	case RPL_BOUNCE:
+		// Most servers send RPL_ISUPPORT as 005
+		s.isupport.parse(inc.Args)
+	case RPL_WELCOME:
+		s.capNeg = false
+		s.registered = true
+		if len(inc.Args) > 0 {
+			s.setNick(inc.Args[0])
+		}
+		s.trigger(ON_CONNECT, inc)
+		s.rejoinChannels()
+		s.regain()
+	case ERR_NICKNAMEINUSE, ERR_ERRONEUSNICKNAME, ERR_UNAVAILRESOURCE,
+		ERR_NICKCOLLISION:
+		s.nickRefused(inc)
+	case RPL_ISON, RPL_MONOFFLINE:
+		s.nickStatus(inc)
+	case CMD_JOIN:
+		if len(inc.Args) < 1 {
+			break
+		}
+		channame := inc.Args[0]
 
-				s.trigger(ON_JOIN, inc)
-			case CMD_PART:
-				if len(inc.Args) < 1 {
-					break
-				}
-				channame := inc.Args[0]
+		user := inc.ID()
+		if !s.Me(user) {
+			break
+		}
+		s.newChannel(channame)
 
-				user := inc.ID()
-				if !s.Me(user) {
-					break
-				}
-				s.delChannel(channame)
+		s.trigger(ON_JOIN, inc)
+	case CMD_PART:
+		if len(inc.Args) < 1 {
+			break
+		}
+		channame := inc.Args[0]
 
-				s.trigger(ON_PART, inc)
-			case CMD_PING:
-				s.WriteMessage(NewMessage("", "PONG", inc.Args...))
-			case CMD_PONG:
-				select {
-				case s.pong <- true:
-				default:
-					log.Printf("Warning: could not send PONG notification")
-				}
+		user := inc.ID()
+		if !s.Me(user) {
+			break
+		}
+		s.delChannel(channame)
 
-			case CMD_PRIVMSG:
-				if len(inc.Args) < 2 {
-					break
-				}
-				var private, channel bool
-				for _, target := range strings.Split(inc.Args[0], ",") {
-					if len(target) > 0 && target[0] == '#' {
-						channel = true
-					}
-					if target == s.id.Nick {
-						private = true
-					}
-				}
-				if channel {
-					s.trigger(ON_CHANMSG, inc)
-				} else if private {
-					s.trigger(ON_PRIVMSG, inc)
-				}
-			case CMD_NOTICE:
-				if len(inc.Args) < 2 {
-					break
-				}
-				var private, channel bool
-				for _, target := range strings.Split(inc.Args[0], ",") {
-					if len(target) > 0 && target[0] == '#' {
-						channel = true
-					}
-					if target == s.id.Nick {
-						private = true
-					}
-				}
-				if channel {
-					// Ignore channel notices
-				} else if private {
-					s.trigger(ON_NOTICE, inc)
-				}
+		s.trigger(ON_PART, inc)
+	case CMD_NICK:
+		if len(inc.Args) > 0 && s.Me(inc.ID()) {
+			s.setNick(inc.Args[0])
+			s.regain()
+		}
+	case CMD_PING:
+		s.send(NewMessage("", CMD_PONG, inc.Args...))
+	case CMD_PONG:
+		// :server PONG server :token
+		if len(inc.Args) == 0 {
+			break
+		}
+		token := inc.Args[len(inc.Args)-1]
+		if !strings.HasPrefix(token, pingPrefix) {
+			// Not one of pingloop's
+			break
+		}
+		select {
+		case s.pong <- token:
+		default:
+			log.Printf("Warning: could not send PONG notification")
+		}
+
+	case CMD_PRIVMSG:
+		if len(inc.Args) < 2 {
+			break
+		}
+		var private, channel bool
+		for _, target := range strings.Split(inc.Args[0], ",") {
+			if s.IsChannel(target) {
+				channel = true
+			}
+			if s.isupport.EqualFold(target, s.id.Nick) {
+				private = true
 			}
 		}
+		if channel {
+			s.trigger(ON_CHANMSG, inc)
+		} else if private {
+			s.trigger(ON_PRIVMSG, inc)
+		}
+	case CMD_NOTICE:
+		if len(inc.Args) < 2 {
+			break
+		}
+		var private, channel bool
+		for _, target := range strings.Split(inc.Args[0], ",") {
+			if s.IsChannel(target) {
+				channel = true
+			}
+			if s.isupport.EqualFold(target, s.id.Nick) {
+				private = true
+			}
+		}
+		if channel {
+			// Ignore channel notices
+		} else if private {
+			s.trigger(ON_NOTICE, inc)
+		}
+	}
+	s.trackChannels(inc)
+	s.trackUsers(inc)
+	s.trackHost(inc)
+	s.answer(inc)
+	if isErrorNumeric(inc.Command) {
+		s.trigger(ON_ERROR, inc)
 	}
+	s.trigger(ON_RAW, inc)
+	s.trigger(CommandEvent(inc.Command), inc)
 }
 
 func (s *Server) reader() {
@@ -230,17 +473,44 @@ func (s *Server) reader() {
 			return
 		}
 
-		msg := ParseMessage(line)
+		msg := ParseMessage(s.decode(line))
 		if msg == nil {
 			continue
 		}
 
-		if msg.Command == CMD_ERROR {
-			s.Log("ERROR %v", msg.Args)
-			return
+		msgs := []*Message{msg}
+		var events []inbound
+		if s.link != nil {
+			msgs, events = s.link.incoming(msg)
+		}
+		for _, msg := range msgs {
+			if msg.Command == CMD_ERROR {
+				s.Log("ERROR %v", msg.Args)
+				s.inc <- inbound{msg: msg}
+				return
+			}
+			s.inc <- inbound{msg: msg}
 		}
+		// After the client forms, so that both views of the network agree
+		for _, e := range events {
+			s.inc <- e
+		}
+	}
+}
 
-		s.inc <- msg
+// An inbound is a message for manage to dispatch, or an event for it to
+// trigger in order with the messages around it.
+type inbound struct {
+	event string // if set, msg is passed to its handlers instead
+	msg   *Message
+}
+
+// post passes an event to manage to trigger, so that its handlers run as
+// they would for a message.  It is dropped if the server has stopped.
+func (s *Server) post(event string, m *Message) {
+	select {
+	case s.evs <- inbound{event, m}:
+	case <-s.done:
 	}
 }
 
@@ -248,28 +518,97 @@ func (s *Server) Log(format string, args ...interface{}) {
 	log.Printf("["+s.name+"] "+format, args...)
 }
 
+// trigger calls the handlers for the event, in priority order.  Synchronous
+// handlers are called directly, and so must be done before trigger returns.
 func (s *Server) trigger(event string, m *Message) {
+	type call struct {
+		reg  *Registration
+		sync bool
+	}
+
 	s.bot.lock.RLock()
-	defer s.bot.lock.RUnlock()
+	calls := make([]call, len(s.bot.callbacks[event]))
+	for i, reg := range s.bot.callbacks[event] {
+		calls[i] = call{reg, reg.sync}
+	}
+	s.bot.lock.RUnlock()
 
-	if s.bot.LogLevel > 0 {
-		log.Printf("Trigger: %s | %s", event, m)
+	if s.bot.LogLevel > 0 && len(calls) > 0 {
+		log.Printf("Trigger: %s | %s", event, s.bot.redact(m))
 	}
 
-	for _, f := range s.bot.callbacks[event] {
-		go f(event, s, m)
+	for _, c := range calls {
+		if atomic.LoadInt32(&c.reg.removed) != 0 {
+			continue
+		}
+		if c.sync {
+			c.reg.handler(event, s, m)
+		} else {
+			go c.reg.handler(event, s, m)
+		}
 	}
 }
 
+// Write writes raw lines to the server.  Lines are sent through the send
+// queue at their default priority.
 func (s *Server) Write(b []byte) (int, error) {
-	return s.conn.Write(b)
+	n := 0
+	for len(b) > 0 {
+		end := len(b)
+		if nl := bytes.IndexByte(b, '\n'); nl >= 0 {
+			end = nl + 1
+		}
+		// The caller may reuse b once we return, so queue a copy
+		line := append([]byte(nil), b[:end]...)
+		b = b[end:]
+
+		p := PriorityNormal
+		m := ParseMessage(string(line))
+		if m != nil {
+			p = priority(m)
+		}
+		if m != nil && s.link != nil {
+			// Raw lines are in client form, and must be translated
+			if _, err := s.WritePriority(m, p); err != nil {
+				return n, err
+			}
+			n += len(line)
+			continue
+		}
+		if _, err := s.queueLines(p, m, line); err != nil {
+			return n, err
+		}
+		n += len(line)
+	}
+	return n, nil
 }
 
 func (s *Server) WriteString(str string) (int, error) {
-	return io.WriteString(s.conn, str)
+	return s.Write([]byte(str))
 }
 
+// WriteMessage writes the message to the server at its default priority: PONG
+// and QUIT are sent immediately, and everything else is queued.
 func (s *Server) WriteMessage(m *Message) (int, error) {
-	log.Printf("<< %s", m)
-	return s.conn.Write(m.Bytes())
+	return s.WritePriority(m, priority(m))
+}
+
+// send writes a protocol message (registration, capability negotiation,
+// etc) immediately.
+func (s *Server) send(m *Message) (int, error) {
+	return s.WritePriority(m, PriorityImmediate)
+}
+
+// outgoing prepares the message for sending to the server.
+func (s *Server) outgoing(m *Message) *Message {
+	if len(m.Tags) > 0 && !s.HasCap("message-tags") {
+		// Client-only tags may only be sent with message-tags
+		m = m.Copy()
+		for k := range m.Tags {
+			if IsClientTag(k) {
+				delete(m.Tags, k)
+			}
+		}
+	}
+	return m
 }
@@ -3,9 +3,10 @@ package bot
 import (
 	"bufio"
 	"fmt"
-	"log"
 	"io"
 	"io/ioutil"
+	"log"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,12 +23,104 @@ func FakeConn() (RW, RW) {
 	return RW{connR, fakeW, fakeW}, RW{fakeR, connW, connW}
 }
 
+// A testConn drives a Server directly, for tests which need to inspect its
+// state as well as its output.
+type testConn struct {
+	t     *testing.T
+	serv  *Server
+	local RW
+	lines chan string
+	syncs int
+}
+
+func newTestConn(t *testing.T, b *Bot) *testConn {
+	conn, local := FakeConn()
+	b.SetFlood(0, 0)
+	return startTestConn(t, b.newServer("s:p", "", conn), local)
+}
+
+// startTestConn returns a testConn for a started server, whose connection's
+// other end is local.
+func startTestConn(t *testing.T, serv *Server, local RW) *testConn {
+	c := &testConn{
+		t:     t,
+		serv:  serv,
+		local: local,
+		lines: make(chan string, 100),
+	}
+	go func() {
+		defer close(c.lines)
+		in := bufio.NewReader(local)
+		for {
+			line, err := in.ReadString('\n')
+			if err != nil {
+				return
+			}
+			c.lines <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+	return c
+}
+
+// Send sends the given lines to the server.
+func (c *testConn) Send(lines ...string) {
+	for _, line := range lines {
+		io.WriteString(c.local, line+"\n")
+	}
+}
+
+// Sync waits until the server has processed everything sent so far, and
+// returns the lines it has written in the meantime.
+func (c *testConn) Sync() []string {
+	c.syncs++
+	token := fmt.Sprintf("sync%d", c.syncs)
+	c.Send("PING :" + token)
+
+	var lines []string
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for sync")
+			}
+			if m := ParseMessage(line); m != nil && m.Prefix != "" && m.Command == CMD_PONG &&
+				m.Args[len(m.Args)-1] == token {
+				// From a server link
+				line = "PONG :" + token
+			}
+			switch line {
+			case "PONG " + token, "PONG :" + token:
+				// The PONG bypasses the send queue, so follow it with a
+				// bulk message, which is only sent once everything queued
+				// before it has been.
+				c.serv.WritePriority(NewMessage("", "SYNC", token), PriorityBulk)
+				continue
+			case "SYNC " + token:
+				return lines
+			}
+			lines = append(lines, line)
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for sync; got %q", lines)
+		}
+	}
+}
+
+// Close closes the connection to the server.
+func (c *testConn) Close() {
+	c.local.Close()
+	for _ = range c.lines {
+	}
+}
+
 type Send string
 type Expect string
 type EOF struct{}
 
 var serverTests = []struct {
 	Desc     string
+	Caps     []string
+	SASL     *SASL
 	Bind     map[string]Handler
 	Sequence []interface{}
 }{
@@ -130,6 +223,159 @@ var serverTests = []struct {
 			Expect("QUIT :read closed"),
 		},
 	},
+	{
+		Desc: "cap negotiate",
+		Caps: []string{"message-tags", "server-time"},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :multi-prefix message-tags server-time"),
+			Expect("CAP REQ :message-tags server-time"),
+			Send(":serv CAP * ACK :message-tags server-time"),
+			Expect("CAP END"),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "cap multiline ls",
+		Caps: []string{"sasl", "server-time"},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL"),
+			Send(":serv CAP * LS :away-notify server-time"),
+			Expect("CAP REQ :sasl server-time"),
+			Send(":serv CAP * NAK :sasl server-time"),
+			Expect("CAP END"),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "cap none available",
+		Caps: []string{"server-time"},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :multi-prefix"),
+			Expect("CAP END"),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "cap unsupported",
+		Caps: []string{"server-time"},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv 421 n CAP :Unknown command"),
+			Send(":serv 001 n :Welcome"),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "cap new del",
+		Caps: []string{"server-time"},
+		Bind: map[string]Handler{
+			ON_CAPS: func(e string, s *Server, m *Message) {
+				fmt.Fprintf(s, "CAPS %s %s\n", m.Args[1], strings.Join(s.Caps(), ","))
+			},
+		},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :cap-notify"),
+			Expect("CAP END"),
+			Send(":serv 001 n :Welcome"),
+			Send(":serv CAP n NEW :server-time"),
+			Expect("CAP REQ server-time"),
+			Send(":serv CAP n ACK :server-time"),
+			Expect("CAPS ACK server-time"),
+			Send(":serv CAP n DEL :server-time"),
+			Expect("CAPS DEL "),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "sasl plain",
+		SASL: &SASL{Mechanism: SASL_PLAIN, User: "acct", Pass: "secret"},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :sasl=PLAIN,EXTERNAL"),
+			Expect("CAP REQ sasl"),
+			Send(":serv CAP * ACK :sasl"),
+			Expect("AUTHENTICATE PLAIN"),
+			Send("AUTHENTICATE +"),
+			Expect("AUTHENTICATE YWNjdABhY2N0AHNlY3JldA=="),
+			Send(":serv 900 n n!u@h acct :You are now logged in as acct"),
+			Send(":serv 903 n :SASL authentication successful"),
+			Expect("CAP END"),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "sasl external",
+		SASL: &SASL{Mechanism: SASL_EXTERNAL},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :sasl"),
+			Expect("CAP REQ sasl"),
+			Send(":serv CAP * ACK :sasl"),
+			Expect("AUTHENTICATE EXTERNAL"),
+			Send("AUTHENTICATE +"),
+			Expect("AUTHENTICATE +"),
+			Send(":serv 904 n :SASL authentication failed"),
+			Expect("CAP END"),
+			EOF{},
+			Expect("QUIT :read closed"),
+		},
+	},
+	{
+		Desc: "sasl required failure",
+		SASL: &SASL{Mechanism: SASL_PLAIN, User: "acct", Pass: "secret", Required: true},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :sasl"),
+			Expect("CAP REQ sasl"),
+			Send(":serv CAP * ACK :sasl"),
+			Expect("AUTHENTICATE PLAIN"),
+			Send("AUTHENTICATE +"),
+			Expect("AUTHENTICATE YWNjdABhY2N0AHNlY3JldA=="),
+			Send(":serv 904 n :SASL authentication failed"),
+			Expect("QUIT :SASL authentication failed"),
+			EOF{},
+		},
+	},
+	{
+		Desc: "sasl required unsupported",
+		SASL: &SASL{Mechanism: SASL_EXTERNAL, Required: true},
+		Sequence: []interface{}{
+			Expect("CAP LS 302"),
+			Expect("NICK n"),
+			Expect("USER u . . :github.com/kylelemons/blightbot " + VERSION),
+			Send(":serv CAP * LS :sasl=PLAIN"),
+			Expect("CAP REQ sasl"),
+			Send(":serv CAP * ACK :sasl"),
+			Expect("QUIT :SASL authentication failed"),
+			EOF{},
+		},
+	},
 }
 
 func TestServer(t *testing.T) {
@@ -143,6 +389,11 @@ func TestServer(t *testing.T) {
 
 		go func() {
 			bot := New("n", "u")
+			bot.SetFlood(0, 0)
+			bot.RequestCap(test.Caps...)
+			if test.SASL != nil {
+				bot.SetSASL(test.SASL)
+			}
 			conn, local := FakeConn()
 			bot.newServer("s:p", "", conn)
 
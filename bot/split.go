@@ -0,0 +1,349 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// MaxLineLength is the maximum length of an IRC line, including the trailing
+// CR LF but not including message tags.
+const MaxLineLength = 512
+
+// Worst-case lengths of our user and host as seen by others, for when the
+// server hasn't told us what they are.
+const (
+	maxUserLen = 10 + 1 // USERLEN, plus a possible ~
+	maxHostLen = 63
+)
+
+// The multiline capability and the tag which marks a line as continuing the
+// one before it.
+const (
+	CAP_MULTILINE     = "draft/multiline"
+	TAG_MULTILINE_CAT = "draft/multiline-concat"
+)
+
+// mIRC formatting codes
+const (
+	fmtBold      = '\x02'
+	fmtColor     = '\x03'
+	fmtHexColor  = '\x04'
+	fmtReset     = '\x0F'
+	fmtMono      = '\x11'
+	fmtReverse   = '\x16'
+	fmtItalic    = '\x1D'
+	fmtStrike    = '\x1E'
+	fmtUnderline = '\x1F'
+)
+
+// A format holds the mIRC formatting in effect at a point in a line.
+type format struct {
+	toggles string // toggle codes which are on, in the order they were set
+	color   string // the color code in effect, if any
+}
+
+// toggle flips the given toggle code.
+func (f *format) toggle(code byte) {
+	if i := strings.IndexByte(f.toggles, code); i >= 0 {
+		f.toggles = f.toggles[:i] + f.toggles[i+1:]
+		return
+	}
+	f.toggles += string(code)
+}
+
+// apply updates the format with the codes in text.
+func (f *format) apply(text string) {
+	for i := 0; i < len(text); {
+		end := codeEnd(text, i)
+		switch c := text[i]; c {
+		case fmtBold, fmtMono, fmtReverse, fmtItalic, fmtStrike, fmtUnderline:
+			f.toggle(c)
+		case fmtColor, fmtHexColor:
+			f.color = text[i:end]
+			if end == i+1 {
+				// A bare color code resets the colors
+				f.color = ""
+			}
+		case fmtReset:
+			*f = format{}
+		}
+		if end == i {
+			end++
+		}
+		i = end
+	}
+}
+
+// String returns the codes needed to restore the format at the start of a
+// new line.
+func (f format) String() string {
+	return f.toggles + f.color
+}
+
+// codeEnd returns the index just past the formatting code at text[i], or i if
+// there is no formatting code there.
+func codeEnd(text string, i int) int {
+	digits := func(i, max int, valid func(byte) bool) int {
+		for n := 0; n < max && i < len(text) && valid(text[i]); n++ {
+			i++
+		}
+		return i
+	}
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	isHex := func(c byte) bool { return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' }
+
+	switch text[i] {
+	case fmtBold, fmtMono, fmtReverse, fmtItalic, fmtStrike, fmtUnderline, fmtReset:
+		return i + 1
+	case fmtColor, fmtHexColor:
+		valid, max := isDigit, 2
+		if text[i] == fmtHexColor {
+			valid, max = isHex, 6
+		}
+		end := digits(i+1, max, valid)
+		if end > i+1 && end+1 < len(text) && text[end] == ',' && valid(text[end+1]) {
+			end = digits(end+1, max, valid)
+		}
+		return end
+	}
+	return i
+}
+
+// visible returns true if text contains anything other than formatting codes.
+func visible(text string) bool {
+	for i := 0; i < len(text); i = codeEnd(text, i) {
+		if codeEnd(text, i) == i {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPoint returns where to split text so that the first part is at most
+// max bytes long, preferring to split after a space, and never splitting a
+// UTF-8 sequence or formatting code.
+func splitPoint(text string, max int) int {
+	if max < 1 {
+		max = 1
+	}
+	if len(text) <= max {
+		return len(text)
+	}
+
+	// Split after the last space, unless it would make a very short line
+	if sp := strings.LastIndex(text[:max], " "); sp >= max/2 {
+		return sp + 1
+	}
+
+	cut := max
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	// Don't split a formatting code (the longest is \x04RRGGBB,RRGGBB)
+	for i := cut - 1; i >= 0 && i >= cut-15; i-- {
+		if codeEnd(text, i) > cut {
+			cut = i
+			break
+		}
+	}
+	if cut == 0 {
+		// Make progress even if max is too small for the first rune
+		_, cut = utf8.DecodeRuneInString(text)
+	}
+	return cut
+}
+
+// SplitText splits text into lines of at most max bytes.  Text is split at
+// newlines, after spaces where possible, and otherwise between UTF-8
+// characters.  The mIRC formatting in effect at the end of each piece is
+// restored at the start of the next, and blank lines are dropped.
+func SplitText(text string, max int) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+
+		var f format
+		for line != "" {
+			prefix := f.String()
+			cut := splitPoint(line, max-len(prefix))
+			part := line[:cut]
+			f.apply(part)
+			line = line[cut:]
+
+			if line != "" {
+				part = strings.TrimSuffix(part, " ")
+			}
+			if visible(part) {
+				lines = append(lines, prefix+part)
+			}
+		}
+	}
+	return lines
+}
+
+// splitConcat splits text like SplitText, except that formatting is not
+// restored and the spaces at which lines are split are kept, so that each
+// line may be rejoined to the one before it.  The returned cat values
+// indicate which lines continue the line before them.
+func splitConcat(text string, max int) (lines []string, cat []bool) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+
+		first := true
+		for first || line != "" {
+			cut := splitPoint(line, max)
+			lines = append(lines, line[:cut])
+			cat = append(cat, !first)
+			line, first = line[cut:], false
+		}
+	}
+	return lines, cat
+}
+
+// setHost records our user@host as seen by others.
+func (s *Server) setHost(userhost string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.host = userhost
+}
+
+// trackHost keeps track of our user@host from an incoming message.
+func (s *Server) trackHost(m *Message) {
+	id := m.ID()
+	switch {
+	case m.Command == RPL_WELCOME && len(m.Args) > 1:
+		// Many servers welcome us with our full prefix
+		words := strings.Fields(m.Args[len(m.Args)-1])
+		if len(words) == 0 {
+			return
+		}
+		if id := (&Message{Prefix: words[len(words)-1]}).ID(); id.User != "" && s.Me(id) {
+			s.setHost(id.User + "@" + id.Host)
+		}
+	case m.Command == RPL_HOSTHIDDEN && len(m.Args) > 1:
+		// :server 396 me [user@]host :is now your displayed host
+		host := m.Args[1]
+		if !strings.Contains(host, "@") {
+			prefix, _ := s.Prefix()
+			user := s.id.User
+			if id := (&Message{Prefix: prefix}).ID(); id.User != "" {
+				user = id.User
+			}
+			host = user + "@" + host
+		}
+		s.setHost(host)
+	case m.Command == CMD_CHGHOST && len(m.Args) > 1 && s.Me(id):
+		s.setHost(m.Args[0] + "@" + m.Args[1])
+	case id.User != "" && s.Me(id):
+		s.setHost(id.User + "@" + id.Host)
+	}
+}
+
+// Prefix returns our prefix (nick!user@host) as seen by others, if it is
+// known.
+func (s *Server) Prefix() (prefix string, ok bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.host == "" {
+		return s.id.Nick, false
+	}
+	return s.id.Nick + "!" + s.host, true
+}
+
+// MaxMessageLength returns the maximum number of bytes of text which can be
+// sent to target with the given command (e.g. PRIVMSG) without being
+// truncated when the server relays it to others.
+func (s *Server) MaxMessageLength(cmd, target string) int {
+	prefix, ok := s.Prefix()
+	if !ok {
+		prefix += "!" + strings.Repeat("u", maxUserLen) + "@" + strings.Repeat("h", maxHostLen)
+	}
+
+	// :prefix CMD target :text\r\n
+	return MaxLineLength - len(":"+prefix+" "+cmd+" "+target+" :"+"\r\n")
+}
+
+// split returns the messages which should be sent in place of m, which are
+// more than one if it is a PRIVMSG or NOTICE with a message too long to fit
+// on one line.  If the server supports multiline messages, the messages are
+// wrapped in a batch.
+func (s *Server) split(m *Message) []*Message {
+	if m.Command != CMD_PRIVMSG && m.Command != CMD_NOTICE || len(m.Args) != 2 {
+		return []*Message{m}
+	}
+	target, text := m.Args[0], m.Args[1]
+	max := s.MaxMessageLength(m.Command, target)
+	if len(text) <= max && strings.IndexByte(text, '\n') < 0 {
+		return []*Message{m}
+	}
+	if strings.HasPrefix(text, "\x01") {
+		// CTCP messages can't be split
+		return []*Message{m}
+	}
+
+	if batch := s.multiline(m, max); batch != nil {
+		return batch
+	}
+
+	var msgs []*Message
+	for _, line := range SplitText(text, max) {
+		msg := m.Copy()
+		msg.Args[1] = line
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return []*Message{m}
+	}
+	return msgs
+}
+
+// multiline returns the message as a multiline batch, or nil if the server
+// doesn't support them or the message is too long for one.
+func (s *Server) multiline(m *Message, max int) []*Message {
+	val, ok := s.CapValue(CAP_MULTILINE)
+	if !ok {
+		return nil
+	}
+	maxBytes, maxLines := 0, 0
+	for _, tok := range strings.Split(val, ",") {
+		key, val := splitCap(tok)
+		n, _ := strconv.Atoi(val)
+		switch key {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+
+	text := strings.Replace(m.Args[1], "\r\n", "\n", -1)
+	if maxBytes <= 0 || len(text) > maxBytes {
+		return nil
+	}
+	lines, cat := splitConcat(text, max)
+	if maxLines > 0 && len(lines) > maxLines {
+		return nil
+	}
+
+	ref := fmt.Sprintf("ml%d", atomic.AddUint32(&s.batches, 1))
+	open := NewMessage("", CMD_BATCH, "+"+ref, CAP_MULTILINE, m.Args[0])
+	for k, v := range m.Tags {
+		open.SetTag(k, v)
+	}
+
+	msgs := []*Message{open}
+	for i, line := range lines {
+		msg := NewMessage("", m.Command, m.Args[0], line)
+		msg.SetTag(TAG_BATCH, ref)
+		if cat[i] {
+			msg.SetTag(TAG_MULTILINE_CAT, "")
+		}
+		msgs = append(msgs, msg)
+	}
+	return append(msgs, NewMessage("", CMD_BATCH, "-"+ref))
+}
@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		Desc string
+		Text string
+		Max  int
+		Want []string
+	}{
+		{
+			Desc: "short",
+			Text: "hello world",
+			Max:  20,
+			Want: []string{"hello world"},
+		},
+		{
+			Desc: "words",
+			Text: "the quick brown fox jumps over the lazy dog",
+			Max:  16,
+			Want: []string{"the quick brown", "fox jumps over", "the lazy dog"},
+		},
+		{
+			Desc: "long word",
+			Text: "abcdefghijklmnopqrstuvwxyz",
+			Max:  10,
+			Want: []string{"abcdefghij", "klmnopqrst", "uvwxyz"},
+		},
+		{
+			Desc: "utf8",
+			Text: "ééééé",
+			Max:  5,
+			Want: []string{"éé", "éé", "é"},
+		},
+		{
+			Desc: "newlines",
+			Text: "one\r\ntwo\n\nthree",
+			Max:  10,
+			Want: []string{"one", "two", "three"},
+		},
+		{
+			Desc: "bold",
+			Text: "\x02bold words\x02 plain",
+			Max:  8,
+			Want: []string{"\x02bold", "\x02words\x02", "plain"},
+		},
+		{
+			Desc: "color",
+			Text: "\x0304,12red on blue\x03 and normal",
+			Max:  14,
+			Want: []string{"\x0304,12red on", "\x0304,12blue\x03", "and normal"},
+		},
+		{
+			Desc: "reset",
+			Text: "\x1D\x1Fab\x0F cd",
+			Max:  4,
+			Want: []string{"\x1D\x1Fab", "cd"},
+		},
+		{
+			Desc: "color code not split",
+			Text: "abcdefg\x0312hi",
+			Max:  9,
+			Want: []string{"abcdefg", "\x0312hi"},
+		},
+	}
+
+	for _, test := range tests {
+		got := SplitText(test.Text, test.Max)
+		if !reflect.DeepEqual(got, test.Want) {
+			t.Errorf("%s: SplitText(%q, %d) = %q, want %q", test.Desc, test.Text, test.Max, got, test.Want)
+		}
+		for _, line := range got {
+			if len(line) > test.Max {
+				t.Errorf("%s: line %q is longer than %d", test.Desc, line, test.Max)
+			}
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	b := New("n", "u")
+	b.RequestCap(CAP_MULTILINE)
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	c.Send(
+		":serv CAP * LS :draft/multiline=max-bytes=100,max-lines=5",
+		":serv CAP * ACK :draft/multiline",
+		":serv 001 n :Welcome to the network n!user@some.host",
+	)
+	c.Sync()
+
+	prefix := ":n!user@some.host PRIVMSG #chan :"
+	max := MaxLineLength - len(prefix+"\r\n")
+	if got := c.serv.MaxMessageLength(CMD_PRIVMSG, "#chan"); got != max {
+		t.Errorf("MaxMessageLength = %d, want %d", got, max)
+	}
+
+	// Too long for a single line or a multiline batch, so it is split
+	word := strings.Repeat("x", (max-2)/2)
+	c.serv.WriteMessage(NewMessage("", CMD_PRIVMSG, "#chan", word+" "+word+" "+word))
+	want := []string{
+		"PRIVMSG #chan :" + word + " " + word,
+		"PRIVMSG #chan " + word,
+	}
+	if got := c.Sync(); !reflect.DeepEqual(got, want) {
+		t.Errorf("split message:\ngot  %q\nwant %q", got, want)
+	}
+
+	// Short enough for a multiline batch
+	c.serv.WriteMessage(NewMessage("", CMD_NOTICE, "#chan", "one\ntwo"))
+	want = []string{
+		"BATCH +ml1 draft/multiline #chan",
+		"@batch=ml1 NOTICE #chan one",
+		"@batch=ml1 NOTICE #chan two",
+		"BATCH -ml1",
+	}
+	if got := c.Sync(); !reflect.DeepEqual(got, want) {
+		t.Errorf("multiline message:\ngot  %q\nwant %q", got, want)
+	}
+
+	// Our host changes
+	c.Send(":serv 396 n a.much.longer.hidden.host :is now your hidden host")
+	c.Sync()
+	if got, ok := c.serv.Prefix(); got != "n!user@a.much.longer.hidden.host" || !ok {
+		t.Errorf("Prefix() = %q, %v, want the hidden host", got, ok)
+	}
+}
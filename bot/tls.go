@@ -0,0 +1,95 @@
+package bot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// TLSOptions controls how a TLS connection to a server is made.
+type TLSOptions struct {
+	// ServerName is the name verified against the server's certificate.  If
+	// it is empty, the host portion of the server address is used.
+	ServerName string
+
+	// RootCAs is the pool of certificate authorities used to verify the
+	// server.  If it is nil, the certificates in CAFile are used, and if that
+	// is also empty, the system pool is used.
+	RootCAs *x509.CertPool
+	CAFile  string
+
+	// Certificate is presented to the server if it is non-nil, for instance
+	// for CertFP or SASL EXTERNAL.  If it is nil and CertFile is set, the
+	// certificate is loaded from CertFile and KeyFile.  If KeyFile is empty,
+	// the key is assumed to be in the same PEM file as the certificate.
+	Certificate *tls.Certificate
+	CertFile    string
+	KeyFile     string
+
+	// Insecure disables all verification of the server's certificate.  This
+	// should only be used for testing.
+	Insecure bool
+}
+
+// Config returns the tls.Config for connecting to the given server address.
+func (o *TLSOptions) Config(server string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         o.ServerName,
+		RootCAs:            o.RootCAs,
+		InsecureSkipVerify: o.Insecure,
+	}
+
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		conf.ServerName = host
+	}
+
+	if conf.RootCAs == nil && o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates found in %q", o.CAFile)
+		}
+	}
+
+	switch {
+	case o.Certificate != nil:
+		conf.Certificates = []tls.Certificate{*o.Certificate}
+	case o.CertFile != "":
+		key := o.KeyFile
+		if key == "" {
+			key = o.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
+
+// ConnectTLS connects to the given server over TLS, using the given password
+// if it is non-empty.  If opts is nil, the default options are used.
+func (b *Bot) ConnectTLS(server, pass string, opts *TLSOptions) error {
+	if opts == nil {
+		opts = new(TLSOptions)
+	}
+
+	conn, err := b.dial(server, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	b.newServer(server, pass, conn)
+	return nil
+}
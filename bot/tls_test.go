@@ -0,0 +1,161 @@
+package bot
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestConnectTLS(t *testing.T) {
+	servCert, servX509 := selfSigned(t, "irc.test")
+	clientCert, clientX509 := selfSigned(t, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(servX509)
+
+	tests := []struct {
+		Desc   string
+		Opts   *TLSOptions
+		Client bool
+		Fail   bool
+	}{
+		{
+			Desc: "verified",
+			Opts: &TLSOptions{ServerName: "irc.test", RootCAs: pool},
+		},
+		{
+			Desc:   "client cert",
+			Opts:   &TLSOptions{ServerName: "irc.test", RootCAs: pool, Certificate: &clientCert},
+			Client: true,
+		},
+		{
+			Desc: "insecure",
+			Opts: &TLSOptions{Insecure: true},
+		},
+		{
+			Desc: "unknown authority",
+			Opts: &TLSOptions{ServerName: "irc.test"},
+			Fail: true,
+		},
+		{
+			Desc: "wrong name",
+			Opts: &TLSOptions{ServerName: "irc.example", RootCAs: pool},
+			Fail: true,
+		},
+	}
+
+	for _, test := range tests {
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{servCert},
+			ClientAuth:   tls.RequestClientCert,
+		})
+		if err != nil {
+			t.Fatalf("listen: %s", err)
+		}
+
+		lines := make(chan string, 1)
+		peers := make(chan []*x509.Certificate, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			tconn := conn.(*tls.Conn)
+			if err := tconn.Handshake(); err != nil {
+				return
+			}
+			peers <- tconn.ConnectionState().PeerCertificates
+
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			lines <- line
+		}()
+
+		b := New("n", "u")
+		err = b.ConnectTLS(l.Addr().String(), "", test.Opts)
+		switch {
+		case test.Fail && err == nil:
+			t.Errorf("%s: connected, want error", test.Desc)
+		case !test.Fail && err != nil:
+			t.Errorf("%s: connect: %s", test.Desc, err)
+		}
+		if err != nil {
+			l.Close()
+			continue
+		}
+
+		select {
+		case certs := <-peers:
+			if got, want := len(certs) > 0, test.Client; got != want {
+				t.Errorf("%s: client certificate presented = %v, want %v", test.Desc, got, want)
+			}
+			if test.Client && len(certs) > 0 && !certs[0].Equal(clientX509) {
+				t.Errorf("%s: client presented the wrong certificate", test.Desc)
+			}
+		case <-time.After(1 * time.Second):
+			t.Errorf("%s: timed out waiting for handshake", test.Desc)
+		}
+
+		select {
+		case line := <-lines:
+			if got, want := line, "NICK n\n"; got != want {
+				t.Errorf("%s: got %q, want %q", test.Desc, got, want)
+			}
+		case <-time.After(1 * time.Second):
+			t.Errorf("%s: timed out waiting for registration", test.Desc)
+		}
+		l.Close()
+	}
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	conf, err := (&TLSOptions{}).Config("irc.example.com:6697")
+	if err != nil {
+		t.Fatalf("config: %s", err)
+	}
+	if got, want := conf.ServerName, "irc.example.com"; got != want {
+		t.Errorf("server name = %q, want %q", got, want)
+	}
+
+	if _, err := (&TLSOptions{CAFile: "/nonexistent/ca.pem"}).Config("irc.example.com:6697"); err == nil {
+		t.Errorf("missing CA file: got no error")
+	}
+	if _, err := (&TLSOptions{}).Config("irc.example.com"); err == nil {
+		t.Errorf("missing port: got no error")
+	}
+}
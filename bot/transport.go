@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// A Dialer makes connections to an IRC server.  The connection carries IRC
+// lines in both directions, as a TCP connection would.
+type Dialer interface {
+	Dial(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// DialerFunc adapts a function to the Dialer interface.
+type DialerFunc func(ctx context.Context) (io.ReadWriteCloser, error)
+
+func (f DialerFunc) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	return f(ctx)
+}
+
+// ConnectTransport connects to a server using the given dialer.  The name
+// identifies the server in logs.
+func (b *Bot) ConnectTransport(name string, d Dialer) error {
+	conn, err := d.Dial(b.ctx)
+	if err != nil {
+		return err
+	}
+
+	b.newServer(name, "", conn)
+	return nil
+}
+
+// UnixSocket returns a dialer which connects to the Unix domain socket at
+// path, e.g. one on which a local bouncer listens.
+func UnixSocket(path string) Dialer {
+	return DialerFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		dialer := &net.Dialer{Timeout: DialTimeout}
+		return dialer.DialContext(ctx, "unix", path)
+	})
+}
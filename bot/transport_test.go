@@ -0,0 +1,136 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "irc.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	b := New("n", "u")
+	if err := b.ConnectTransport("bouncer", UnixSocket(path)); err != nil {
+		t.Fatalf("ConnectTransport: %s", err)
+	}
+	c := accept(t, l)
+	c.Expect("NICK n")
+	c.conn.Close()
+}
+
+func TestWebSocket(t *testing.T) {
+	conns := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Sec-WebSocket-Protocol"); !strings.Contains(got, WS_TEXT) {
+			t.Errorf("Sec-WebSocket-Protocol = %q, want %q", got, WS_TEXT)
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %s", err)
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n"+
+			"Sec-WebSocket-Protocol: %s\r\n\r\n",
+			wsAccept(r.Header.Get("Sec-WebSocket-Key")), WS_TEXT)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conns <- &wsConn{conn: conn, in: rw.Reader, opcode: wsText}
+	}))
+	defer srv.Close()
+
+	b := New("n", "u")
+	b.SetFlood(0, 0)
+	if err := b.ConnectTransport("ws", WebSocket("ws://"+srv.Listener.Addr().String()+"/irc", nil, nil)); err != nil {
+		t.Fatalf("ConnectTransport: %s", err)
+	}
+	ws := <-conns
+	defer ws.conn.Close()
+
+	// Each line is sent in its own frame, without the CR LF
+	expect := func(wantOp byte, want string) {
+		t.Helper()
+		_, op, payload, err := readFrame(ws.in)
+		if err != nil {
+			t.Fatalf("reading %q: %s", want, err)
+		}
+		if op != wantOp || string(payload) != want {
+			t.Errorf("got frame %x %q, want %x %q", op, payload, wantOp, want)
+		}
+	}
+	expect(wsText, "NICK n")
+	expect(wsText, "USER u . . :github.com/kylelemons/blightbot "+VERSION)
+
+	// Control frames are answered
+	writeFrame(ws.conn, wsPing, []byte("heartbeat"), false)
+	expect(wsPong, "heartbeat")
+
+	// Messages may be fragmented
+	ws.conn.Write([]byte{0x00 | wsText, 5})
+	ws.conn.Write([]byte("PING "))
+	writeFrame(ws.conn, wsContinuation, []byte(":token"), false)
+	expect(wsText, "PONG token")
+
+	ws.Write([]byte(":serv 001 n :Welcome\r\n"))
+	ws.Write([]byte("PING :sync\r\n"))
+	expect(wsText, "PONG sync")
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	requests := make(chan string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		in := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			req, err := http.ReadRequest(in)
+			if err != nil {
+				return
+			}
+			requests <- req.Method + " " + req.RequestURI
+			if req.Method == "CONNECT" {
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			}
+		}
+	}()
+
+	// The handshake fails when the proxy hangs up, after the upgrade request
+	netOpts := &NetOptions{Proxy: "http://" + l.Addr().String()}
+	if _, err := WebSocket("ws://irc.example/irc", netOpts, nil).Dial(context.Background()); err == nil {
+		t.Errorf("Dial succeeded without a handshake")
+	}
+	for _, want := range []string{"CONNECT irc.example:80", "GET /irc"} {
+		select {
+		case got := <-requests:
+			if got != want {
+				t.Errorf("request = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %q request", want)
+		}
+	}
+}
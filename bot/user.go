@@ -0,0 +1,263 @@
+package bot
+
+import (
+	"sort"
+	"strings"
+)
+
+// A User is a user which shares at least one channel with the bot.
+type User struct {
+	Nick     string
+	User     string
+	Host     string
+	Realname string
+
+	// Account is the services account the user is logged into, or "" if
+	// they are not logged in (or it is not known).  It is only tracked on
+	// servers which support extended-join, account-notify, account-tag or
+	// WHOX.
+	Account string
+
+	// Channels holds the channels the user shares with the bot.  It is filled
+	// in when the user is retrieved.
+	Channels []string
+}
+
+// ID returns the identity of the user.
+func (u *User) ID() *Identity {
+	return &Identity{Nick: u.Nick, User: u.User, Host: u.Host}
+}
+
+// The WHOX query token used when the bot looks up the members of a channel.
+const whoxToken = "152"
+
+// User returns the user with the given nick, if they share a channel with the
+// bot.
+func (s *Server) User(nick string) (User, bool) {
+	s.lock.RLock()
+	u, ok := s.users[s.ToLower(nick)]
+	var user User
+	if ok {
+		user = *u
+	}
+	s.lock.RUnlock()
+
+	if !ok {
+		return User{}, false
+	}
+	user.Channels = s.userChannels(user.Nick)
+	return user, true
+}
+
+// Users returns all users which share a channel with the bot, sorted by nick.
+func (s *Server) Users() []User {
+	s.lock.RLock()
+	users := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, *u)
+	}
+	s.lock.RUnlock()
+
+	for i := range users {
+		users[i].Channels = s.userChannels(users[i].Nick)
+	}
+	sort.Sort(userSorter(users))
+	return users
+}
+
+// userChannels returns the names of the channels the user is in.
+func (s *Server) userChannels(nick string) []string {
+	var chans []string
+	for _, ch := range s.Channels() {
+		if _, ok := ch.Member(nick); ok {
+			chans = append(chans, ch.Name())
+		}
+	}
+	return chans
+}
+
+// getUser returns the user with the given nick, adding it if it is not yet
+// known.  The server lock must be held.
+func (s *Server) getUser(nick string) *User {
+	key := s.ToLower(nick)
+	u, ok := s.users[key]
+	if !ok {
+		u = &User{Nick: nick}
+		s.users[key] = u
+	}
+	return u
+}
+
+// updateUser calls update with the user with the given nick, adding it if
+// create is true and it is not yet known.
+func (s *Server) updateUser(nick string, create bool, update func(u *User)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[s.ToLower(nick)]; !ok && !create {
+		return
+	}
+	update(s.getUser(nick))
+}
+
+// pruneUsers forgets the given users (or, if none are given, all users) who
+// no longer share a channel with the bot.
+func (s *Server) pruneUsers(nicks ...string) {
+	if len(nicks) == 0 {
+		s.lock.RLock()
+		for _, u := range s.users {
+			nicks = append(nicks, u.Nick)
+		}
+		s.lock.RUnlock()
+	}
+
+	for _, nick := range nicks {
+		if s.isupport.EqualFold(nick, s.id.Nick) || len(s.userChannels(nick)) > 0 {
+			continue
+		}
+		s.lock.Lock()
+		delete(s.users, s.ToLower(nick))
+		s.lock.Unlock()
+	}
+}
+
+// account returns the account name from a message argument, where "*" or
+// "0" means no account.
+func account(arg string) string {
+	if arg == "*" || arg == "0" {
+		return ""
+	}
+	return arg
+}
+
+// trackUsers updates the user table from an incoming message.  It must be
+// called after trackChannels.
+func (s *Server) trackUsers(m *Message) {
+	id := m.ID()
+
+	// Any message from a user tells us their user@host and (with
+	// account-tag) their account.
+	if id.Nick != "" && id.User != "" {
+		acct, tagged := m.Tag(TAG_ACCOUNT)
+		s.updateUser(id.Nick, m.Command == CMD_JOIN, func(u *User) {
+			u.Nick, u.User, u.Host = id.Nick, id.User, id.Host
+			if tagged {
+				u.Account = acct
+			}
+		})
+	}
+
+	switch m.Command {
+	case CMD_JOIN:
+		if len(m.Args) < 1 {
+			return
+		}
+		if s.Me(id) && s.isupport.IsChannel(m.Args[0]) {
+			if _, ok := s.isupport.Get("WHOX"); ok {
+				s.WriteMessage(NewMessage("", CMD_WHO, m.Args[0], "%tcuhnfar,"+whoxToken))
+			}
+		}
+		// extended-join: JOIN #chan account :realname
+		if len(m.Args) < 3 {
+			return
+		}
+		s.updateUser(id.Nick, false, func(u *User) {
+			u.Account, u.Realname = account(m.Args[1]), m.Args[2]
+		})
+	case CMD_PART:
+		if s.Me(id) {
+			s.pruneUsers()
+		} else {
+			s.pruneUsers(id.Nick)
+		}
+	case CMD_KICK:
+		if len(m.Args) < 2 {
+			return
+		}
+		if s.isupport.EqualFold(m.Args[1], s.id.Nick) {
+			s.pruneUsers()
+		} else {
+			s.pruneUsers(m.Args[1])
+		}
+		s.trigger(ON_KICK, m)
+	case CMD_QUIT:
+		s.lock.Lock()
+		delete(s.users, s.ToLower(id.Nick))
+		s.lock.Unlock()
+		s.trigger(ON_QUIT, m)
+	case CMD_NICK:
+		if len(m.Args) < 1 {
+			return
+		}
+		s.lock.Lock()
+		if u, ok := s.users[s.ToLower(id.Nick)]; ok {
+			delete(s.users, s.ToLower(id.Nick))
+			u.Nick = m.Args[0]
+			s.users[s.ToLower(u.Nick)] = u
+		}
+		s.lock.Unlock()
+		s.trigger(ON_NICK, m)
+	case CMD_ACCOUNT:
+		// account-notify: :nick!user@host ACCOUNT <account|*>
+		if len(m.Args) < 1 {
+			return
+		}
+		s.updateUser(id.Nick, false, func(u *User) {
+			u.Account = account(m.Args[0])
+		})
+		s.trigger(ON_ACCOUNT, m)
+	case CMD_CHGHOST:
+		// :nick!user@host CHGHOST <user> <host>
+		if len(m.Args) < 2 {
+			return
+		}
+		s.updateUser(id.Nick, false, func(u *User) {
+			u.User, u.Host = m.Args[0], m.Args[1]
+		})
+	case RPL_NAMREPLY:
+		// :server 353 me = #chan :[@]nick[!user@host]...
+		if len(m.Args) < 4 || s.GetChannel(m.Args[2]) == nil {
+			return
+		}
+		_, prefixes := s.isupport.Prefix()
+		for _, name := range strings.Fields(m.Args[3]) {
+			id := (&Message{Prefix: strings.TrimLeft(name, prefixes)}).ID()
+			if id.Nick == "" {
+				id.Nick = id.Host
+				id.Host = ""
+			}
+			s.updateUser(id.Nick, true, func(u *User) {
+				if id.User != "" {
+					u.User, u.Host = id.User, id.Host
+				}
+			})
+		}
+	case RPL_WHOREPLY:
+		// :server 352 me #chan user host server nick flags :hops realname
+		if len(m.Args) < 8 {
+			return
+		}
+		realname := m.Args[7]
+		if sp := strings.IndexByte(realname, ' '); sp >= 0 {
+			realname = realname[sp+1:]
+		}
+		s.updateUser(m.Args[5], false, func(u *User) {
+			u.User, u.Host, u.Realname = m.Args[2], m.Args[3], realname
+		})
+	case RPL_WHOSPCRPL:
+		// :server 354 me token #chan user host nick flags account :realname
+		if len(m.Args) < 9 || m.Args[1] != whoxToken {
+			return
+		}
+		s.updateUser(m.Args[5], false, func(u *User) {
+			u.User, u.Host = m.Args[3], m.Args[4]
+			u.Account, u.Realname = account(m.Args[7]), m.Args[8]
+		})
+	}
+}
+
+type userSorter []User
+
+func (u userSorter) Len() int           { return len(u) }
+func (u userSorter) Less(i, j int) bool { return u[i].Nick < u[j].Nick }
+func (u userSorter) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserTracking(t *testing.T) {
+	b := New("n", "u")
+	events := make(chan string, 10)
+	for _, evt := range []string{ON_NICK, ON_QUIT, ON_ACCOUNT, ON_KICK} {
+		b.OnEvent(evt, func(e string, s *Server, m *Message) {
+			events <- e + " " + m.ID().Nick
+		})
+	}
+
+	c := newTestConn(t, b)
+	defer c.Close()
+
+	c.Send(
+		":serv 001 n :Welcome",
+		":serv 005 n WHOX :are supported",
+		":n!u@h JOIN #chan * :Bot",
+	)
+	if got, want := c.Sync(), []string{"WHO #chan %tcuhnfar," + whoxToken}; !reflect.DeepEqual(got[len(got)-1:], want) {
+		t.Errorf("after join, sent %q, want %q", got, want)
+	}
+
+	c.Send(
+		":serv 353 n = #chan :n @alice bob carol",
+		":serv 366 n #chan :End of NAMES list",
+		":serv 354 n "+whoxToken+" #chan ali ce.host alice H@ alice_acct :Alice A.",
+		":serv 354 n "+whoxToken+" #chan bob bob.host bob H 0 :Bob B.",
+		":dave!d@dave.host JOIN #chan dave_acct :Dave D.",
+		":bob!bob@bob.host ACCOUNT bob_acct",
+		":alice!ali@ce.host NICK Alicia",
+		":carol!c@carol.host QUIT :bye",
+		":Alicia!ali@ce.host KICK #chan dave :out",
+		"@account=bob_new :bob!bob@new.host PRIVMSG #chan :hi",
+	)
+	c.Sync()
+
+	want := map[string]User{
+		"n":      {Nick: "n", User: "u", Host: "h", Realname: "Bot", Channels: []string{"#chan"}},
+		"Alicia": {Nick: "Alicia", User: "ali", Host: "ce.host", Realname: "Alice A.", Account: "alice_acct", Channels: []string{"#chan"}},
+		"bob":    {Nick: "bob", User: "bob", Host: "new.host", Realname: "Bob B.", Account: "bob_new", Channels: []string{"#chan"}},
+	}
+	got := map[string]User{}
+	for _, u := range c.serv.Users() {
+		got[u.Nick] = u
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("users = %+v, want %+v", got, want)
+	}
+
+	if u, ok := c.serv.User("ALICIA"); !ok || u.Account != "alice_acct" {
+		t.Errorf("User(ALICIA) = %+v, %v", u, ok)
+	}
+	if _, ok := c.serv.User("alice"); ok {
+		t.Errorf("old nick still tracked")
+	}
+
+	wantEvents := map[string]bool{
+		ON_ACCOUNT + " bob": true,
+		ON_NICK + " alice":  true,
+		ON_QUIT + " carol":  true,
+		ON_KICK + " Alicia": true,
+	}
+	timeout := time.After(1 * time.Second)
+	for len(wantEvents) > 0 {
+		select {
+		case e := <-events:
+			if !wantEvents[e] {
+				t.Errorf("unexpected event %q", e)
+			}
+			delete(wantEvents, e)
+		case <-timeout:
+			t.Fatalf("timed out waiting for events %v", wantEvents)
+		}
+	}
+
+	c.Send(":n!u@h PART #chan")
+	c.Sync()
+	if users := c.serv.Users(); len(users) != 1 || users[0].Nick != "n" {
+		t.Errorf("after part, users = %+v, want only the bot", users)
+	}
+}
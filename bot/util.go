@@ -14,10 +14,24 @@ func isspecial(r rune) bool {
 	return (r >= '[' && r <= '`') || (r >= '{' && r <= '}')
 }
 
-// TODO(kevlar): Tests
+// ToLower casefolds the string using the rfc1459 casemapping.  Use
+// Server.ToLower to fold using the casemapping advertised by a server.
 func ToLower(str string) string {
+	return toLower(str, CASEMAP_RFC1459)
+}
+
+func toLower(str, casemap string) string {
+	var max rune
+	switch casemap {
+	case CASEMAP_ASCII:
+		max = 'Z'
+	case CASEMAP_STRICT:
+		max = ']'
+	default:
+		max = '^'
+	}
 	return strings.Map(func(r rune) rune {
-		if r >= 'A' && r <= '^' {
+		if r >= 'A' && r <= max {
 			return r - 'A' + 'a'
 		}
 		return r
@@ -64,6 +78,8 @@ func ValidServerPrefix(pfx string) bool {
 	return true
 }
 
+// ValidNick returns true if the string is a valid nick.  It does not check
+// the length; use Server.Features().ValidNick to check that as well.
 func ValidNick(str string) bool {
 	if len(str) == 0 {
 		return false
@@ -79,11 +95,24 @@ func ValidNick(str string) bool {
 	return true
 }
 
+// ValidChannel returns true if the string is a valid #channel name.  Use
+// Server.Features().ValidChannel to check using the channel types advertised
+// by a server.
 func ValidChannel(str string) bool {
+	return validChannel(str, "#")
+}
+
+// ValidChannelTypes returns true if the string is a valid channel name
+// beginning with one of the given channel types (as in CHANTYPES, e.g. "#&").
+func ValidChannelTypes(str, chantypes string) bool {
+	return validChannel(str, chantypes)
+}
+
+func validChannel(str, chantypes string) bool {
 	if len(str) == 0 {
 		return false
 	}
-	if str[0] != '#' {
+	if strings.IndexByte(chantypes, str[0]) < 0 {
 		return false
 	}
 	for _, r := range str {
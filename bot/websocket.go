@@ -0,0 +1,328 @@
+package bot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The IRCv3 WebSocket subprotocols.  With WS_TEXT, lines are sent as UTF-8
+// text frames; with WS_BINARY, as binary frames.
+const (
+	WS_TEXT   = "text.ircv3.net"
+	WS_BINARY = "binary.ircv3.net"
+)
+
+// The GUID used to compute Sec-WebSocket-Accept (RFC 6455)
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// The largest message we accept from the server
+const wsMaxMessage = 1 << 16
+
+// WebSocket returns a dialer which connects to an IRC server using the
+// IRCv3 WebSocket binding, with each line in its own frame.  The URL must
+// use the ws or wss scheme.  netOpts configures the TCP connection and opts
+// configures TLS for wss; either may be nil.
+func WebSocket(rawurl string, netOpts *NetOptions, opts *TLSOptions) Dialer {
+	return DialerFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return dialWebSocket(ctx, rawurl, netOpts, opts)
+	})
+}
+
+// dialWebSocket connects to the URL and performs the opening handshake.
+func dialWebSocket(ctx context.Context, rawurl string, netOpts *NetOptions, opts *TLSOptions) (io.ReadWriteCloser, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		if opts == nil {
+			opts = new(TLSOptions)
+		}
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+
+	if u.Scheme != "wss" {
+		opts = nil
+	}
+	conn, err := dialTCP(ctx, &net.Dialer{Timeout: DialTimeout}, addr, netOpts, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := wsHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value for the given key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsHandshake performs the client side of the opening handshake.
+func wsHandshake(conn net.Conn, u *url.URL) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {WS_TEXT + ", " + WS_BINARY},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	in := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(in, req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, fmt.Errorf("websocket: handshake failed: %s", resp.Status)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"):
+		return nil, errors.New("websocket: server did not upgrade the connection")
+	case resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key):
+		return nil, errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+
+	ws := &wsConn{
+		conn:   conn,
+		in:     in,
+		opcode: wsText,
+		client: true,
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") == WS_BINARY {
+		ws.opcode = wsBinary
+	}
+	return ws, nil
+}
+
+// A wsConn carries IRC lines over a WebSocket connection.  Each line written
+// is sent as a frame, and each message read is returned as a line.
+type wsConn struct {
+	conn   net.Conn
+	in     *bufio.Reader
+	opcode byte // for the frames we send
+	client bool // whether we mask our frames
+
+	wlock sync.Mutex
+	line  []byte // the partial line being written, protected by wlock
+
+	buf []byte // the rest of the last message read
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = append(msg, '\r', '\n')
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// readMessage returns the next data message, answering control frames.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := readFrame(c.in)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		}
+
+		msg = append(msg, payload...)
+		if len(msg) > wsMaxMessage {
+			return nil, errors.New("websocket: message too long")
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	c.line = append(c.line, p...)
+	for {
+		nl := bytes.IndexByte(c.line, '\n')
+		if nl < 0 {
+			break
+		}
+		line := strings.TrimRight(string(c.line[:nl]), "\r")
+		c.line = c.line[nl+1:]
+		if line == "" {
+			continue
+		}
+		if c.opcode == wsText {
+			line = strings.ToValidUTF8(line, "\uFFFD")
+		}
+		if err := writeFrame(c.conn, c.opcode, []byte(line), c.client); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return writeFrame(c.conn, op, payload, c.client)
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000: normal closure
+	return c.conn.Close()
+}
+
+// readFrame reads a frame, unmasking its payload if necessary.
+func readFrame(r *bufio.Reader) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	masked, length := head[1]&0x80 != 0, uint64(head[1]&0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, errors.New("websocket: frame too long")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes payload as a single frame, masked if mask is true (as
+// frames from clients must be).
+func writeFrame(w io.Writer, op byte, payload []byte, mask bool) error {
+	frame := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if mask {
+		frame[1] |= 0x80
+		var key [4]byte
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= key[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
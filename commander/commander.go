@@ -4,6 +4,7 @@ import (
 	"log"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/kylelemons/blightbot/bot"
 )
@@ -23,6 +24,7 @@ type Command struct {
 	hook     Hook
 	min, max int
 	priv     bool
+	ops      bool
 }
 
 // Args limits the command to only be called when the given minimum or
@@ -45,6 +47,14 @@ func (c *Command) Private() *Command {
 	return c
 }
 
+// Ops restricts the command to channel operators: of the channel it is
+// used in, or of any channel shared with the bot if it is sent privately.
+// The command is returned for easy chaining.
+func (c *Command) Ops() *Command {
+	c.ops = true
+	return c
+}
+
 // Help sets the help text for the command
 func (c *Command) Help(text string) *Command {
 	c.help = text
@@ -63,8 +73,8 @@ func Cmd(name string, hook Hook) *Command {
 }
 
 // Run creates the proper bindings on the bot and listens for commands on its
-// servers.  This function does not exit, and so it should be called in its own
-// goroutine if further work needs to be done.
+// servers.  This function does not exit until the bot is closed, and so it
+// should be called in its own goroutine if further work needs to be done.
 func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 	// Handy local type for bundling data
 	type event struct {
@@ -76,7 +86,10 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 	// Make the event handler
 	events := make(chan event, 10)
 	handle := func(evname string, srv *bot.Server, msg *bot.Message) {
-		events <- event{evname, srv, msg}
+		select {
+		case events <- event{evname, srv, msg}:
+		case <-b.Done():
+		}
 	}
 
 	// Listen for the events we want
@@ -85,7 +98,8 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 		bot.ON_PRIVMSG,
 		bot.ON_NOTICE,
 	} {
-		b.OnEvent(evname, handle)
+		reg := b.OnEvent(evname, handle)
+		defer reg.Remove()
 	}
 
 	// Sort the commands for help
@@ -134,6 +148,18 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 		cmds = append(cmds, c)
 	}
 
+	// Add lag
+	if _, ok := cmdmap["LAG"]; !ok {
+		c := &Command{
+			name: "LAG",
+			help: "Show the bot's lag to the server (channel operators only)",
+			ops:  true,
+			hook: lag,
+		}
+		cmdmap["LAG"] = append(cmdmap["LAG"], c)
+		cmds = append(cmds, c)
+	}
+
 	// Add the help command
 	if _, ok := cmdmap["HELP"]; !ok {
 		c := &Command{
@@ -147,7 +173,14 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 	}
 
 	// Wait for events and handle them
-	for e := range events {
+	for {
+		var e event
+		select {
+		case e = <-events:
+		case <-b.Done():
+			return
+		}
+
 		// Ignore malformatted messages
 		if len(e.msg.Args) < 2 || len(e.msg.Args[1]) == 0 {
 			continue
@@ -180,11 +213,23 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 			continue
 		}
 
+		// Leave out the commands the sender may not use
+		var allowed []*Command
+		for _, c := range cmd {
+			if !c.ops || isOp(e.srv, e.msg, e.name) {
+				allowed = append(allowed, c)
+			}
+		}
+		if len(allowed) == 0 {
+			continue
+		}
+
 		// Build the reply
-		replies := make(chan *bot.Message, 10)
+		replies := make(chan reply, 10)
 		go func() {
 			if ctcp {
-				for m := range replies {
+				for r := range replies {
+					m := r.msg
 					switch m.Command {
 					case bot.CMD_PRIVMSG:
 						fallthrough
@@ -193,16 +238,18 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 							m.Args[1] = EncodeCTCP(m.Args[1])
 						}
 					}
-					e.srv.WriteMessage(m)
+					e.srv.WritePriority(m, r.pri)
 				}
 				return
 			}
-			for m := range replies {
-				e.srv.WriteMessage(m)
+			for r := range replies {
+				e.srv.WritePriority(r.msg, r.pri)
 			}
 		}()
 		resp := &Response{
-			out: replies,
+			out:  replies,
+			serv: e.srv,
+			pri:  bot.PriorityNormal,
 		}
 		src := &Source{
 			server:  e.srv,
@@ -224,15 +271,63 @@ func Run(b *bot.Bot, startchar byte, cmds []*Command) {
 		}
 
 		// Call the hook
-		for _, cmd := range cmd {
+		for _, cmd := range allowed {
 			cmd.hook.call(src, resp, command, args)
 		}
 	}
 }
 
+// isOp returns true if the sender of the message is a channel operator in the
+// channel it was sent to or, if it was sent privately, in any channel shared
+// with the bot.
+func isOp(srv *bot.Server, msg *bot.Message, evname string) bool {
+	nick := msg.ID().Nick
+	if evname == bot.ON_CHANMSG {
+		ch := srv.GetChannel(msg.Args[0])
+		return ch != nil && ch.IsOp(nick)
+	}
+	for _, ch := range srv.Channels() {
+		if ch.IsOp(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// lag reports the bot's lag to the server.
+func lag(s *Source, r *Response, cmd string, args []string) {
+	r.Public()
+	srv := s.Server()
+
+	history := srv.LagHistory()
+	if len(history) == 0 {
+		r.Printf("Lag: %s (no PINGs answered yet)", srv.Lag())
+		return
+	}
+	min, max, total := history[0], history[0], time.Duration(0)
+	for _, rtt := range history {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		total += rtt
+	}
+	avg := total / time.Duration(len(history))
+
+	status := ""
+	if srv.Lagging() {
+		status = " " + Bold("LAGGING")
+	}
+	r.Printf("Lag: %s%s (last %d: min %s, avg %s, max %s)", srv.Lag().Round(time.Millisecond), status,
+		len(history), min.Round(time.Millisecond), avg.Round(time.Millisecond), max.Round(time.Millisecond))
+}
+
 func genhelp(cmds []*Command, cmdwidth int) Hook {
 	return func(s *Source, r *Response, cmd string, args []string) {
 		r.Private()
+		r.Bulk()
 		r.Printf("Help:")
 
 		name, sent := "", 0
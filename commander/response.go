@@ -7,9 +7,15 @@ import (
 	"github.com/kylelemons/blightbot/bot"
 )
 
+type reply struct {
+	msg *bot.Message
+	pri bot.Priority
+}
+
 type Response struct {
 	// Reply channel
-	out chan *bot.Message
+	out  chan reply
+	serv *bot.Server
 
 	// Possible settings
 	public  string
@@ -18,12 +24,13 @@ type Response struct {
 	// The current setting
 	target string
 	msgtyp string
+	pri    bot.Priority
 }
 
 func (r *Response) Public() {
 	r.target = r.public
 	r.msgtyp = bot.CMD_NOTICE
-	if len(r.target) > 0 && r.target[0] == '#' {
+	if r.serv.IsChannel(r.target) {
 		r.msgtyp = bot.CMD_PRIVMSG
 	}
 }
@@ -31,23 +38,29 @@ func (r *Response) Public() {
 func (r *Response) Private() {
 	r.target = r.private
 	r.msgtyp = bot.CMD_NOTICE
-	if len(r.target) > 0 && r.target[0] == '#' {
+	if r.serv.IsChannel(r.target) {
 		r.msgtyp = bot.CMD_PRIVMSG
 	}
 }
 
+// Bulk sends the rest of the response at bulk priority, so that long output
+// does not hold up other replies.
+func (r *Response) Bulk() {
+	r.pri = bot.PriorityBulk
+}
+
 func (r *Response) WriteString(s string) {
 	if r.target == "" {
 		return
 	}
-	r.out <- bot.NewMessage("", r.msgtyp, r.target, s)
+	r.out <- reply{bot.NewMessage("", r.msgtyp, r.target, s), r.pri}
 }
 
 func (r *Response) Printf(format string, args ...interface{}) {
 	if r.target == "" {
 		return
 	}
-	r.out <- bot.NewMessage("", r.msgtyp, r.target, fmt.Sprintf(format, args...))
+	r.out <- reply{bot.NewMessage("", r.msgtyp, r.target, fmt.Sprintf(format, args...)), r.pri}
 }
 
 func (r *Response) done() {
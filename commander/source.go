@@ -20,3 +20,9 @@ func (s *Source) Message() *bot.Message {
 func (s *Source) ID() *bot.Identity {
 	return s.message.ID()
 }
+
+// User returns what the server knows about the sender of the message, if they
+// share a channel with the bot.
+func (s *Source) User() (bot.User, bool) {
+	return s.server.User(s.message.ID().Nick)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kylelemons/blightbot/bot"
+)
+
+// A Config describes the networks to which the bot connects, each with its
+// own identity, channels and modules.  It is loaded from the JSON file named
+// by -config, for example:
+//
+//	{
+//	  "networks": [{
+//	    "name": "libera",
+//	    "servers": ["irc.libera.chat:6697"],
+//	    "tls": true,
+//	    "nick": "BlightBot",
+//	    "alt_nicks": ["BlightBot_"],
+//	    "identify": "hunter2",
+//	    "channels": ["#ircd-blight", {"name": "#secret", "key": "sesame"}],
+//	    "modules": ["gonuts"],
+//	    "prefix": "!"
+//	  }]
+//	}
+//
+// Flags given on the command line override the settings of every network.
+// Without -config, the networks are described by -servers and -pass.
+type Config struct {
+	Networks []*NetConfig `json:"networks"`
+}
+
+// A NetConfig describes a network and the bot which connects to it.  The
+// fields correspond to the flags of the same names.
+type NetConfig struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers"` // as in -servers, one per element
+	Pass    string   `json:"pass"`
+
+	TLS         bool   `json:"tls"`
+	TLSCert     string `json:"tls_cert"`
+	TLSCA       string `json:"tls_ca"`
+	TLSInsecure bool   `json:"tls_insecure"`
+
+	Proxy string `json:"proxy"`
+	Bind  string `json:"bind"`
+	IPv6  bool   `json:"ipv6"`
+
+	Nick     string   `json:"nick"`
+	User     string   `json:"user"`
+	AltNicks []string `json:"alt_nicks"`
+
+	Identify     string `json:"identify"`
+	SASLUser     string `json:"sasl_user"`
+	SASLExternal bool   `json:"sasl_external"`
+	SASLRequired bool   `json:"sasl_required"`
+	Ghost        bool   `json:"ghost"`
+
+	Channels  []ChanConfig `json:"channels"`
+	ChanTypes string       `json:"chantypes"` // the network's CHANTYPES, for checking Channels
+	Modules   []string     `json:"modules"`
+	Prefix    string       `json:"prefix"`
+
+	// Link, if non-nil, links to the network as a TS6 server (see
+	// bot.Link), e.g. {"name": "bot.example.net", "sid": "0BB",
+	// "password": "secret"}.
+	Link *bot.Link `json:"link"`
+}
+
+// A ChanConfig is a channel to join, and its key if it has one.  In the
+// file, a channel without a key may be given as just its name.
+type ChanConfig struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+func (c *ChanConfig) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*c = ChanConfig{}
+		return json.Unmarshal(data, &c.Name)
+	}
+	type chanConfig ChanConfig
+	return json.Unmarshal(data, (*chanConfig)(c))
+}
+
+// config returns the configuration described by -config, or by the flags
+// alone, with any flags which were given applied on top.
+func config() (*Config, error) {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return buildConfig(given)
+}
+
+// buildConfig returns the configuration as config does, given the names of
+// the flags which were set.
+func buildConfig(given map[string]bool) (*Config, error) {
+	if *configFile == "" {
+		cfg := flagConfig()
+		return cfg, cfg.check()
+	}
+	for _, name := range []string{"servers", "pass", "link-name", "link-sid"} {
+		if given[name] {
+			return nil, fmt.Errorf("-%s cannot be used with -config; set it for each network in %s", name, *configFile)
+		}
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range cfg.Networks {
+		for name, set := range overrides {
+			if given[name] {
+				set(n)
+			}
+		}
+		n.defaults()
+	}
+	return cfg, cfg.check()
+}
+
+// loadConfig reads a configuration file.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	cfg := new(Config)
+	if err := dec.Decode(cfg); err != nil {
+		var offset int64 = -1
+		var syntax *json.SyntaxError
+		var typ *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntax):
+			offset = syntax.Offset
+		case errors.As(err, &typ):
+			offset = typ.Offset
+		}
+		if offset >= 0 {
+			line := 1 + bytes.Count(data[:offset], []byte("\n"))
+			return nil, fmt.Errorf("config: %s:%d: %s", path, line, err)
+		}
+		return nil, fmt.Errorf("config: %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// flagConfig returns the configuration described by the flags: a network
+// for each comma-separated entry in -servers, with the password in the same
+// position in -pass, and the same identity and channels on each.
+func flagConfig() *Config {
+	cfg := new(Config)
+	p := strings.Split(*pass, ",")
+	for i, addrs := range strings.Split(*server, ",") {
+		n := new(NetConfig)
+		n.Servers = strings.Split(addrs, "|")
+		if i < len(p) {
+			n.Pass = p[i]
+		}
+		for _, set := range overrides {
+			set(n)
+		}
+		if *linkName != "" {
+			n.Link = &bot.Link{Name: *linkName, SID: *linkSID}
+		}
+		n.defaults()
+		cfg.Networks = append(cfg.Networks, n)
+	}
+	return cfg
+}
+
+// Settings which the flags override, by flag name.
+var overrides = map[string]func(n *NetConfig){
+	"tls":          func(n *NetConfig) { n.TLS = *useTLS },
+	"tls-cert":     func(n *NetConfig) { n.TLSCert = *tlsCert },
+	"tls-ca":       func(n *NetConfig) { n.TLSCA = *tlsCA },
+	"tls-insecure": func(n *NetConfig) { n.TLSInsecure = *tlsInsecure },
+
+	"proxy": func(n *NetConfig) { n.Proxy = *proxy },
+	"bind":  func(n *NetConfig) { n.Bind = *bind },
+	"ipv6":  func(n *NetConfig) { n.IPv6 = *ipv6 },
+
+	"nick":      func(n *NetConfig) { n.Nick = *nick },
+	"user":      func(n *NetConfig) { n.User = *user },
+	"alt-nicks": func(n *NetConfig) { n.AltNicks = split(*altNicks) },
+
+	"identify":      func(n *NetConfig) { n.Identify = *nsid },
+	"sasl-user":     func(n *NetConfig) { n.SASLUser = *saslUser },
+	"sasl-external": func(n *NetConfig) { n.SASLExternal = *saslExternal },
+	"sasl-required": func(n *NetConfig) { n.SASLRequired = *saslRequired },
+	"ghost":         func(n *NetConfig) { n.Ghost = *ghost },
+
+	"channels": func(n *NetConfig) {
+		n.Channels = nil
+		for _, name := range split(*channel) {
+			n.Channels = append(n.Channels, ChanConfig{Name: name})
+		}
+	},
+	"modules": func(n *NetConfig) { n.Modules = split(*modules) },
+	"prefix":  func(n *NetConfig) { n.Prefix = *prefix },
+}
+
+// split splits a comma-separated flag, ignoring empty entries.
+func split(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// defaults fills in the settings which were left empty.
+func (n *NetConfig) defaults() {
+	if n.Name == "" && len(n.Servers) > 0 {
+		n.Name, _, _ = strings.Cut(n.Servers[0], ";")
+	}
+	if n.Nick == "" {
+		n.Nick = randname()
+	}
+	if n.User == "" {
+		n.User = "blight"
+	}
+	if n.Prefix == "" {
+		n.Prefix = "!"
+	}
+	if n.ChanTypes == "" {
+		n.ChanTypes = "#&"
+	}
+	if n.Link != nil && n.Link.Password == "" {
+		n.Link.Password = n.Pass
+	}
+}
+
+// network returns the index of the named network, which may be omitted if
+// there is only one.
+func (c *Config) network(name string) (int, error) {
+	if name == "" {
+		if len(c.Networks) != 1 {
+			return 0, fmt.Errorf("config: %d networks; name one of them", len(c.Networks))
+		}
+		return 0, nil
+	}
+	for i, n := range c.Networks {
+		if n.Name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("config: no network named %q", name)
+}
+
+// check returns the problems with the configuration, if any, naming the
+// network each is in.
+func (c *Config) check() error {
+	if len(c.Networks) == 0 {
+		return errors.New("config: no networks")
+	}
+
+	var errs []error
+	names := map[string]bool{}
+	for i, n := range c.Networks {
+		where := fmt.Sprintf("network %d", i+1)
+		if n.Name != "" {
+			where = fmt.Sprintf("network %q", n.Name)
+		}
+		for _, err := range n.check() {
+			errs = append(errs, fmt.Errorf("config: %s: %s", where, err))
+		}
+		if names[n.Name] {
+			errs = append(errs, fmt.Errorf("config: %s: duplicate name", where))
+		}
+		names[n.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// check returns the problems with the network's settings.
+func (n *NetConfig) check() []error {
+	var errs []error
+	bad := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(n.Servers) == 0 {
+		bad("no servers")
+	}
+	for _, addr := range n.Servers {
+		if addr == "" || strings.ContainsAny(addr, ", |") {
+			bad("invalid server %q", addr)
+		}
+		if strings.HasPrefix(addr, "unix:") && (strings.Contains(addr, ";") || n.Proxy != "" || n.Bind != "" || n.IPv6) {
+			bad("proxy, bind and ipv6 cannot be used with unix socket %q", addr)
+		}
+	}
+	for _, nick := range append([]string{n.Nick}, n.AltNicks...) {
+		if !bot.ValidNick(nick) {
+			bad("invalid nick %q", nick)
+		}
+	}
+	if n.User == "" || strings.ContainsAny(n.User, " @!") {
+		bad("invalid user name %q", n.User)
+	}
+	for _, ch := range n.Channels {
+		if !bot.ValidChannelTypes(ch.Name, n.ChanTypes) {
+			bad("invalid channel %q", ch.Name)
+		}
+		if strings.ContainsAny(ch.Key, " ,") {
+			bad("invalid key for %s", ch.Name)
+		}
+	}
+	for _, mod := range n.Modules {
+		if _, ok := modlists[mod]; !ok {
+			bad("unknown module %q (have: %s)", mod, modlist())
+		}
+	}
+	if len(n.Prefix) != 1 {
+		bad("prefix %q is not a single character", n.Prefix)
+	}
+	if n.SASLExternal && n.TLSCert == "" {
+		bad("sasl_external requires tls_cert")
+	}
+	if (n.TLSCert != "" || n.TLSCA != "" || n.TLSInsecure) && !n.TLS {
+		bad("TLS settings given without tls")
+	}
+	if n.Ghost && n.Identify == "" {
+		bad("ghost requires identify")
+	}
+	return errs
+}
+
+// network returns the bot.Network for the configuration.
+func (n *NetConfig) network() *bot.Network {
+	var tlsOpts *bot.TLSOptions
+	if n.TLS {
+		tlsOpts = &bot.TLSOptions{
+			CAFile:   n.TLSCA,
+			CertFile: n.TLSCert,
+			Insecure: n.TLSInsecure,
+		}
+	}
+	netOpts := &bot.NetOptions{
+		Proxy:      n.Proxy,
+		Bind:       n.Bind,
+		PreferIPv6: n.IPv6,
+	}
+
+	net := &bot.Network{
+		Name:       n.Name,
+		Pass:       n.Pass,
+		TLS:        tlsOpts,
+		Net:        netOpts,
+		Link:       n.Link,
+		MinBackoff: *delay,
+		MaxBackoff: *rdelay,
+	}
+	for _, ch := range n.Channels {
+		entry := ch.Name
+		if ch.Key != "" {
+			entry += " " + ch.Key
+		}
+		net.Channels = append(net.Channels, entry)
+	}
+	for _, addr := range n.Servers {
+		addr, opts := serverOptions(addr, netOpts)
+		if opts != netOpts {
+			if net.AddrNet == nil {
+				net.AddrNet = map[string]*bot.NetOptions{}
+			}
+			net.AddrNet[addr] = opts
+		}
+		net.Addrs = append(net.Addrs, addr)
+	}
+	net.Transport = transport(net.AddrNet, netOpts, tlsOpts)
+	return net
+}
+
+// sasl returns the SASL settings for the network, or nil.
+func (n *NetConfig) sasl() *bot.SASL {
+	auth := &bot.SASL{
+		User:     n.SASLUser,
+		Pass:     n.Identify,
+		Required: n.SASLRequired,
+	}
+	switch {
+	case n.SASLExternal:
+		auth.Mechanism = bot.SASL_EXTERNAL
+	case n.Identify != "":
+		auth.Mechanism = bot.SASL_PLAIN
+		if auth.User == "" {
+			auth.User = n.Nick
+		}
+	default:
+		return nil
+	}
+	return auth
+}
+
+// onConnect identifies with NickServ if SASL was not available.  It is
+// registered synchronously, so that it does so before the network's channels
+// are joined.
+func (n *NetConfig) onConnect(event string, serv *bot.Server, msg *bot.Message) {
+	if n.Identify != "" && serv.Account() == "" {
+		// SASL was not available, fall back to NickServ
+		serv.WriteMessage(bot.NewMessage("", bot.CMD_PRIVMSG, "NickServ", "IDENTIFY "+n.Identify))
+	}
+}
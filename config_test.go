@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file for the test and returns its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("write config: %s", err)
+	}
+	return path
+}
+
+// setFlag sets a flag's value for the duration of the test.
+func setFlag(t *testing.T, p *string, val string) {
+	old := *p
+	*p = val
+	t.Cleanup(func() { *p = old })
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		Desc string
+		Data string
+		Want string
+	}{
+		{
+			Desc: "syntax",
+			Data: "{\n  \"networks\": [\n    {\"name\": \"a\",}\n  ]\n}\n",
+			Want: "config.json:3: invalid character",
+		},
+		{
+			Desc: "type",
+			Data: "{\n  \"networks\": [{\n    \"name\": \"a\",\n    \"tls\": \"yes\"\n  }]\n}\n",
+			Want: "config.json:4: json: cannot unmarshal string",
+		},
+		{
+			Desc: "unknown field",
+			Data: `{"networks": [{"name": "a", "nikc": "bot"}]}`,
+			Want: `unknown field "nikc"`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := loadConfig(writeConfig(t, test.Data))
+		if err == nil || !strings.Contains(err.Error(), test.Want) {
+			t.Errorf("%s: loadConfig = %v, want error containing %q", test.Desc, err, test.Want)
+		}
+	}
+}
+
+func TestConfigChannels(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{"networks": [{
+		"name": "a",
+		"channels": ["#plain", {"name": "#keyed", "key": "sesame"}, {"name": "#object"}]
+	}]}`))
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	want := []ChanConfig{{Name: "#plain"}, {Name: "#keyed", Key: "sesame"}, {Name: "#object"}}
+	if got := cfg.Networks[0].Channels; !reflect.DeepEqual(got, want) {
+		t.Errorf("channels = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	cfg := &Config{Networks: []*NetConfig{
+		{Name: "a", Servers: []string{"a.example:6667"}},
+		{Name: "b", Servers: []string{"b.example:6667"}},
+		{Name: "a", Servers: []string{"c.example:6667"}},
+	}}
+	for _, n := range cfg.Networks {
+		n.Nick = "bot"
+		n.defaults()
+	}
+	err := cfg.check()
+	if err == nil || !strings.Contains(err.Error(), `network "a": duplicate name`) {
+		t.Errorf("check = %v, want duplicate name", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "\n") {
+		t.Errorf("check = %v, want only the duplicate", err)
+	}
+
+	unix := &NetConfig{Name: "u", Servers: []string{"unix:/run/irc.sock"}, Nick: "bot", Proxy: "socks5://127.0.0.1:1080"}
+	unix.defaults()
+	if errs := unix.check(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "unix socket") {
+		t.Errorf("check with a proxied unix socket = %v, want one error", errs)
+	}
+
+	if _, err := cfg.network(""); err == nil {
+		t.Errorf("network(\"\") with %d networks succeeded", len(cfg.Networks))
+	}
+	if i, err := cfg.network("b"); err != nil || i != 1 {
+		t.Errorf("network(b) = %d, %v; want 1", i, err)
+	}
+	if _, err := cfg.network("missing"); err == nil {
+		t.Errorf("network(missing) succeeded")
+	}
+}
+
+func TestBuildConfig(t *testing.T) {
+	path := writeConfig(t, `{"networks": [
+		{"name": "a", "servers": ["a.example:6667"], "nick": "alice", "prefix": "."},
+		{"name": "b", "servers": ["b.example:6667"], "nick": "bob"}
+	]}`)
+	setFlag(t, configFile, path)
+	setFlag(t, nick, "flagnick")
+	setFlag(t, prefix, "@")
+
+	// Flags which were not given leave the file's settings alone
+	cfg, err := buildConfig(map[string]bool{"config": true})
+	if err != nil {
+		t.Fatalf("buildConfig: %s", err)
+	}
+	for i, want := range []struct{ Nick, Prefix string }{{"alice", "."}, {"bob", "!"}} {
+		if n := cfg.Networks[i]; n.Nick != want.Nick || n.Prefix != want.Prefix {
+			t.Errorf("network %s: nick %q, prefix %q; want %q, %q", n.Name, n.Nick, n.Prefix, want.Nick, want.Prefix)
+		}
+	}
+
+	// Flags which were given override them on every network
+	cfg, err = buildConfig(map[string]bool{"config": true, "nick": true})
+	if err != nil {
+		t.Fatalf("buildConfig: %s", err)
+	}
+	for i, want := range []struct{ Nick, Prefix string }{{"flagnick", "."}, {"flagnick", "!"}} {
+		if n := cfg.Networks[i]; n.Nick != want.Nick || n.Prefix != want.Prefix {
+			t.Errorf("network %s: nick %q, prefix %q; want %q, %q", n.Name, n.Nick, n.Prefix, want.Nick, want.Prefix)
+		}
+	}
+
+	for _, name := range []string{"servers", "pass"} {
+		_, err := buildConfig(map[string]bool{"config": true, name: true})
+		if err == nil || !strings.Contains(err.Error(), "-"+name+" cannot be used with -config") {
+			t.Errorf("buildConfig with -%s = %v, want an error", name, err)
+		}
+	}
+}
@@ -170,6 +170,7 @@ var Issue = commander.Cmd("issue", func(src *commander.Source, resp *commander.R
 	}
 
 	sort.Sort(ByLatest(feed.Entry))
+	resp.Bulk()
 	for entryIdx, e := range feed.Entry {
 		if entryIdx >= 5 {
 			break
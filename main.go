@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/kylelemons/blightbot/acro"
@@ -22,20 +27,52 @@ func randname() string {
 }
 
 var (
-	logFile = daemon.LogFileFlag("log", 0644)
+	logFile    = daemon.LogFileFlag("log", 0644)
+	configFile = flag.String("config", "", "JSON file describing each network's servers, identity, channels and modules (see config.go); other flags override its settings")
 
 	nick    = flag.String("nick", randname(), "Nick to use when connecting")
 	user    = flag.String("user", "blight", "Username to use when connecting")
 	pass    = flag.String("pass", "", "Server password to use")
-	nsid    = flag.String("identify", "", "Nickserv password with which to identify")
-	server  = flag.String("servers", "irc.freenode.net:6667", "Servers (addr:port) to which the bot should connect")
+	nsid    = flag.String("identify", "", "Services password with which to identify (using SASL PLAIN if supported)")
+	server  = flag.String("servers", "irc.freenode.net:6667", "Servers (addr:port, ws:// or wss:// URL, or unix:path) to which the bot should connect (commas separate networks, | separates alternate servers, and ;proxy=URL;bind=IP;ipv6 after an addr:port or URL overrides -proxy, -bind and -ipv6)")
 	channel = flag.String("channels", "#ircd-blight,#acrogame", "Channel(s) to join (commas, no spaces)")
-	delay   = flag.Duration("delay", 5*time.Second, "Delay after disconnect")
-	rdelay  = flag.Duration("reconnect-wait", 60*time.Second, "Time to wait before reconnecting after a failed connection")
+	delay   = flag.Duration("delay", bot.DefaultMinBackoff, "Delay before reconnecting, doubled after each failed attempt")
+	rdelay  = flag.Duration("reconnect-wait", 60*time.Second, "Maximum time to wait before reconnecting")
 	modules = flag.String("modules", "", "Comma separated list of modules to load: "+modlist())
-)
+	prefix  = flag.String("prefix", "!", "Character with which commands start")
+
+	useTLS      = flag.Bool("tls", false, "Connect to servers using TLS")
+	tlsCert     = flag.String("tls-cert", "", "PEM file containing the client certificate and key to present (for CertFP)")
+	tlsCA       = flag.String("tls-ca", "", "PEM file containing the CA certificates to trust (default: system roots)")
+	tlsInsecure = flag.Bool("tls-insecure", false, "Do not verify server certificates (for testing only)")
+
+	saslUser     = flag.String("sasl-user", "", "Services account for SASL (default: -nick)")
+	saslExternal = flag.Bool("sasl-external", false, "Authenticate with SASL EXTERNAL using the -tls-cert certificate")
+	saslRequired = flag.Bool("sasl-required", false, "Abort the connection if SASL authentication fails")
+
+	altNicks = flag.String("alt-nicks", "", "Nicks (commas, no spaces) to use if -nick is unavailable")
+	regain   = flag.Duration("regain", bot.DefaultRegainInterval, "How often to check whether -nick has become available (0 to disable)")
+	ghost    = flag.Bool("ghost", false, "Recover -nick with NickServ GHOST instead of REGAIN (requires -identify)")
+
+	floodBurst    = flag.Int("flood-burst", bot.DefaultFloodBurst, "Number of lines which may be sent to a server at once")
+	floodInterval = flag.Duration("flood-interval", bot.DefaultFloodInterval, "Time between lines once the burst is used up (0 to disable flood control)")
+	lagThreshold  = flag.Duration("lag-threshold", bot.DefaultLagThreshold, "Lag above which a server is reported as lagging (0 to disable)")
+
+	proxy = flag.String("proxy", "", "Proxy through which to connect (socks5://[user:pass@]host:port or http://[user:pass@]host:port)")
+	bind  = flag.String("bind", "", "Local IP address from which to connect")
+	ipv6  = flag.Bool("ipv6", false, "Prefer IPv6 addresses when connecting")
+
+	charset      = flag.String("charset", bot.CHARSET_UTF8, "Character set in which to send lines (utf-8, cp1252 or iso-8859-1)")
+	fallback     = flag.String("fallback-charset", bot.CHARSET_CP1252, "Character set of received lines which are not valid UTF-8")
+	chanCharsets = flag.String("channel-charsets", "", "Per-channel character sets, used for sending and as the fallback (#chan=charset, commas, no spaces)")
 
-var servers = map[string]string{}
+	record     = flag.String("record", "", "Directory in which to record each connection's traffic")
+	replayFile = flag.String("replay", "", "Recording to replay through the bot instead of connecting, reporting where the bot's replies differ")
+	replayNet  = flag.String("replay-network", "", "Network (by name) whose bot replays the -replay recording, if there is more than one")
+
+	linkName = flag.String("link-name", "", "Link to the servers as a TS6 server with this name (using -pass as the link password) instead of connecting as a client")
+	linkSID  = flag.String("link-sid", "", "Server ID (e.g. 0BB) with which to link, with -link-name")
+)
 
 var modlists = map[string][]*commander.Command{
 	"gonuts": {
@@ -67,75 +104,216 @@ func modlist() string {
 	return strings.Join(list, " ")
 }
 
-func OnConnect(event string, serv *bot.Server, msg *bot.Message) {
-	if *nsid != "" {
-		serv.WriteMessage(bot.NewMessage("", bot.CMD_PRIVMSG, "NickServ", "IDENTIFY "+*nsid))
-		time.Sleep(3)
+// serverOptions splits the ;-separated options from a server address in
+// -servers, returning the address and the network options for it.  If there
+// are no options, def is returned.
+func serverOptions(addr string, def *bot.NetOptions) (string, *bot.NetOptions) {
+	parts := strings.Split(addr, ";")
+	if len(parts) == 1 {
+		return addr, def
+	}
+
+	opts := *def
+	for _, opt := range parts[1:] {
+		key, val, _ := strings.Cut(opt, "=")
+		switch key {
+		case "proxy":
+			opts.Proxy = val
+		case "bind":
+			opts.Bind = val
+		case "ipv6":
+			opts.PreferIPv6 = val == "" || val == "true"
+		default:
+			log.Fatalf("Unknown option %q for server %q", key, parts[0])
+		}
+	}
+	return parts[0], &opts
+}
+
+// transport returns the dialers for addresses in -servers which are not
+// plain host:port: ws:// and wss:// URLs, which use the network options, and
+// unix:/path/to/socket.  Addresses with their own network options are in
+// addrNet.
+func transport(addrNet map[string]*bot.NetOptions, netOpts *bot.NetOptions, tlsOpts *bot.TLSOptions) func(addr string) bot.Dialer {
+	return func(addr string) bot.Dialer {
+		switch {
+		case strings.HasPrefix(addr, "ws://"), strings.HasPrefix(addr, "wss://"):
+			opts, ok := addrNet[addr]
+			if !ok {
+				opts = netOpts
+			}
+			return bot.WebSocket(addr, opts, tlsOpts)
+		case strings.HasPrefix(addr, "unix:"):
+			return bot.UnixSocket(strings.TrimPrefix(addr, "unix:"))
+		}
+		return nil
 	}
-	serv.WriteMessage(bot.NewMessage("", "JOIN", *channel))
 }
 
-func OnDisconnect(event string, serv *bot.Server, msg *bot.Message) {
-	server, pass := serv.Name(), servers[serv.Name()]
-	log.Printf("Server %q disconnected.", server)
-	time.Sleep(*delay)
-	for {
-		log.Printf("Recnnecting to %q...", server)
-		if err := serv.Bot().ConnectPass(server, pass); err != nil {
-			log.Printf("connect: %s", err)
-			time.Sleep(*rdelay)
+// encoding returns the encoding described by the -charset, -fallback-charset
+// and -channel-charsets flags.
+func encoding() *bot.Encoding {
+	enc := &bot.Encoding{
+		Fallback: *fallback,
+		Outgoing: *charset,
+		Channels: map[string]*bot.Encoding{},
+	}
+	for _, opt := range strings.Split(*chanCharsets, ",") {
+		if opt == "" {
 			continue
 		}
-		break
+		ch, cs, _ := strings.Cut(opt, "=")
+		enc.Channels[ch] = &bot.Encoding{Fallback: cs, Outgoing: cs}
 	}
+	for _, cs := range []string{*charset, *fallback} {
+		if !bot.ValidCharset(cs) {
+			log.Fatalf("Unknown character set %q", cs)
+		}
+	}
+	for ch, e := range enc.Channels {
+		if !bot.ValidCharset(e.Outgoing) {
+			log.Fatalf("Unknown character set %q for %s", e.Outgoing, ch)
+		}
+	}
+	return enc
 }
 
-func main() {
-	flag.Parse()
+// replay feeds the -replay recording through the bot for the network, and
+// reports the lines it sent which differ from those in the recording.
+func replay(b *bot.Bot, n *NetConfig) {
+	f, err := os.Open(*replayFile)
+	if err != nil {
+		log.Fatalf("replay: %s", err)
+	}
+	defer f.Close()
 
-	// Parse servers
-	s, p := strings.Split(*server, ","), strings.Split(*pass, ",")
-	for i, serv := range s {
-		var pass string
-		if i < len(p) {
-			pass = p[i]
+	b.SetClock(bot.NewVirtualClock(time.Time{}))
+	// The replayed server is not part of a network, so join its channels as
+	// the network would
+	channels := n.network().Channels
+	b.OnConnect(func(event string, serv *bot.Server, msg *bot.Message) {
+		for _, entry := range channels {
+			serv.WriteMessage(bot.NewMessage("", bot.CMD_JOIN, strings.Fields(entry)...))
 		}
-		servers[serv] = pass
+	}).Sync()
+	r, err := b.Replay(*replayFile, f)
+	if err != nil {
+		log.Fatalf("replay: %s", err)
+	}
+	defer r.Close()
+	if err := r.Wait(); err != nil {
+		log.Printf("replay: %s", err)
 	}
 
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	sent, recorded := r.Sent(), r.Recorded()
+	diffs := 0
+	for i := 0; i < len(sent) || i < len(recorded); i++ {
+		var got, want string
+		if i < len(sent) {
+			got = sent[i]
+		}
+		if i < len(recorded) {
+			want = recorded[i]
+		}
+		if got != want {
+			fmt.Printf("line %d: sent %q, recorded %q\n", i+1, got, want)
+			diffs++
+		}
+	}
+	fmt.Printf("Replayed %s: sent %d lines (%d recorded), %d differ\n", *replayFile, len(sent), len(recorded), diffs)
+}
 
-	b := bot.New(*nick, *user)
-	b.OnConnect(OnConnect)
-	b.OnDisconnect(OnDisconnect)
+// Modules which have been loaded for any network.
+var started = map[string]bool{}
 
-	var cmds []*commander.Command
-	for _, mod := range strings.Split(*modules, ",") {
-		list, ok := modlists[mod]
-		if !ok {
-			continue
+// newBot returns the bot for a network, with its modules loaded.
+func newBot(n *NetConfig) *bot.Bot {
+	b := bot.New(n.Nick, n.User)
+	b.SetSASL(n.sasl())
+	b.SetFlood(*floodBurst, *floodInterval)
+	b.SetLagThreshold(*lagThreshold)
+	b.SetEncoding(encoding())
+	if len(n.AltNicks) > 0 {
+		b.SetAltNicks(n.AltNicks...)
+	}
+	b.SetRegain(*regain)
+	if n.Identify != "" {
+		ns := &bot.NickServ{Password: n.Identify}
+		if n.Ghost {
+			ns.Command = bot.NICKSERV_GHOST
 		}
-		log.Printf("Loading commands from %q", mod)
-		cmds = append(cmds, list...)
+		b.SetNickServ(ns)
+	}
+	b.OnConnect(n.onConnect).Sync()
+
+	var cmds []*commander.Command
+	for _, mod := range n.Modules {
+		log.Printf("[%s] Loading commands from %q", n.Name, mod)
+		cmds = append(cmds, modlists[mod]...)
 
 		switch mod {
 		case "gonuts":
-			log.Printf("Starting godoc polling")
-			gonuts.StartPolling()
+			if !started[mod] {
+				log.Printf("Starting godoc polling")
+				gonuts.StartPolling()
+			}
+		case "acro":
+			acro.Register(b)
 		case "paste":
-			log.Printf("Initializing paste module")
+			log.Printf("[%s] Initializing paste module", n.Name)
 			paste.Register(b)
 		}
+		started[mod] = true
+	}
+	go commander.Run(b, n.Prefix[0], cmds)
+	return b
+}
+
+func main() {
+	flag.Parse()
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	cfg, err := config()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var bots []*bot.Bot
+	for _, n := range cfg.Networks {
+		bots = append(bots, newBot(n))
+	}
+
+	if *replayFile != "" {
+		i, err := cfg.network(*replayNet)
+		if err != nil {
+			log.Fatalf("replay: %s", err)
+		}
+		replay(bots[i], cfg.Networks[i])
+		return
 	}
-	go commander.Run(b, '!', cmds)
 
-	for server, pass := range servers {
-		log.Printf("Connecting to %q...", server)
-		if err := b.ConnectPass(server, pass); err != nil {
-			log.Fatalf("connect: %s", err)
+	for i, n := range cfg.Networks {
+		if *record != "" {
+			bots[i].SetRecorder(bot.RecordDir(*record))
+		}
+		if err := bots[i].ConnectNetwork(n.network()); err != nil {
+			log.Fatalf("connect %s: %s", n.Name, err)
 		}
 	}
 
 	log.Printf("Bot is running...")
-	select {}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, b := range bots {
+		wg.Add(1)
+		go func(b *bot.Bot) {
+			defer wg.Done()
+			if err := b.Run(ctx); err != nil {
+				log.Printf("Shutting down: %s", err)
+			}
+		}(b)
+	}
+	wg.Wait()
 }
@@ -1,6 +1,7 @@
 package paste
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"flag"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/kylelemons/blightbot/bot"
 	"github.com/kylelemons/blightbot/commander"
@@ -19,6 +21,9 @@ var (
 	chans = flag.String("paste-chans", "", "Channels to send paste notifications on")
 )
 
+// How long to wait for an announcement to be delivered
+const announceTimeout = 10 * time.Minute
+
 func nopaste(s *commander.Source, r *commander.Response, cmd string, args []string) {
 	r.Public()
 	r.Printf("If you need to paste more than 3 lines, use gp: go get github.com/kylelemons/gopaste/gp")
@@ -31,6 +36,9 @@ var servers = struct {
 	m map[string]*bot.Server
 }{m: map[string]*bot.Server{}}
 
+// Announces pastes on every registered bot's servers.
+var loop sync.Once
+
 func addServer(event string, serv *bot.Server, msg *bot.Message) {
 	servers.Lock()
 	defer servers.Unlock()
@@ -42,19 +50,38 @@ func delServer(event string, serv *bot.Server, msg *bot.Message) {
 	servers.Lock()
 	defer servers.Unlock()
 
-	delete(servers.m, serv.Name())
+	// The server may already have been replaced by a reconnection
+	if servers.m[serv.Name()] == serv {
+		delete(servers.m, serv.Name())
+	}
 }
 
+// Register announces pastes on the bot's servers.  It may be called for
+// several bots.
 func Register(b *bot.Bot) {
 	if len(*chans) == 0 {
 		log.Printf("skipping paste init: no channels to notify")
 		return
 	}
 
-	b.OnConnect(addServer)
-	b.OnDisconnect(delServer)
+	// Synchronous, so that a reconnection can't be seen before the
+	// disconnection it follows.
+	b.OnConnect(addServer).Sync()
+	b.OnDisconnect(delServer).Sync()
+
+	loop.Do(func() { go pasteloop() })
+}
+
+// announce sends the text to the channel, and logs it if the server rejects
+// it (e.g. because the bot is not in the channel).
+func announce(srv *bot.Server, sname, channel, text string) {
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
 
-	go pasteloop()
+	msg := bot.NewMessage("", bot.CMD_PRIVMSG, channel, text)
+	if err := srv.SendPriority(ctx, msg, bot.PriorityBulk); err != nil {
+		log.Printf("Writing to %s on %s: %s", channel, sname, err)
+	}
 }
 
 func pasteloop() {
@@ -70,18 +97,11 @@ func pasteloop() {
 		servers.Lock()
 		defer servers.Unlock()
 
-		msg := &bot.Message{
-			Command: bot.CMD_PRIVMSG,
-			Args: []string{
-				"",
-				fmt.Sprintf("pasted: %s", url),
-			},
-		}
+		text := fmt.Sprintf("pasted: %s", url)
 		for sname, srv := range servers.m {
 			for _, channel := range chans {
 				log.Printf("Writing to %s on %s", channel, sname)
-				msg.Args[0] = channel
-				srv.WriteMessage(msg)
+				go announce(srv, sname, channel, text)
 			}
 		}
 	}